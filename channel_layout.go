@@ -0,0 +1,155 @@
+package avmuxer
+
+import (
+	"errors"
+	"math"
+)
+
+// ChannelMatrix converts interleaved audio between channel layouts. It has a
+// row per output channel and a column per input channel: output channel o is
+// the sum of every input channel i scaled by m[o][i].
+type ChannelMatrix [][]float64
+
+// DefaultChannelMatrix returns the matrix used when none is configured. Mono
+// is duplicated to every output channel, every input channel is averaged into
+// mono, and otherwise channels map one to one with extra outputs left silent.
+func DefaultChannelMatrix(in, out int) ChannelMatrix {
+	m := make(ChannelMatrix, out)
+	for o := range m {
+		m[o] = make([]float64, in)
+		switch {
+		case in == 1:
+			m[o][0] = 1
+		case out == 1:
+			for i := range m[o] {
+				m[o][i] = 1 / float64(in)
+			}
+		case o < in:
+			m[o][o] = 1
+		}
+	}
+	return m
+}
+
+func (m ChannelMatrix) validate(in, out int) error {
+	if len(m) != out {
+		return errors.New("channel matrix doesn't match the output channel count")
+	}
+	for _, row := range m {
+		if len(row) != in {
+			return errors.New("channel matrix doesn't match the input channel count")
+		}
+	}
+	return nil
+}
+
+// apply converts the interleaved frames of src into dst, which has to hold as
+// many frames in the output layout.
+func (m ChannelMatrix) apply(dst, src []int16) {
+	out, in := len(m), len(m[0])
+	for f := 0; f < len(src)/in; f++ {
+		frame := src[f*in : (f+1)*in]
+		for o, row := range m {
+			var acc float64
+			for i, g := range row {
+				acc += g * float64(frame[i])
+			}
+			dst[f*out+o] = clampInt16(int32(math.Round(acc)))
+		}
+	}
+}
+
+// streamConverter reads a stream converted to a sample rate and channel
+// layout. Streams whose Format has no channel count are read with their
+// layout unchanged.
+type streamConverter struct {
+	fifo *resampleFIFO
+	// channels is the layout of the stream, 0 when it reports none, and
+	// outChannels the layout it is converted to.
+	channels    int
+	outChannels int
+	matrix      ChannelMatrix
+	raw         []int16
+}
+
+func newStreamConverter(stream Stream, rate, channels int) (*streamConverter, error) {
+	f := stream.Format()
+	c := &streamConverter{
+		channels:    f.channels(0),
+		outChannels: channels,
+	}
+	if c.channels != 0 && channels != 0 && c.channels != channels {
+		c.matrix = DefaultChannelMatrix(c.channels, channels)
+	}
+	if in := f.rate(rate); in != rate {
+		fifo, err := newResampleFIFO(in, rate, f.channels(channels))
+		if err != nil {
+			return nil, err
+		}
+		c.fifo = fifo
+	}
+	return c, nil
+}
+
+// setMatrix replaces the default up or down mixing matrix.
+func (c *streamConverter) setMatrix(m ChannelMatrix) error {
+	if c.channels == 0 {
+		return errors.New("stream doesn't report its channel count")
+	}
+	if err := m.validate(c.channels, c.outChannels); err != nil {
+		return err
+	}
+	c.matrix = m
+	return nil
+}
+
+// read fills dst with converted audio from stream and returns the number of
+// samples written.
+func (c *streamConverter) read(stream Stream, dst []int16) (int, error) {
+	if c.matrix == nil {
+		return c.readStream(stream, dst)
+	}
+	frames := len(dst) / c.outChannels
+	if cap(c.raw) < frames*c.channels {
+		c.raw = make([]int16, frames*c.channels)
+	}
+	n, err := c.readStream(stream, c.raw[:frames*c.channels])
+	if err != nil {
+		return 0, err
+	}
+	frames = n / c.channels
+	c.matrix.apply(dst, c.raw[:frames*c.channels])
+	return frames * c.outChannels, nil
+}
+
+func (c *streamConverter) readStream(stream Stream, dst []int16) (int, error) {
+	if c.fifo != nil {
+		return c.fifo.readFrom(stream, dst)
+	}
+	return stream.ReadPCM(dst)
+}
+
+// SetChannelMatrix sets the matrix converting the source id to the channel
+// layout of the mix, replacing the default one. The source's Format has to
+// tell its channel count. Replacing the source's stream restores the default matrix.
+func (mr *Multiplexer) SetChannelMatrix(id string, m ChannelMatrix) error {
+	mr.Lock()
+	defer mr.Unlock()
+	s, ok := mr.sources[id]
+	if !ok {
+		return ErrSourceNotFound
+	}
+	return s.conv.setMatrix(m)
+}
+
+// SetChannelMatrix sets the matrix converting the input to the channel layout
+// of the encoder, replacing the default one.
+func (tc *Transcoder) SetChannelMatrix(m ChannelMatrix) error {
+	prev := tc.matrix
+	tc.matrix = m
+	if err := tc.configure(); err != nil {
+		tc.matrix = prev
+		return err
+	}
+	return nil
+}
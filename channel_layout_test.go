@@ -0,0 +1,116 @@
+package avmuxer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func interleave(frames int, channels ...int16) []int16 {
+	pcm := make([]int16, 0, frames*len(channels))
+	for i := 0; i < frames; i++ {
+		pcm = append(pcm, channels...)
+	}
+	return pcm
+}
+
+func TestDefaultChannelMatrix(t *testing.T) {
+	assert.Equal(t, ChannelMatrix{{1}, {1}}, DefaultChannelMatrix(1, 2))
+	assert.Equal(t, ChannelMatrix{{0.5, 0.5}}, DefaultChannelMatrix(2, 1))
+	assert.Equal(t, ChannelMatrix{{1, 0}, {0, 1}}, DefaultChannelMatrix(2, 2))
+	assert.Equal(t, ChannelMatrix{{1, 0}, {0, 1}, {0, 0}}, DefaultChannelMatrix(2, 3))
+}
+
+func TestChannelMatrix_Apply(t *testing.T) {
+	stereo := make([]int16, 4)
+	DefaultChannelMatrix(1, 2).apply(stereo, []int16{100, -200})
+	assert.Equal(t, []int16{100, 100, -200, -200}, stereo)
+
+	mono := make([]int16, 2)
+	DefaultChannelMatrix(2, 1).apply(mono, []int16{100, 300, 32767, 32767})
+	assert.Equal(t, []int16{200, 32767}, mono)
+
+	// gains above unity saturate
+	ChannelMatrix{{2}}.apply(mono, []int16{30000, -30000})
+	assert.Equal(t, []int16{32767, -32768}, mono)
+
+	assert.NoError(t, DefaultChannelMatrix(2, 1).validate(2, 1))
+	assert.Error(t, DefaultChannelMatrix(2, 1).validate(2, 2))
+	assert.Error(t, DefaultChannelMatrix(2, 1).validate(1, 1))
+}
+
+func TestMultiplexer_MixesChannelLayouts(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Channels: 2})
+	mono := &formatStream{newBufferStream(interleave(8, 1000)), Format{Channels: 1}}
+	stereo := &formatStream{newBufferStream(interleave(8, 2000, -2000)), Format{Channels: 2}}
+	assert.NoError(t, mux.AddSourceStream("mono", mono))
+	assert.NoError(t, mux.AddSourceStream("stereo", stereo))
+
+	assert.Equal(t, interleave(4, 3000, -1000), mux.ReadPCM(8))
+	// each source gave up four frames
+	assert.Equal(t, 4, mono.Len())
+	assert.Equal(t, 8, stereo.Len())
+
+	mux = NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("mono", mono))
+	assert.NoError(t, mux.AddSourceStream("stereo", stereo))
+	assert.Equal(t, interleave(4, 1000), mux.ReadPCM(4))
+}
+
+func TestMultiplexer_SetChannelMatrix(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Channels: 2})
+	stereo := &formatStream{newBufferStream(interleave(8, 2000, -2000)), Format{Channels: 2}}
+	assert.NoError(t, mux.AddSourceStream("stereo", stereo))
+	assert.NoError(t, mux.AddSourceStream("raw", &constantStream{value: 1}))
+
+	assert.ErrorIs(t, mux.SetChannelMatrix("missing", ChannelMatrix{{0, 1}, {1, 0}}), ErrSourceNotFound)
+	assert.Error(t, mux.SetChannelMatrix("raw", ChannelMatrix{{0, 1}, {1, 0}}))
+	assert.Error(t, mux.SetChannelMatrix("stereo", ChannelMatrix{{0.5, 0.5}}))
+
+	// swap left and right
+	assert.NoError(t, mux.SetChannelMatrix("stereo", ChannelMatrix{{0, 1}, {1, 0}}))
+	assert.Equal(t, interleave(2, -1999, 2001), mux.ReadPCM(4))
+}
+
+func TestMultiplexer_EncoderChannelLayout(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Channels: 2})
+	stereo := &formatStream{newBufferStream(interleave(8, 1000, 3000)), Format{Channels: 2}}
+	assert.NoError(t, mux.AddSourceStream("stereo", stereo))
+
+	enc := new(MockEncoder)
+	enc.On("SampleSize").Return(2)
+	enc.On("ChannelCount").Return(1)
+	enc.On("Encode", []int16{2000, 2000}, mock.Anything).Return(4, nil)
+	assert.NoError(t, mux.AddEncoder("enc", enc))
+
+	n, err := mux.Read(make([]byte, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	// one frame of the mono encoder is two stereo frames of the mix
+	assert.Equal(t, 12, stereo.Len())
+}
+
+func TestTranscoder_ChannelLayout(t *testing.T) {
+	stereo := &formatStream{newBufferStream(interleave(8, 1000, 3000)), Format{Channels: 2}}
+	enc := new(MockEncoder)
+	enc.On("SampleSize").Return(2)
+	enc.On("ChannelCount").Return(1)
+	enc.On("Encode", []int16{2000, 2000}, mock.Anything).Return(4, nil).Once()
+	enc.On("Encode", []int16{1000, 1000}, mock.Anything).Return(4, nil).Once()
+
+	transcoder := NewTranscoder()
+	assert.NoError(t, transcoder.AddSource(stereo))
+	assert.NoError(t, transcoder.AddEncoder(enc))
+
+	dst := make([]byte, 100)
+	_, err := transcoder.Read(dst)
+	assert.NoError(t, err)
+
+	assert.Error(t, transcoder.SetChannelMatrix(ChannelMatrix{{1, 0}, {0, 1}}))
+	// keep the left channel only
+	assert.NoError(t, transcoder.SetChannelMatrix(ChannelMatrix{{1, 0}}))
+	_, err = transcoder.Read(dst)
+	assert.NoError(t, err)
+	enc.AssertExpectations(t)
+}
@@ -0,0 +1,151 @@
+package avmuxer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for every timing dependent component of the
+// package, so tests can substitute a ManualClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer mirrors the subset of time.Timer used by the package.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package. Times it returns carry a
+// monotonic reading.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// ManualClock is a Clock that only moves when Advance or Set is called, firing
+// any timers whose deadline has been reached.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (mc *ManualClock) Now() time.Time {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.now
+}
+
+func (mc *ManualClock) NewTimer(d time.Duration) Timer {
+	t := &manualTimer{clock: mc, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.Set(mc.Now().Add(d))
+}
+
+// Set moves the clock to t and fires the timers due by then, earliest first.
+func (mc *ManualClock) Set(t time.Time) {
+	mc.mu.Lock()
+	mc.now = t
+	var due []*manualTimer
+	pending := mc.timers[:0]
+	for _, timer := range mc.timers {
+		if !timer.deadline.After(t) {
+			due = append(due, timer)
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	mc.timers = pending
+	mc.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].deadline.Before(due[j].deadline)
+	})
+	for _, timer := range due {
+		timer.fire(t)
+	}
+}
+
+// Timers returns the number of timers waiting to fire.
+func (mc *ManualClock) Timers() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.timers)
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Reset arms the timer to fire d from the clock's current time. A deadline that
+// has already passed fires straight away.
+func (t *manualTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+	mc := t.clock
+	mc.mu.Lock()
+	now := mc.now
+	t.deadline = now.Add(d)
+	if d > 0 {
+		mc.timers = append(mc.timers, t)
+	}
+	mc.mu.Unlock()
+	if d <= 0 {
+		t.fire(now)
+	}
+	return active
+}
+
+func (t *manualTimer) Stop() bool {
+	mc := t.clock
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for i, timer := range mc.timers {
+		if timer == t {
+			mc.timers = append(mc.timers[:i], mc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *manualTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
@@ -0,0 +1,43 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClock_Timers(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	t1 := clock.NewTimer(10 * time.Millisecond)
+	t2 := clock.NewTimer(30 * time.Millisecond)
+	assert.Equal(t, 2, clock.Timers())
+
+	clock.Advance(5 * time.Millisecond)
+	assert.Len(t, t1.C(), 0)
+
+	clock.Advance(5 * time.Millisecond)
+	assert.Equal(t, start.Add(10*time.Millisecond), <-t1.C())
+	assert.Len(t, t2.C(), 0)
+	assert.Equal(t, 1, clock.Timers())
+
+	assert.True(t, t2.Stop())
+	assert.False(t, t2.Stop())
+	clock.Advance(time.Second)
+	assert.Len(t, t2.C(), 0)
+
+	// a deadline that already passed fires on reset
+	assert.False(t, t1.Reset(0))
+	assert.Equal(t, start.Add(1010*time.Millisecond), <-t1.C())
+}
+
+func TestSystemClock(t *testing.T) {
+	timer := SystemClock.NewTimer(time.Millisecond)
+	before := SystemClock.Now()
+	fired := <-timer.C()
+	assert.False(t, fired.Before(before.Add(-time.Millisecond)))
+	assert.False(t, timer.Stop())
+}
@@ -1,124 +1,76 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"time"
 
-	"github.com/pion/webrtc/v4/pkg/media/oggreader"
-	"gopkg.in/hraban/opus.v2"
+	"github.com/itzmanish/avmuxer"
 )
 
-// Helper function to convert int16 PCM data to byte slice
-func int16ToByteSlice(samples []int16) []byte {
-	byteSlice := make([]byte, len(samples)*2)
-	for i, sample := range samples {
-		byteSlice[i*2] = byte(sample)
-		byteSlice[i*2+1] = byte(sample >> 8)
-	}
-	return byteSlice
-}
-
-// Helper function to convert byte slice to int16 PCM data
-func byteSliceToInt16(samples []byte) []int16 {
-	pcm := make([]int16, len(samples)/2)
-	for i := 0; i < len(samples); i += 2 {
-		pcm[i/2] = int16(samples[i]) | int16(samples[i+1])<<8
-	}
-	return pcm
-}
-
 func main() {
 	// Open the input OGG file
-	inputFile, err := os.Open("3.ogg")
+	input, err := avmuxer.NewOggOpusFileStream("3.ogg")
 	if err != nil {
 		log.Fatalf("Error opening input file: %v", err)
 	}
-	defer inputFile.Close()
+	defer input.Close()
+	channels := input.ChannelCount()
 
-	// Create a new Opus decoder
-	clockRate := 48000 // 48 kHz
-	channels := 2      // Stereo
-	decoder, err := opus.NewDecoder(clockRate, channels)
+	// Create a new Opus encoder, 20ms frames at 48 kHz
+	frameSize := 960
+	encoder, err := avmuxer.NewOpusEncoder(48000, channels, frameSize)
 	if err != nil {
-		log.Fatalln("failed to init decoder", err)
+		log.Fatalf("Error creating Opus encoder: %v", err)
 	}
 
-	// Create a buffer to hold the decoded PCM data
-	var pcmBuffer bytes.Buffer
-	// Decode the Opus data from the OGG file
-	oggReader, _, err := oggreader.NewWith(inputFile)
+	// Create the output PCM and OGG files
+	pcmFile, err := os.Create("3.pcm")
 	if err != nil {
-		log.Fatalf("Error initializing ogg reader: %w", err)
+		log.Fatalf("Error creating output file: %v", err)
+	}
+	defer pcmFile.Close()
+	oggWriter, err := avmuxer.NewOggOpusFileWriter("3-out.ogg", avmuxer.OggOpusWriterOptions{
+		Channels:        channels,
+		InputSampleRate: input.Head().InputSampleRate,
+		Comments:        input.Tags().Comments,
+	})
+	if err != nil {
+		log.Fatalf("Error creating output file: %v", err)
 	}
-	var lastGranule uint64 = 0
+
+	// Decode the OGG file to PCM and encode it back to Opus
+	pcm := make([]int16, frameSize*channels)
+	opusData := make([]byte, 4000)
+	saved := 0
 	for {
-		opusData, header, err := oggReader.ParseNextPage()
+		n, err := input.ReadPCM(pcm)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Fatalf("Error reading ogg data: %w", err)
-			}
+			log.Fatalf("Error reading ogg data: %v", err)
 		}
-		sampleCount := float64(header.GranulePosition - lastGranule)
-		lastGranule = header.GranulePosition
-		sampleDuration := time.Duration((sampleCount/float64(clockRate))*1000) * time.Millisecond
-
-		samples := uint64(sampleDuration.Seconds() * float64(clockRate))
-		log.Printf("samples: %v, sampleCount: %v, duration: %v, header: %+v, raw: %v", samples, sampleCount, sampleDuration, header, opusData)
-		if sampleCount == 0 {
-			continue
+		if _, err := pcmFile.Write(avmuxer.Int16ToByteSlice(pcm[:n])); err != nil {
+			log.Fatalf("failed to write pcm data to file: %v", err)
 		}
-		pcm := make([]int16, 960*channels)
-		n, err := decoder.Decode(opusData, pcm)
+		saved += n * 2
+
+		// the last frame is padded with silence
+		clear(pcm[n:])
+		size, err := encoder.Encode(pcm, opusData)
 		if err != nil {
-			log.Fatalf("Error decoding Opus data: %v", err)
+			log.Fatalf("Error encoding Opus data: %v", err)
+		}
+		if _, err := oggWriter.Write(opusData[:size]); err != nil {
+			log.Fatalf("Error writing ogg data: %v", err)
 		}
-		log.Printf("n: %v, pcm: %v, len(pcm): %v", n, pcm, len(pcm))
-		pcmBytes := int16ToByteSlice(pcm[:n*channels])
-		pcmBuffer.Write(pcmBytes)
-	}
-
-	// // Create a new Opus encoder
-	// encoder, err := opus.NewEncoder(clockRate, channels, opus.AppAudio)
-	// if err != nil {
-	// 	log.Fatalf("Error creating Opus encoder: %v", err)
-	// }
-
-	// Create the output OGG file
-	outputFile, err := os.Create("3.pcm")
-	if err != nil {
-		log.Fatalf("Error creating output file: %v", err)
 	}
-	defer outputFile.Close()
-
-	// Encode the PCM data back to Opus and write to the OGG file
-	pcmData := pcmBuffer.Bytes()
-
-	n, err := outputFile.Write(pcmData)
-	if err != nil {
-		log.Fatalf("failed to write pcm data to file: %w", err)
+	if err := oggWriter.Close(); err != nil {
+		log.Fatalf("Error closing ogg file: %v", err)
 	}
-	log.Println("saved: %v bytes", n)
-	// pcmSamples := byteSliceToInt16(pcmData)
-	// for len(pcmSamples) > 0 {
-	// 	frameSize := 960
-	// 	if len(pcmSamples) < frameSize*channels {
-	// 		frameSize = len(pcmSamples) / channels
-	// 	}
-	// 	opusData := make([]byte, 4000)
-	// 	n, err := encoder.Encode(pcmSamples[:frameSize*channels], opusData)
-	// 	if err != nil {
-	// 		log.Fatalf("Error encoding Opus data: %v", err)
-	// 	}
-	// 	opusData = opusData[:n]
-	// 	oggWriter.WritePacket(opusData, 0, len(opusData))
-	// 	pcmSamples = pcmSamples[frameSize*channels:]
-	// }
+	log.Printf("saved: %v bytes", saved)
 
 	fmt.Println("Conversion complete!")
 }
@@ -18,19 +18,13 @@ import (
 	"log"
 	"os"
 	"strings"
-	"time"
 
-	"github.com/hraban/opus"
+	"github.com/itzmanish/avmuxer"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media"
-	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 	"golang.design/x/clipboard"
 )
 
-const (
-	audioFileName   = "1.ogg"
-	oggPageDuration = time.Millisecond * 20
-)
+const audioFileName = "1.ogg"
 
 // nolint:gocognit
 func _main() {
@@ -85,69 +79,33 @@ func _main() {
 		}()
 
 		go func() {
-			// Open a OGG file and start reading using our OGGReader
-			file, oggErr := os.Open(audioFileName)
+			// Open the OGG file, looping it once it ends
+			input, oggErr := avmuxer.NewOggOpusFileStream(audioFileName, avmuxer.OggOpusOptions{Loop: true})
 			if oggErr != nil {
 				panic(oggErr)
 			}
+			defer input.Close()
 
-			// Open on oggfile in non-checksum mode.
-			ogg, _, oggErr := oggreader.NewWith(file)
+			// Re-encode the decoded audio in 20ms frames
+			encoder, oggErr := avmuxer.NewOpusEncoder(48000, input.ChannelCount(), 960)
 			if oggErr != nil {
 				panic(oggErr)
 			}
+			transcoder := avmuxer.NewTranscoder()
+			if oggErr = transcoder.AddSource(input); oggErr != nil {
+				panic(oggErr)
+			}
+			if oggErr = transcoder.AddEncoder(encoder); oggErr != nil {
+				panic(oggErr)
+			}
 
 			// Wait for connection established
 			<-iceConnectedCtx.Done()
 
-			// Keep track of last granule, the difference is the amount of samples in the buffer
-			var lastGranule uint64
-			decoder, err := opus.NewDecoder(48000, 2)
-			if err != nil {
-				log.Fatal("failed to create decoder", err)
-			}
-			// It is important to use a time.Ticker instead of time.Sleep because
-			// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
-			// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-			ticker := time.NewTicker(oggPageDuration)
-			defer ticker.Stop()
-
-			for ; true; <-ticker.C {
-				pageData, pageHeader, oggErr := ogg.ParseNextPage()
-				if errors.Is(oggErr, io.EOF) {
-					file.Seek(0, io.SeekStart)
-					ogg, _, oggErr = oggreader.NewWith(file)
-					if oggErr != nil {
-						panic(oggErr)
-					}
-					lastGranule = 0
-				}
-
-				if oggErr != nil {
-					panic(oggErr)
-				}
-
-				// The amount of samples is the difference between the last and current timestamp
-				sampleCount := float64(pageHeader.GranulePosition - lastGranule)
-				lastGranule = pageHeader.GranulePosition
-				sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
-				log.Printf("header: %+v, sampleCount: %v, sampleDuration: %v, raw: %v", pageHeader, sampleCount, sampleDuration, pageData)
-				if pageHeader.GranulePosition/960 > 5 {
-					os.Exit(1)
-				}
-
-				if oggErr = audioTrack.WriteSample(media.Sample{Data: pageData, Duration: sampleDuration}); oggErr != nil {
-					panic(oggErr)
-				}
-				if sampleCount == 0 {
-					continue
-				}
-				pcm := make([]int16, int(sampleCount*2))
-				i, err := decoder.Decode(pageData, pcm)
-				if err != nil {
-					log.Fatal("failed to decode opus data", err)
-				}
-				log.Println("decoded count: ", i)
+			// PumpTrack paces the frames against the start time so no skew
+			// accumulates
+			if oggErr = avmuxer.PumpTrack(context.Background(), transcoder, audioTrack); oggErr != nil {
+				log.Fatalf("failed to send audio: %v", oggErr)
 			}
 		}()
 	}
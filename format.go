@@ -0,0 +1,126 @@
+package avmuxer
+
+import (
+	"fmt"
+	"time"
+)
+
+// SampleFormat is the encoding of the samples in PCM.
+type SampleFormat int
+
+const (
+	// SampleFormatUnknown is reported by streams that don't describe their
+	// samples.
+	SampleFormatUnknown SampleFormat = iota
+	// SampleFormatS16 is interleaved signed 16 bit PCM, which is what
+	// ReadPCM, WritePCM, Encode and Decode exchange.
+	SampleFormatS16
+)
+
+func (sf SampleFormat) String() string {
+	switch sf {
+	case SampleFormatUnknown:
+		return "unknown"
+	case SampleFormatS16:
+		return "s16"
+	}
+	return fmt.Sprintf("SampleFormat(%d)", int(sf))
+}
+
+// Format describes the PCM a stream, encoder or decoder produces or consumes.
+// Fields left zero are unknown: a source with an unknown sample rate or
+// channel count is mixed as it is.
+type Format struct {
+	SampleRate   int
+	Channels     int
+	SampleFormat SampleFormat
+	// FrameDuration is the duration of the frames the stream is read or
+	// written in.
+	FrameDuration time.Duration
+}
+
+// pcmFormat describes int16 PCM.
+func pcmFormat(sampleRate, channels int, frameDuration time.Duration) Format {
+	return Format{
+		SampleRate:    sampleRate,
+		Channels:      channels,
+		SampleFormat:  SampleFormatS16,
+		FrameDuration: frameDuration,
+	}
+}
+
+// FrameSize returns the number of interleaved samples in a frame, or 0 when
+// the format doesn't tell.
+func (f Format) FrameSize() int {
+	return int(int64(f.SampleRate)*int64(f.FrameDuration)/int64(time.Second)) * f.Channels
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d Hz, %d channels, %v, %v", f.SampleRate, f.Channels, f.SampleFormat, f.FrameDuration)
+}
+
+// rate returns the sample rate, or def when it is unknown.
+func (f Format) rate(def int) int {
+	if f.SampleRate > 0 {
+		return f.SampleRate
+	}
+	return def
+}
+
+// channels returns the channel count, or def when it is unknown.
+func (f Format) channels(def int) int {
+	if f.Channels > 0 {
+		return f.Channels
+	}
+	return def
+}
+
+// validate reports formats that cannot be converted to the mix.
+func (f Format) validate() error {
+	if f.SampleRate < 0 {
+		return fmt.Errorf("invalid sample rate %d", f.SampleRate)
+	}
+	if f.Channels < 0 {
+		return fmt.Errorf("invalid channel count %d", f.Channels)
+	}
+	if f.FrameDuration < 0 {
+		return fmt.Errorf("invalid frame duration %v", f.FrameDuration)
+	}
+	if f.SampleFormat != SampleFormatUnknown && f.SampleFormat != SampleFormatS16 {
+		return fmt.Errorf("unsupported sample format %v", f.SampleFormat)
+	}
+	if f.SampleRate > 0 && int64(f.SampleRate)*int64(f.FrameDuration)%int64(time.Second) != 0 {
+		return fmt.Errorf("frame duration %v is not a whole number of samples at %d Hz", f.FrameDuration, f.SampleRate)
+	}
+	return nil
+}
+
+// validateSource checks that the source id can be converted to the mix.
+func validateSource(id string, stream Stream) error {
+	f := stream.Format()
+	if err := f.validate(); err != nil {
+		return fmt.Errorf("source %v format %v: %w", id, f, err)
+	}
+	return nil
+}
+
+// frameDuration returns the duration of size samples at sampleRate.
+func frameDuration(size, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(size) * time.Second / time.Duration(sampleRate)
+}
+
+// validateEncoder checks that enc can encode a mix running at mixRate.
+func validateEncoder(enc Encoder, mixRate int) error {
+	f := enc.Format()
+	if err := f.validate(); err != nil {
+		return fmt.Errorf("encoder format %v: %w", f, err)
+	}
+	if f.SampleRate > 0 && enc.SampleSize()*mixRate%f.SampleRate != 0 {
+		return fmt.Errorf("encoder frame of %d samples at %d Hz is not a whole number of samples at %d Hz",
+			enc.SampleSize(), f.SampleRate, mixRate)
+	}
+	return nil
+}
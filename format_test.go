@@ -0,0 +1,105 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// formatStream is a bufferStream with a given format
+type formatStream struct {
+	*bufferStream
+	format Format
+}
+
+func (fs *formatStream) Format() Format {
+	return fs.format
+}
+
+// formatEncoder is an Encoder with a given format that encodes nothing
+type formatEncoder struct {
+	format Format
+	size   int
+}
+
+func (fe *formatEncoder) Encode([]int16, []byte) (int, error) {
+	return 0, nil
+}
+
+func (fe *formatEncoder) SampleSize() int {
+	return fe.size
+}
+
+func (fe *formatEncoder) ChannelCount() int {
+	return fe.format.Channels
+}
+
+func (fe *formatEncoder) Format() Format {
+	return fe.format
+}
+
+func TestFormat_Validate(t *testing.T) {
+	assert.NoError(t, Format{}.validate())
+	assert.NoError(t, pcmFormat(48000, 2, 20*time.Millisecond).validate())
+	assert.NoError(t, pcmFormat(44100, 1, 10*time.Millisecond).validate())
+
+	assert.EqualError(t, Format{SampleRate: -1}.validate(), "invalid sample rate -1")
+	assert.EqualError(t, Format{Channels: -2}.validate(), "invalid channel count -2")
+	assert.EqualError(t, Format{FrameDuration: -time.Millisecond}.validate(), "invalid frame duration -1ms")
+	assert.EqualError(t, Format{SampleFormat: SampleFormat(7)}.validate(), "unsupported sample format SampleFormat(7)")
+	assert.EqualError(t, pcmFormat(44100, 1, 5*time.Millisecond/2).validate(),
+		"frame duration 2.5ms is not a whole number of samples at 44100 Hz")
+}
+
+func TestFormat_FrameSize(t *testing.T) {
+	assert.Equal(t, 1920, pcmFormat(48000, 2, 20*time.Millisecond).FrameSize())
+	assert.Equal(t, 160, pcmFormat(8000, 1, 20*time.Millisecond).FrameSize())
+	assert.Equal(t, 0, Format{SampleRate: 8000}.FrameSize())
+	assert.Equal(t, "48000 Hz, 2 channels, s16, 20ms", pcmFormat(48000, 2, 20*time.Millisecond).String())
+}
+
+func TestStreamFormats(t *testing.T) {
+	g711, err := NewG711Stream("g711", G711Type_Alaw)
+	assert.NoError(t, err)
+	assert.Equal(t, pcmFormat(8000, 1, 0), g711.Format())
+
+	enc, err := NewG711EncoderWithDuration(G711Type_Ulaw, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, pcmFormat(8000, 1, 30*time.Millisecond), enc.Format())
+
+	opus, err := NewDecodingOpusStream("opus", 48000, 20, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, pcmFormat(48000, 2, 20*time.Millisecond), opus.Format())
+
+	dec, err := NewOpusDecoder(16000, 1, 320)
+	assert.NoError(t, err)
+	assert.Equal(t, pcmFormat(16000, 1, 20*time.Millisecond), dec.Format())
+
+	transcoder := NewTranscoder()
+	assert.Equal(t, Format{}, transcoder.Format())
+	assert.NoError(t, transcoder.AddSource(opus))
+	assert.Equal(t, opus.Format(), transcoder.Format())
+}
+
+func TestMultiplexer_ValidatesFormats(t *testing.T) {
+	mux := NewMultiplexer()
+	bad := &formatStream{newBufferStream(nil), Format{SampleRate: 8000, SampleFormat: SampleFormat(9)}}
+	assert.EqualError(t, mux.AddSourceStream("bad", bad),
+		"source bad format 8000 Hz, 0 channels, SampleFormat(9), 0s: unsupported sample format SampleFormat(9)")
+	assert.Empty(t, mux.Sources())
+
+	assert.NoError(t, mux.AddSourceStream("good", &constantStream{}))
+	assert.Error(t, mux.ReplaceSourceStream("good", bad))
+
+	// 100 samples at 11025 Hz is not a whole number of samples at 48 kHz
+	odd := &formatEncoder{pcmFormat(11025, 1, 0), 100}
+	assert.EqualError(t, mux.AddEncoder("odd", odd),
+		"encoder frame of 100 samples at 11025 Hz is not a whole number of samples at 48000 Hz")
+	assert.Error(t, mux.AddEncoderFor("good", odd))
+	assert.NoError(t, mux.AddEncoder("wide", &formatEncoder{pcmFormat(44100, 1, 10*time.Millisecond), 441}))
+
+	transcoder := NewTranscoder()
+	assert.Error(t, transcoder.AddSource(bad))
+	assert.Error(t, transcoder.AddEncoder(&formatEncoder{format: Format{Channels: -1}}))
+}
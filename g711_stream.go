@@ -46,6 +46,18 @@ func NewG711Stream(id string, stype G711Type) (Stream, error) {
 	}, nil
 }
 
+func (gs *G711Stream) SampleRate() int {
+	return G711SampleRate
+}
+
+func (gs *G711Stream) ChannelCount() int {
+	return 1
+}
+
+func (gs *G711Stream) Format() Format {
+	return pcmFormat(G711SampleRate, 1, 0)
+}
+
 func (gs *G711Stream) Write(pkt []byte) (int, error) {
 	return gs.inputBuffer.Write(pkt)
 }
@@ -71,3 +83,154 @@ func (gs *G711Stream) ReadPCM(dst []int16) (int, error) {
 func (gs *G711Stream) WritePCM(data []int16) (int, error) {
 	return 0, errors.New("g711 stream doesn't support write pcm")
 }
+
+const (
+	G711SampleRate = 8000
+	// g711DefaultDurationMs is the usual packetization time of G.711.
+	g711DefaultDurationMs = 20
+)
+
+// G711Encoder encodes 8 kHz mono PCM to A-law or µ-law, one byte per sample.
+type G711Encoder struct {
+	stype G711Type
+	size  int
+}
+
+// NewG711Encoder creates an Encoder producing 20 ms frames.
+func NewG711Encoder(stype G711Type) (Encoder, error) {
+	return NewG711EncoderWithDuration(stype, g711DefaultDurationMs)
+}
+
+// NewG711EncoderWithDuration creates an Encoder producing frames of
+// sampleDurationMs.
+func NewG711EncoderWithDuration(stype G711Type, sampleDurationMs int) (Encoder, error) {
+	if stype != G711Type_Alaw && stype != G711Type_Ulaw {
+		return nil, fmt.Errorf("unknown g711 stream type: %v", stype)
+	}
+	if sampleDurationMs <= 0 {
+		return nil, fmt.Errorf("invalid g711 sample duration: %v", sampleDurationMs)
+	}
+	return &G711Encoder{
+		stype: stype,
+		size:  G711SampleRate * sampleDurationMs / 1000,
+	}, nil
+}
+
+func (ge *G711Encoder) SampleRate() int {
+	return G711SampleRate
+}
+
+func (ge *G711Encoder) Format() Format {
+	return pcmFormat(G711SampleRate, 1, frameDuration(ge.size, G711SampleRate))
+}
+
+func (ge *G711Encoder) SampleSize() int {
+	return ge.size
+}
+
+func (ge *G711Encoder) ChannelCount() int {
+	return 1
+}
+
+func (ge *G711Encoder) Encode(in []int16, out []byte) (int, error) {
+	if len(out) < len(in) {
+		return 0, io.ErrShortBuffer
+	}
+	for i, sample := range in {
+		if ge.stype == G711Type_Alaw {
+			out[i] = g711.EncodeAlawFrame(sample)
+		} else {
+			out[i] = g711.EncodeUlawFrame(sample)
+		}
+	}
+	return len(in), nil
+}
+
+// G711EncodingStream is the encoding counterpart of G711Stream: PCM written
+// with WritePCM is encoded and read back with Read.
+type G711EncodingStream struct {
+	id string
+
+	sink    io.Writer
+	encoder *G711Encoder
+	buffer  *RingBuffer[byte]
+}
+
+func NewG711EncodingStream(id string, stype G711Type) (*G711EncodingStream, error) {
+	enc, err := NewG711Encoder(stype)
+	if err != nil {
+		return nil, err
+	}
+	ge := enc.(*G711Encoder)
+	return &G711EncodingStream{
+		id:      id,
+		encoder: ge,
+		// hold a few frames worth of encoded audio
+		buffer: NewRingBuffer[byte](ge.SampleSize() * 10),
+	}, nil
+}
+
+func (ges *G711EncodingStream) ID() string {
+	return ges.id
+}
+
+func (ges *G711EncodingStream) SampleRate() int {
+	return G711SampleRate
+}
+
+func (ges *G711EncodingStream) Format() Format {
+	return ges.encoder.Format()
+}
+
+func (ges *G711EncodingStream) SampleSize() int {
+	return ges.encoder.SampleSize()
+}
+
+func (ges *G711EncodingStream) ChannelCount() int {
+	return ges.encoder.ChannelCount()
+}
+
+func (ges *G711EncodingStream) Encode(in []int16, out []byte) (int, error) {
+	return ges.encoder.Encode(in, out)
+}
+
+func (ges *G711EncodingStream) WritePCM(data []int16) (int, error) {
+	encoded := make([]byte, len(data))
+	n, err := ges.Encode(data, encoded)
+	if err != nil {
+		return 0, err
+	}
+	if ges.sink != nil {
+		_, err = ges.sink.Write(encoded[:n])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return ges.buffer.Write(encoded[:n])
+}
+
+// Write encodes little endian 16 bit PCM.
+func (ges *G711EncodingStream) Write(data []byte) (int, error) {
+	return ges.WritePCM(ByteSliceToInt16(data))
+}
+
+// Read reads encoded G.711 data.
+func (ges *G711EncodingStream) Read(dst []byte) (int, error) {
+	n, err := ges.buffer.Read(dst)
+	if err == ErrEmptyBuffer {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (*G711EncodingStream) ReadPCM([]int16) (int, error) {
+	return 0, errors.New("g711 encoding stream doesn't support reading pcm")
+}
+
+func (ges *G711EncodingStream) Connect(writer io.Writer) error {
+	if ges.sink != nil {
+		return errors.New("stream already connected to other reader")
+	}
+	ges.sink = writer
+	return nil
+}
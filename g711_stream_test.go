@@ -0,0 +1,95 @@
+package avmuxer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zaf/g711"
+)
+
+func TestNewG711Encoder(t *testing.T) {
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.Equal(t, 160, enc.SampleSize())
+	assert.Equal(t, 1, enc.ChannelCount())
+
+	enc, err = NewG711EncoderWithDuration(G711Type_Alaw, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, 240, enc.SampleSize())
+
+	_, err = NewG711Encoder(G711Type(0))
+	assert.Error(t, err)
+	_, err = NewG711EncoderWithDuration(G711Type_Alaw, 0)
+	assert.Error(t, err)
+}
+
+func TestG711Encoder_Encode(t *testing.T) {
+	pcm := generateTestPCM(100, 2)
+	for _, stype := range []G711Type{G711Type_Alaw, G711Type_Ulaw} {
+		enc, err := NewG711Encoder(stype)
+		assert.NoError(t, err)
+
+		_, err = enc.Encode(pcm, make([]byte, 10))
+		assert.ErrorIs(t, err, io.ErrShortBuffer)
+
+		out := make([]byte, len(pcm))
+		n, err := enc.Encode(pcm, out)
+		assert.NoError(t, err)
+		assert.Equal(t, len(pcm), n)
+
+		// decode it back through the decoding stream
+		dec, err := NewG711Stream("dec", stype)
+		assert.NoError(t, err)
+		_, err = dec.(*G711Stream).Write(out[:n])
+		assert.NoError(t, err)
+		decoded := make([]int16, len(pcm))
+		n, err = dec.ReadPCM(decoded)
+		assert.NoError(t, err)
+		assert.Equal(t, len(pcm), n)
+		for i := range pcm {
+			assert.InDelta(t, pcm[i], decoded[i], float64(pcm[i])/16+16)
+		}
+	}
+}
+
+func TestG711EncodingStream(t *testing.T) {
+	stream, err := NewG711EncodingStream("enc", G711Type_Alaw)
+	assert.NoError(t, err)
+	assert.Equal(t, "enc", stream.ID())
+
+	sink := &bytes.Buffer{}
+	assert.NoError(t, stream.Connect(sink))
+	assert.Error(t, stream.Connect(sink))
+
+	pcm := generateTestPCM(160, 1)
+	n, err := stream.WritePCM(pcm)
+	assert.NoError(t, err)
+	assert.Equal(t, 160, n)
+
+	out := make([]byte, 200)
+	n, err = stream.Read(out)
+	assert.NoError(t, err)
+	assert.Equal(t, g711.EncodeAlaw(Int16ToByteSlice(pcm)), out[:n])
+	assert.Equal(t, out[:n], sink.Bytes())
+
+	_, err = stream.Read(out)
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = stream.ReadPCM(pcm)
+	assert.Error(t, err)
+}
+
+func TestMultiplexer_G711Encoder(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{SampleRate: G711SampleRate, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 1000}))
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddEncoder("pstn", enc))
+
+	out := make([]byte, 400)
+	n, err := mux.Read(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 160, n)
+	assert.Equal(t, g711.EncodeUlawFrame(1000), out[0])
+}
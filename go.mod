@@ -3,7 +3,7 @@ module github.com/itzmanish/avmuxer
 go 1.22.1
 
 require (
-	github.com/hraban/opus v0.0.0-20230925203106-0188a62cb302
+	github.com/pion/rtp v1.8.7
 	github.com/pion/webrtc/v4 v4.0.0-beta.26
 	github.com/stretchr/testify v1.9.0
 	github.com/zaf/g711 v1.4.0
@@ -23,7 +23,6 @@ require (
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/rtcp v1.2.14 // indirect
-	github.com/pion/rtp v1.8.7 // indirect
 	github.com/pion/sctp v1.8.19 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.3 // indirect
@@ -0,0 +1,336 @@
+package avmuxer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJitterMinDelay = 20 * time.Millisecond
+	defaultJitterMaxDelay = 200 * time.Millisecond
+	// jitterDelayFactor is how many multiples of the measured jitter are
+	// buffered on top of one frame.
+	jitterDelayFactor = 3
+	// jitterMaxSeqJump is the sequence number jump, forward or back, past
+	// which the sender is taken to have restarted and the buffer resyncs.
+	jitterMaxSeqJump = 1000
+)
+
+// JitterBufferOptions configures a JitterBuffer.
+type JitterBufferOptions struct {
+	// ClockRate is the rate of the RTP timestamps, defaults to 48000.
+	ClockRate int
+	// FrameDuration is the duration of one packet, defaults to 20 ms.
+	FrameDuration time.Duration
+	// MinDelay and MaxDelay bound the adaptive target delay, they default to
+	// 20 ms and 200 ms.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxPackets bounds the number of packets held, the oldest are dropped
+	// when more arrive. It defaults to twice the packets of MaxDelay.
+	MaxPackets int
+	// Clock timestamps packet arrivals, defaults to SystemClock.
+	Clock Clock
+}
+
+// validate rejects negative options, zero ones are replaced by their
+// defaults.
+func (o JitterBufferOptions) validate() error {
+	switch {
+	case o.ClockRate < 0:
+		return fmt.Errorf("invalid jitter buffer clock rate: %v", o.ClockRate)
+	case o.FrameDuration < 0:
+		return fmt.Errorf("invalid jitter buffer frame duration: %v", o.FrameDuration)
+	case o.MinDelay < 0 || o.MaxDelay < 0:
+		return fmt.Errorf("invalid jitter buffer delay: %v to %v", o.MinDelay, o.MaxDelay)
+	case o.MaxPackets < 0:
+		return fmt.Errorf("invalid jitter buffer size: %v packets", o.MaxPackets)
+	}
+	return nil
+}
+
+func (o JitterBufferOptions) withDefaults() JitterBufferOptions {
+	if o.ClockRate == 0 {
+		o.ClockRate = 48000
+	}
+	if o.FrameDuration == 0 {
+		o.FrameDuration = 20 * time.Millisecond
+	}
+	if o.MinDelay == 0 {
+		o.MinDelay = defaultJitterMinDelay
+	}
+	if o.MaxDelay == 0 {
+		o.MaxDelay = defaultJitterMaxDelay
+	}
+	if o.MaxDelay < o.MinDelay {
+		o.MaxDelay = o.MinDelay
+	}
+	if o.MaxPackets == 0 {
+		o.MaxPackets = max(1, int(2*o.MaxDelay/o.FrameDuration))
+	}
+	if o.Clock == nil {
+		o.Clock = SystemClock
+	}
+	return o
+}
+
+// JitterStats is a snapshot of the state of a JitterBuffer.
+type JitterStats struct {
+	// CurrentDelay is the duration of audio buffered.
+	CurrentDelay time.Duration
+	// TargetDelay is the delay the buffer fills up to before playing out.
+	TargetDelay time.Duration
+	// Jitter is the RFC 3550 interarrival jitter estimate.
+	Jitter   time.Duration
+	Buffered int
+	// Late counts packets that arrived after their playout time and were
+	// discarded.
+	Late uint64
+	// Lost counts packets that were missing at their playout time.
+	Lost      uint64
+	Reordered uint64
+	Duplicate uint64
+	// Dropped counts packets discarded to bring the delay down after the
+	// target shrank, when the buffer overflowed or when it resynced.
+	Dropped uint64
+}
+
+type jitterStatus int
+
+const (
+	// jitterReady means a packet is returned.
+	jitterReady jitterStatus = iota
+	// jitterLost means the next packet is missing while later ones are
+	// buffered.
+	jitterLost
+	// jitterEmpty means there is nothing to play out yet.
+	jitterEmpty
+)
+
+type jitterPacket struct {
+	timestamp uint32
+	payload   []byte
+}
+
+// JitterBuffer reorders packets by RTP sequence number and releases them once
+// enough audio is buffered to absorb the measured network jitter.
+type JitterBuffer struct {
+	mu   sync.Mutex
+	opts JitterBufferOptions
+
+	// packets is keyed by extended sequence number.
+	packets map[uint64]jitterPacket
+	started bool
+	playing bool
+	played  bool
+	highest uint64
+	next    uint64
+
+	arrivals interarrivalJitter
+	target   time.Duration
+
+	stats JitterStats
+}
+
+// NewJitterBuffer creates a JitterBuffer, rejecting negative options.
+func NewJitterBuffer(opts JitterBufferOptions) (*JitterBuffer, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	return &JitterBuffer{
+		opts:     opts,
+		packets:  make(map[uint64]jitterPacket),
+		arrivals: interarrivalJitter{clockRate: opts.ClockRate},
+		target:   opts.MinDelay,
+	}, nil
+}
+
+// Push adds a packet. Packets older than the playout position are counted as
+// late and dropped. A sequence number far from the buffered ones restarts the
+// buffer from it.
+func (jb *JitterBuffer) Push(seq uint16, timestamp uint32, payload []byte) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	now := jb.opts.Clock.Now()
+
+	var ext uint64
+	if jb.started {
+		ext = uint64(int64(jb.highest) + int64(int16(seq-uint16(jb.highest))))
+	}
+	if !jb.started || ext >= jb.highest+jitterMaxSeqJump || ext+jitterMaxSeqJump <= jb.next {
+		ext = jb.resync(seq)
+	}
+	jb.updateJitter(now, timestamp)
+
+	if ext < jb.next {
+		if jb.played {
+			jb.stats.Late++
+			return
+		}
+		jb.next = ext
+	}
+	if _, ok := jb.packets[ext]; ok {
+		jb.stats.Duplicate++
+		return
+	}
+	if ext < jb.highest {
+		jb.stats.Reordered++
+	} else {
+		jb.highest = ext
+	}
+	jb.packets[ext] = jitterPacket{
+		timestamp: timestamp,
+		payload:   append([]byte(nil), payload...),
+	}
+
+	// make room by moving the playout position past the oldest packets
+	for len(jb.packets) > jb.opts.MaxPackets {
+		if _, ok := jb.packets[jb.next]; ok {
+			delete(jb.packets, jb.next)
+			jb.stats.Dropped++
+		}
+		jb.next++
+		jb.played = true
+	}
+}
+
+// resync drops the buffered packets and restarts playout from seq, returning
+// its extended sequence number.
+func (jb *JitterBuffer) resync(seq uint16) uint64 {
+	jb.stats.Dropped += uint64(len(jb.packets))
+	clear(jb.packets)
+	// start high so sequence numbers from before the first packet can be
+	// represented
+	ext := 1<<32 + uint64(seq)
+	jb.started = true
+	jb.playing = false
+	jb.played = false
+	jb.highest = ext
+	jb.next = ext
+	// the timestamps of the new packets have nothing to do with the old ones
+	jb.arrivals.started = false
+	return ext
+}
+
+// updateJitter updates the jitter estimate with a packet arrival and the target
+// delay with it.
+func (jb *JitterBuffer) updateJitter(now time.Time, timestamp uint32) {
+	jb.arrivals.update(now, timestamp)
+	target := jb.opts.FrameDuration + jitterDelayFactor*jb.arrivals.duration()
+	if target < jb.opts.MinDelay {
+		target = jb.opts.MinDelay
+	}
+	if target > jb.opts.MaxDelay {
+		target = jb.opts.MaxDelay
+	}
+	jb.target = target
+}
+
+// interarrivalJitter estimates the interarrival jitter of RTP packets as
+// described in RFC 3550 section 6.4.1. Every packet is compared to the one
+// that arrived before it, whatever their sequence numbers.
+type interarrivalJitter struct {
+	clockRate int
+	started   bool
+	// jitter is in timestamp units.
+	jitter        float64
+	lastArrival   time.Time
+	lastTimestamp uint32
+}
+
+// update folds the transit time difference between a packet arriving now and
+// the previous one into the estimate.
+func (j *interarrivalJitter) update(now time.Time, timestamp uint32) {
+	if j.started {
+		arrival := now.Sub(j.lastArrival).Seconds() * float64(j.clockRate)
+		sent := float64(int32(timestamp - j.lastTimestamp))
+		j.jitter += (math.Abs(arrival-sent) - j.jitter) / 16
+	}
+	j.started = true
+	j.lastArrival = now
+	j.lastTimestamp = timestamp
+}
+
+// duration returns the estimate as a duration.
+func (j *interarrivalJitter) duration() time.Duration {
+	return time.Duration(j.jitter / float64(j.clockRate) * float64(time.Second))
+}
+
+// delay returns the duration of audio buffered, from the playout position to
+// the end of the newest packet. The newest packet is always buffered, the one
+// at the playout position may be missing and then counts as a frame per
+// packet in between.
+func (jb *JitterBuffer) delay() time.Duration {
+	if len(jb.packets) == 0 {
+		return 0
+	}
+	span := time.Duration(jb.highest-jb.next) * jb.opts.FrameDuration
+	if oldest, ok := jb.packets[jb.next]; ok {
+		ts := jb.packets[jb.highest].timestamp - oldest.timestamp
+		span = time.Duration(float64(ts) / float64(jb.opts.ClockRate) * float64(time.Second))
+	}
+	return span + jb.opts.FrameDuration
+}
+
+// Pop returns the next packet in sequence order. It is called once per frame
+// of playout; until the buffered delay reaches the target, and again after
+// running dry, it reports jitterEmpty.
+func (jb *JitterBuffer) Pop() ([]byte, jitterStatus) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	if len(jb.packets) == 0 {
+		jb.playing = false
+		return nil, jitterEmpty
+	}
+	if !jb.playing {
+		if jb.delay() < jb.target {
+			return nil, jitterEmpty
+		}
+		jb.playing = true
+	}
+
+	// shed a frame at a time when the target has come down since the buffer
+	// filled up
+	if jb.delay() > jb.target+2*jb.opts.FrameDuration {
+		if _, ok := jb.packets[jb.next]; ok {
+			delete(jb.packets, jb.next)
+			jb.stats.Dropped++
+		} else {
+			jb.stats.Lost++
+		}
+		jb.next++
+	}
+
+	jb.played = true
+	p, ok := jb.packets[jb.next]
+	jb.next++
+	if !ok {
+		jb.stats.Lost++
+		return nil, jitterLost
+	}
+	delete(jb.packets, jb.next-1)
+	return p.payload, jitterReady
+}
+
+// peek returns the payload of the next packet to be played without removing
+// it, nil when it has not arrived.
+func (jb *JitterBuffer) peek() []byte {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	return jb.packets[jb.next].payload
+}
+
+// Stats returns a snapshot of the buffer statistics.
+func (jb *JitterBuffer) Stats() JitterStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	stats := jb.stats
+	stats.CurrentDelay = jb.delay()
+	stats.TargetDelay = jb.target
+	stats.Jitter = jb.arrivals.duration()
+	stats.Buffered = len(jb.packets)
+	return stats
+}
@@ -0,0 +1,220 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFrameTs = 960
+
+func newTestJitterBuffer(t *testing.T, opts JitterBufferOptions) (*JitterBuffer, *ManualClock) {
+	clock := NewManualClock(time.Unix(0, 0))
+	opts.Clock = clock
+	jb, err := NewJitterBuffer(opts)
+	assert.NoError(t, err)
+	return jb, clock
+}
+
+func popPayload(t *testing.T, jb *JitterBuffer) byte {
+	payload, status := jb.Pop()
+	assert.Equal(t, jitterReady, status)
+	if len(payload) == 0 {
+		return 0
+	}
+	return payload[0]
+}
+
+func TestJitterBuffer_Reorders(t *testing.T) {
+	jb, clock := newTestJitterBuffer(t, JitterBufferOptions{})
+
+	_, status := jb.Pop()
+	assert.Equal(t, jitterEmpty, status)
+
+	// timestamps keep counting up across the sequence number wrap
+	ts := func(seq uint16) uint32 { return uint32(seq+2) * testFrameTs }
+	for _, seq := range []uint16{65534, 0, 65535, 1} {
+		jb.Push(seq, ts(seq), []byte{byte(seq)})
+		clock.Advance(20 * time.Millisecond)
+	}
+	jb.Push(0, ts(0), []byte{0})
+
+	for _, want := range []byte{254, 255, 0, 1} {
+		assert.Equal(t, want, popPayload(t, jb))
+	}
+	_, status = jb.Pop()
+	assert.Equal(t, jitterEmpty, status)
+
+	stats := jb.Stats()
+	assert.Equal(t, uint64(1), stats.Reordered)
+	assert.Equal(t, uint64(1), stats.Duplicate)
+	assert.Equal(t, 0, stats.Buffered)
+}
+
+func TestJitterBuffer_LateAndLost(t *testing.T) {
+	jb, clock := newTestJitterBuffer(t, JitterBufferOptions{})
+	push := func(seq uint16) {
+		jb.Push(seq, uint32(seq)*testFrameTs, []byte{byte(seq)})
+		clock.Advance(20 * time.Millisecond)
+	}
+
+	push(10)
+	assert.Equal(t, byte(10), popPayload(t, jb))
+
+	// 11 goes missing, 12 is there when 11 is due
+	push(12)
+	_, status := jb.Pop()
+	assert.Equal(t, jitterLost, status)
+	assert.Equal(t, byte(12), popPayload(t, jb))
+
+	// 11 finally arrives after its playout time
+	push(11)
+	stats := jb.Stats()
+	assert.Equal(t, uint64(1), stats.Lost)
+	assert.Equal(t, uint64(1), stats.Late)
+	assert.Equal(t, 0, stats.Buffered)
+}
+
+func TestJitterBuffer_AdaptiveDelay(t *testing.T) {
+	jb, clock := newTestJitterBuffer(t, JitterBufferOptions{})
+
+	// evenly paced packets keep the delay at its minimum
+	for seq := uint16(0); seq < 50; seq++ {
+		jb.Push(seq, uint32(seq)*testFrameTs, []byte{byte(seq)})
+		assert.Equal(t, byte(seq), popPayload(t, jb))
+		clock.Advance(20 * time.Millisecond)
+	}
+	stats := jb.Stats()
+	assert.Equal(t, time.Duration(0), stats.Jitter)
+	assert.Equal(t, 20*time.Millisecond, stats.TargetDelay)
+
+	// bursty arrivals raise the target
+	for seq := uint16(50); seq < 100; seq += 2 {
+		jb.Push(seq, uint32(seq)*testFrameTs, []byte{byte(seq)})
+		jb.Push(seq+1, uint32(seq+1)*testFrameTs, []byte{byte(seq + 1)})
+		clock.Advance(40 * time.Millisecond)
+	}
+	stats = jb.Stats()
+	assert.Greater(t, stats.Jitter, 5*time.Millisecond)
+	assert.Greater(t, stats.TargetDelay, 40*time.Millisecond)
+	assert.LessOrEqual(t, stats.TargetDelay, defaultJitterMaxDelay)
+}
+
+func TestJitterBuffer_WaitsForTargetDelay(t *testing.T) {
+	jb, _ := newTestJitterBuffer(t, JitterBufferOptions{MinDelay: 60 * time.Millisecond})
+
+	jb.Push(0, 0, []byte{0})
+	jb.Push(1, testFrameTs, []byte{1})
+	_, status := jb.Pop()
+	assert.Equal(t, jitterEmpty, status)
+
+	jb.Push(2, 2*testFrameTs, []byte{2})
+	assert.Equal(t, 60*time.Millisecond, jb.Stats().CurrentDelay)
+	assert.Equal(t, byte(0), popPayload(t, jb))
+	assert.Equal(t, byte(1), popPayload(t, jb))
+}
+
+func TestNewJitterBuffer_InvalidOptions(t *testing.T) {
+	for _, opts := range []JitterBufferOptions{
+		{ClockRate: -1},
+		{FrameDuration: -time.Millisecond},
+		{MinDelay: -time.Millisecond},
+		{MaxDelay: -time.Millisecond},
+		{MaxPackets: -1},
+	} {
+		_, err := NewJitterBuffer(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+	_, err := NewJitterBufferedOpusStream("1", 48000, 20, 1, JitterBufferOptions{MaxPackets: -1})
+	assert.Error(t, err)
+}
+
+func TestJitterBuffer_Overflow(t *testing.T) {
+	jb, _ := newTestJitterBuffer(t, JitterBufferOptions{MaxPackets: 3})
+
+	// 1 is missing, the oldest packets make way for new ones
+	for _, seq := range []uint16{0, 2, 3, 4} {
+		jb.Push(seq, uint32(seq)*testFrameTs, []byte{byte(seq)})
+	}
+	stats := jb.Stats()
+	assert.Equal(t, 3, stats.Buffered)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	// the delay runs from the missing packet
+	assert.Equal(t, 80*time.Millisecond, stats.CurrentDelay)
+
+	jb.Push(5, 5*testFrameTs, []byte{5})
+	stats = jb.Stats()
+	assert.Equal(t, 3, stats.Buffered)
+	assert.Equal(t, uint64(2), stats.Dropped)
+	assert.Equal(t, 60*time.Millisecond, stats.CurrentDelay)
+
+	// the dropped packets are late when they show up again
+	jb.Push(1, testFrameTs, []byte{1})
+	assert.Equal(t, uint64(1), jb.Stats().Late)
+	for _, want := range []byte{3, 4, 5} {
+		assert.Equal(t, want, popPayload(t, jb))
+	}
+}
+
+func TestJitterBuffer_Resync(t *testing.T) {
+	jb, clock := newTestJitterBuffer(t, JitterBufferOptions{})
+	push := func(seq uint16, ts uint32) {
+		jb.Push(seq, ts, []byte{byte(seq)})
+		clock.Advance(20 * time.Millisecond)
+	}
+
+	push(100, 0)
+	push(101, testFrameTs)
+	assert.Equal(t, byte(100), popPayload(t, jb))
+
+	// the sender restarts far ahead, the buffer starts over from there
+	push(5000, 1<<20)
+	stats := jb.Stats()
+	assert.Equal(t, 1, stats.Buffered)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, 20*time.Millisecond, stats.CurrentDelay)
+	assert.Equal(t, byte(136), popPayload(t, jb))
+
+	// and again far behind, which isn't taken as late
+	push(10, 0)
+	push(11, testFrameTs)
+	stats = jb.Stats()
+	assert.Equal(t, uint64(0), stats.Late)
+	assert.Equal(t, 2, stats.Buffered)
+	assert.Equal(t, byte(10), popPayload(t, jb))
+	assert.Equal(t, byte(11), popPayload(t, jb))
+}
+
+func TestJitterBufferedOpusStream(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	stream, err := NewJitterBufferedOpusStream("1", 48000, 20, 1, JitterBufferOptions{Clock: clock})
+	assert.NoError(t, err)
+
+	enc, err := NewOpusEncoder(48000, 1, 960)
+	assert.NoError(t, err)
+	packets := make([][]byte, 3)
+	for i := range packets {
+		packets[i] = make([]byte, 4000)
+		n, err := enc.Encode(generateTestPCM(960, 1), packets[i])
+		assert.NoError(t, err)
+		packets[i] = packets[i][:n]
+	}
+
+	for _, seq := range []uint16{1, 0, 2} {
+		_, err = stream.WritePacket(seq, uint32(seq)*960, packets[seq])
+		assert.NoError(t, err)
+		clock.Advance(20 * time.Millisecond)
+	}
+
+	pcm := make([]int16, 960)
+	for i := 0; i < 3; i++ {
+		n, err := stream.ReadPCM(pcm)
+		assert.NoError(t, err)
+		assert.Equal(t, 960, n)
+	}
+	stats := stream.JitterStats()
+	assert.Equal(t, uint64(1), stats.Reordered)
+	assert.Equal(t, uint64(0), stats.Lost)
+	assert.Equal(t, uint64(3), stream.DecoderStats().Decoded)
+}
@@ -0,0 +1,105 @@
+package avmuxer
+
+import "math"
+
+// audioLevelSilence is the lowest level the RFC 6464 audio level extension
+// can carry, in -dBov.
+const audioLevelSilence = 127
+
+// AudioLevel is the level of a frame of audio.
+type AudioLevel struct {
+	// RMS and Peak are relative to full scale, between 0 and 1.
+	RMS  float64
+	Peak float64
+	// Level is the RMS level in -dBov, from 0 for full scale to 127 for
+	// -127 dBov and below, and Voice whether the frame holds speech, as
+	// carried by the RFC 6464 audio level header extension.
+	Level uint8
+	Voice bool
+}
+
+// DBov returns the RMS level in dBov, -127 for silence.
+func (l AudioLevel) DBov() float64 {
+	if l.RMS <= 0 {
+		return -audioLevelSilence
+	}
+	return math.Max(20*math.Log10(l.RMS), -audioLevelSilence)
+}
+
+// Levels are the audio levels of the most recently mixed frame.
+type Levels struct {
+	// Mix is the level of the full mix as it is output.
+	Mix AudioLevel
+	// Sources holds the level of every source by id, measured before its
+	// gain is applied so a muted participant still shows up as talking.
+	Sources map[string]AudioLevel
+}
+
+// Levels returns the audio levels of the most recently mixed frame.
+func (mr *Multiplexer) Levels() Levels {
+	mr.RLock()
+	defer mr.RUnlock()
+	levels := Levels{
+		Mix:     mr.mixLevel,
+		Sources: make(map[string]AudioLevel, len(mr.sources)),
+	}
+	for id, s := range mr.sources {
+		levels.Sources[id] = s.meter
+	}
+	return levels
+}
+
+// levelMeter accumulates the samples of a frame.
+type levelMeter struct {
+	sum  float64
+	peak int32
+}
+
+func (m *levelMeter) add(v int16) {
+	a := int32(v)
+	if a < 0 {
+		a = -a
+	}
+	if a > m.peak {
+		m.peak = a
+	}
+	m.sum += float64(v) * float64(v)
+}
+
+// level returns the level of a frame of samples samples, the ones not added
+// being silence.
+func (m *levelMeter) level(samples int, voice bool) AudioLevel {
+	l := AudioLevel{Level: audioLevelSilence, Voice: voice}
+	if samples <= 0 {
+		return l
+	}
+	l.RMS = math.Sqrt(m.sum/float64(samples)) / 32768
+	l.Peak = float64(m.peak) / 32768
+	l.Level = uint8(math.Round(-l.DBov()))
+	return l
+}
+
+// measureLevel returns the level of pcm as a frame of samples samples.
+func measureLevel(pcm []int16, samples int, voice bool) AudioLevel {
+	var m levelMeter
+	for _, v := range pcm {
+		m.add(v)
+	}
+	return m.level(samples, voice)
+}
+
+// meterMix measures the level of the frame just mixed as it is rendered for
+// the full mix, which holds voice when a source that is not silenced speaks.
+// Must be called with the lock held.
+func (mr *Multiplexer) meterMix(sampleSize int, anySolo bool) {
+	voice := false
+	for _, s := range mr.sources {
+		voice = voice || (s.vad != nil && s.vad.Speaking() && s.targetGain(anySolo) > 0)
+	}
+	var m levelMeter
+	gain := mr.mixer.gain(mr.frameActive)
+	for _, v := range mr.frame {
+		m.add(mr.mixer.sample(v, gain))
+	}
+	mr.mixLevel = m.level(sampleSize, voice)
+}
@@ -0,0 +1,58 @@
+package avmuxer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasureLevel(t *testing.T) {
+	square := interleave(480, 32767, -32768)
+	l := measureLevel(square, len(square), true)
+	assert.InDelta(t, 1, l.RMS, 1e-4)
+	assert.Equal(t, 1.0, l.Peak)
+	assert.Equal(t, uint8(0), l.Level)
+	assert.True(t, l.Voice)
+
+	l = measureLevel(sineWave(48000, 1000, 960, 32767), 960, false)
+	assert.InDelta(t, -3.01, l.DBov(), 0.1)
+	assert.Equal(t, uint8(3), l.Level)
+
+	l = measureLevel(interleave(480, 328, -328), 960, false)
+	assert.Equal(t, uint8(40), l.Level)
+	assert.InDelta(t, 0.01, l.Peak, 1e-4)
+
+	// the samples missing from the frame are silence
+	l = measureLevel(interleave(480, 16384), 960, false)
+	assert.Equal(t, uint8(9), l.Level)
+
+	l = measureLevel(nil, 960, false)
+	assert.Equal(t, AudioLevel{Level: 127}, l)
+	assert.Equal(t, -127.0, l.DBov())
+	assert.Equal(t, uint8(120), measureLevel([]int16{1}, 960, false).Level)
+}
+
+func TestMultiplexer_Levels(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, GainRampSamples: -1, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("tone", &constantStream{value: 16384}))
+	assert.NoError(t, mux.AddSourceStream("muted", &constantStream{value: 8192}))
+	assert.NoError(t, mux.AddSourceStream("voice", &formatStream{newBufferStream(voiced(48000, 4800, 8000)), Format{Channels: 1}}))
+	assert.NoError(t, mux.Mute("muted"))
+	assert.NoError(t, mux.Mute("voice"))
+
+	assert.Equal(t, Levels{Sources: map[string]AudioLevel{"tone": {}, "muted": {}, "voice": {}}}, mux.Levels())
+	mux.ReadPCM(960)
+	levels := mux.Levels()
+	assert.Equal(t, uint8(6), levels.Sources["tone"].Level)
+	// sources are measured before their gain
+	assert.Equal(t, uint8(12), levels.Sources["muted"].Level)
+	assert.True(t, levels.Sources["voice"].Voice)
+	assert.Equal(t, uint8(6), levels.Mix.Level)
+	assert.InDelta(t, 0.5, levels.Mix.Peak, 1e-4)
+	assert.False(t, levels.Mix.Voice)
+
+	assert.NoError(t, mux.Unmute("voice"))
+	mux.ReadPCM(960)
+	levels = mux.Levels()
+	assert.True(t, levels.Mix.Voice)
+}
@@ -0,0 +1,186 @@
+package avmuxer
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+static int avmuxer_encoder_set(OpusEncoder *st, int request, opus_int32 value) {
+	return opus_encoder_ctl(st, request, value);
+}
+
+static int avmuxer_encoder_get(OpusEncoder *st, int request, opus_int32 *value) {
+	return opus_encoder_ctl(st, request, value);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// libopusEncoder owns a libopus encoder. The opus binding doesn't expose
+// every encoder control, such as VBR, so the encoder is created here rather
+// than through it.
+type libopusEncoder struct {
+	p        *C.OpusEncoder
+	channels int
+	// mem holds the encoder state on the Go heap, like the binding does, so
+	// it doesn't need to be freed.
+	mem []byte
+}
+
+func newLibopusEncoder(sampleRate, channels int, app OpusApplication) (*libopusEncoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("invalid opus channel count: %v", channels)
+	}
+	application, err := app.libopus()
+	if err != nil {
+		return nil, err
+	}
+	enc := &libopusEncoder{
+		channels: channels,
+		mem:      make([]byte, C.opus_encoder_get_size(C.int(channels))),
+	}
+	enc.p = (*C.OpusEncoder)(unsafe.Pointer(&enc.mem[0]))
+	if res := C.opus_encoder_init(enc.p, C.opus_int32(sampleRate), C.int(channels), C.int(application)); res != C.OPUS_OK {
+		return nil, opus.Error(res)
+	}
+	return enc, nil
+}
+
+func (app OpusApplication) libopus() (int, error) {
+	switch app {
+	case OpusApplicationAudio:
+		return C.OPUS_APPLICATION_AUDIO, nil
+	case OpusApplicationVoIP:
+		return C.OPUS_APPLICATION_VOIP, nil
+	case OpusApplicationLowDelay:
+		return C.OPUS_APPLICATION_RESTRICTED_LOWDELAY, nil
+	}
+	return 0, fmt.Errorf("unknown opus application: %v", app)
+}
+
+func (bw OpusBandwidth) libopus() (int, error) {
+	switch bw {
+	case OpusBandwidthFull:
+		return C.OPUS_BANDWIDTH_FULLBAND, nil
+	case OpusBandwidthNarrow:
+		return C.OPUS_BANDWIDTH_NARROWBAND, nil
+	case OpusBandwidthMedium:
+		return C.OPUS_BANDWIDTH_MEDIUMBAND, nil
+	case OpusBandwidthWide:
+		return C.OPUS_BANDWIDTH_WIDEBAND, nil
+	case OpusBandwidthSuperWide:
+		return C.OPUS_BANDWIDTH_SUPERWIDEBAND, nil
+	}
+	return 0, fmt.Errorf("unknown opus bandwidth: %v", bw)
+}
+
+// encode encodes a frame of interleaved pcm into data, returning the size of
+// the packet.
+func (enc *libopusEncoder) encode(pcm []int16, data []byte) (int, error) {
+	if len(pcm) == 0 {
+		return 0, errors.New("no pcm to encode")
+	}
+	if len(data) == 0 {
+		return 0, errors.New("no buffer to encode to")
+	}
+	if len(pcm)%enc.channels != 0 {
+		return 0, errors.New("pcm length must be a multiple of the channel count")
+	}
+	n := C.opus_encode(enc.p, (*C.opus_int16)(&pcm[0]), C.int(len(pcm)/enc.channels),
+		(*C.uchar)(&data[0]), C.opus_int32(len(data)))
+	if n < 0 {
+		return 0, opus.Error(n)
+	}
+	return int(n), nil
+}
+
+func (enc *libopusEncoder) set(request C.int, value int) error {
+	if res := C.avmuxer_encoder_set(enc.p, request, C.opus_int32(value)); res != C.OPUS_OK {
+		return opus.Error(res)
+	}
+	return nil
+}
+
+func (enc *libopusEncoder) get(request C.int) (int, error) {
+	var v C.opus_int32
+	if res := C.avmuxer_encoder_get(enc.p, request, &v); res != C.OPUS_OK {
+		return 0, opus.Error(res)
+	}
+	return int(v), nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// setBitrate sets the target bitrate, 0 lets the encoder pick one.
+func (enc *libopusEncoder) setBitrate(bitrate int) error {
+	if bitrate == 0 {
+		bitrate = C.OPUS_AUTO
+	}
+	return enc.set(C.OPUS_SET_BITRATE_REQUEST, bitrate)
+}
+
+func (enc *libopusEncoder) bitrate() (int, error) {
+	return enc.get(C.OPUS_GET_BITRATE_REQUEST)
+}
+
+func (enc *libopusEncoder) setVBR(vbr bool) error {
+	return enc.set(C.OPUS_SET_VBR_REQUEST, boolToInt(vbr))
+}
+
+func (enc *libopusEncoder) vbr() (bool, error) {
+	v, err := enc.get(C.OPUS_GET_VBR_REQUEST)
+	return v != 0, err
+}
+
+func (enc *libopusEncoder) setComplexity(complexity int) error {
+	return enc.set(C.OPUS_SET_COMPLEXITY_REQUEST, complexity)
+}
+
+func (enc *libopusEncoder) complexity() (int, error) {
+	return enc.get(C.OPUS_GET_COMPLEXITY_REQUEST)
+}
+
+func (enc *libopusEncoder) setMaxBandwidth(bandwidth OpusBandwidth) error {
+	bw, err := bandwidth.libopus()
+	if err != nil {
+		return err
+	}
+	return enc.set(C.OPUS_SET_MAX_BANDWIDTH_REQUEST, bw)
+}
+
+func (enc *libopusEncoder) setInBandFEC(fec bool) error {
+	return enc.set(C.OPUS_SET_INBAND_FEC_REQUEST, boolToInt(fec))
+}
+
+func (enc *libopusEncoder) inBandFEC() (bool, error) {
+	v, err := enc.get(C.OPUS_GET_INBAND_FEC_REQUEST)
+	return v != 0, err
+}
+
+func (enc *libopusEncoder) setPacketLossPercent(percent int) error {
+	return enc.set(C.OPUS_SET_PACKET_LOSS_PERC_REQUEST, percent)
+}
+
+func (enc *libopusEncoder) packetLossPercent() (int, error) {
+	return enc.get(C.OPUS_GET_PACKET_LOSS_PERC_REQUEST)
+}
+
+func (enc *libopusEncoder) setDTX(dtx bool) error {
+	return enc.set(C.OPUS_SET_DTX_REQUEST, boolToInt(dtx))
+}
+
+func (enc *libopusEncoder) dtx() (bool, error) {
+	v, err := enc.get(C.OPUS_GET_DTX_REQUEST)
+	return v != 0, err
+}
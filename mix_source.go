@@ -0,0 +1,136 @@
+package avmuxer
+
+import "time"
+
+// mixSource is a stream registered with the Multiplexer together with the
+// state the mixer keeps for it between frames.
+type mixSource struct {
+	id     string
+	stream Stream
+	// conv converts the stream to the sample rate and channel layout of the
+	// mix.
+	conv *streamConverter
+
+	pcm     []int16
+	read    int
+	audible bool
+	// contribution is what this source added to the current frame, a
+	// mix-minus output is the frame sum with it subtracted.
+	contribution []int32
+
+	// level is the gain set by the user, gain is the one currently applied
+	// while ramping towards rampTarget.
+	level      float64
+	muted      bool
+	solo       bool
+	gain       float64
+	rampTarget float64
+	rampLeft   int
+	panner     panner
+
+	// vad detects speech in the stream before the gain is applied,
+	// speechChanged is set when the current frame started or stopped it.
+	vad           *VAD
+	speechChanged bool
+	// reportedAt is when the sender last reported its audio level.
+	reportedAt time.Time
+	// meter is the level of the current frame before the gain is applied.
+	meter AudioLevel
+	// ssrc identifies the source in the CSRCs of the mixed RTP stream.
+	ssrc    uint32
+	hasSSRC bool
+	// benched is set in top-N mixing while the source is not among the
+	// selected speakers.
+	benched bool
+
+	// fadeLeft and fadeTotal are set on streams that have been removed from the
+	// mix and are fading out whatever they still had buffered.
+	fadeLeft  int
+	fadeTotal int
+}
+
+func newMixSource(id string, stream Stream) *mixSource {
+	return &mixSource{
+		id:         id,
+		stream:     stream,
+		level:      1,
+		gain:       1,
+		rampTarget: 1,
+		panner:     newPanner(),
+	}
+}
+
+// convertTo makes the source convert its stream to the given sample rate and
+// channel layout when the stream reports different ones.
+func (s *mixSource) convertTo(rate, channels int) error {
+	conv, err := newStreamConverter(s.stream, rate, channels)
+	if err != nil {
+		return err
+	}
+	s.conv = conv
+	return nil
+}
+
+// readFrame reads up to sampleSize samples from the stream into s.pcm and
+// applies the source gain, ramping towards gain over rampSamples.
+func (s *mixSource) readFrame(sampleSize int, gain float64, rampSamples int) {
+	s.read = 0
+	s.audible = false
+	s.speechChanged = false
+	want := sampleSize
+	if s.fadeTotal > 0 && s.fadeLeft < want {
+		want = s.fadeLeft
+	}
+	if want <= 0 {
+		return
+	}
+	if cap(s.pcm) < sampleSize {
+		s.pcm = make([]int16, sampleSize)
+	}
+	var n int
+	var err error
+	if s.conv != nil {
+		n, err = s.conv.read(s.stream, s.pcm[:want])
+	} else {
+		n, err = s.stream.ReadPCM(s.pcm[:want])
+	}
+	if err != nil || n == 0 {
+		s.measure(nil, want)
+		return
+	}
+	s.measure(s.pcm[:n], want)
+	s.applyGain(s.pcm[:n], gain, rampSamples)
+	if s.fadeTotal > 0 {
+		s.fadeOut(s.pcm[:n])
+	}
+	s.read = n
+	s.audible = isAudible(s.pcm[:n])
+}
+
+// measure runs voice activity detection and level metering on a frame of
+// sampleSize samples of which pcm could be read.
+func (s *mixSource) measure(pcm []int16, sampleSize int) {
+	if s.vad == nil {
+		return
+	}
+	_, s.speechChanged = s.vad.process(pcm, sampleSize)
+	s.meter = measureLevel(pcm, sampleSize, s.vad.Speaking())
+}
+
+// fadeOut applies a linear ramp towards silence that spans fadeTotal samples.
+func (s *mixSource) fadeOut(pcm []int16) {
+	for i := range pcm {
+		pcm[i] = int16(int64(pcm[i]) * int64(s.fadeLeft-i) / int64(s.fadeTotal+1))
+	}
+	s.fadeLeft -= len(pcm)
+}
+
+// accumulate adds the samples read for the current frame to frame.
+func (s *mixSource) accumulate(frame []int32) {
+	s.contribution = resizeInt32(s.contribution, s.read)
+	for i := 0; i < s.read; i++ {
+		c := int32(s.pcm[i])
+		s.contribution[i] = c
+		frame[i] += c
+	}
+}
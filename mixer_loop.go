@@ -0,0 +1,263 @@
+package avmuxer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// maxEncodedFrameSize is large enough for any single encoded audio frame.
+const maxEncodedFrameSize = 4000
+
+// maxFrameLag is how many frames the mixing loop may fall behind before it
+// stops catching up and restarts its schedule from the current time.
+const maxFrameLag = 5
+
+// MixFrame is a frame produced by the mixing loop.
+type MixFrame struct {
+	// PCM is always a full frame in the sample rate and channel layout of the
+	// mix, silence when no source had audio.
+	PCM []int16
+	// Encoded is PCM encoded with the Multiplexer's encoder, nil without one.
+	Encoded  []byte
+	Duration time.Duration
+	// Silent is true when no source contributed to the frame.
+	Silent bool
+	// Idle is true when the Multiplexer had no sources, not even one fading
+	// out.
+	Idle bool
+	// Sequence counts the frames produced since Start, starting at 0.
+	Sequence uint64
+}
+
+// MixSink receives every frame produced by the mixing loop.
+type MixSink interface {
+	WriteFrame(MixFrame) error
+}
+
+// MixSinkFunc adapts a function to a MixSink.
+type MixSinkFunc func(MixFrame) error
+
+func (f MixSinkFunc) WriteFrame(frame MixFrame) error {
+	return f(frame)
+}
+
+type encodedWriterSink struct {
+	w io.Writer
+}
+
+// NewEncodedWriterSink returns a MixSink writing each encoded frame to w with a
+// single Write call.
+func NewEncodedWriterSink(w io.Writer) MixSink {
+	return &encodedWriterSink{w: w}
+}
+
+func (s *encodedWriterSink) WriteFrame(frame MixFrame) error {
+	if len(frame.Encoded) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(frame.Encoded)
+	return err
+}
+
+type pcmWriterSink struct {
+	w io.Writer
+}
+
+// NewPCMWriterSink returns a MixSink writing each frame to w as little endian
+// 16 bit PCM.
+func NewPCMWriterSink(w io.Writer) MixSink {
+	return &pcmWriterSink{w: w}
+}
+
+func (s *pcmWriterSink) WriteFrame(frame MixFrame) error {
+	_, err := s.w.Write(Int16ToByteSlice(frame.PCM))
+	return err
+}
+
+// AddSink registers a sink that receives every frame of the mixing loop.
+func (mr *Multiplexer) AddSink(id string, sink MixSink) error {
+	mr.Lock()
+	defer mr.Unlock()
+	if _, ok := mr.sinks[id]; ok {
+		return errors.New("sink already exists")
+	}
+	mr.sinks[id] = sink
+	return nil
+}
+
+func (mr *Multiplexer) RemoveSink(id string) error {
+	mr.Lock()
+	defer mr.Unlock()
+	if _, ok := mr.sinks[id]; !ok {
+		return errors.New("sink doesn't exist")
+	}
+	delete(mr.sinks, id)
+	return nil
+}
+
+// Start runs a mixing loop that produces a frame every frameDuration and
+// delivers it to the registered sinks, until Stop is called or ctx is done.
+// Frames are scheduled against the start time rather than the previous tick so
+// timing errors do not accumulate. With an encoder configured the frame
+// duration is the encoder's, so frameDuration has to match the one of the
+// encoder and of the mix-minus encoders; otherwise the frame size is derived
+// from MixerOptions.SampleRate and Channels.
+func (mr *Multiplexer) Start(ctx context.Context, frameDuration time.Duration) error {
+	if frameDuration <= 0 {
+		return errors.New("invalid frame duration")
+	}
+	mr.Lock()
+	defer mr.Unlock()
+	if mr.loopDone != nil {
+		return errors.New("multiplexer already started")
+	}
+	if err := checkFrameDuration("encoder", mr.encoder, frameDuration); err != nil {
+		return err
+	}
+	for id, enc := range mr.minusEncoders {
+		if err := checkFrameDuration("encoder for "+id, enc, frameDuration); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	mr.loopCancel = cancel
+	mr.loopDone = done
+	go func() {
+		defer close(done)
+		mr.run(ctx, frameDuration)
+	}()
+	return nil
+}
+
+// checkFrameDuration checks that enc, when set and reporting a frame duration,
+// encodes frames of frameDuration.
+func checkFrameDuration(name string, enc Encoder, frameDuration time.Duration) error {
+	if enc == nil {
+		return nil
+	}
+	if d := enc.Format().FrameDuration; d != 0 && d != frameDuration {
+		return fmt.Errorf("frame duration %v doesn't match the %v frame duration %v", frameDuration, name, d)
+	}
+	return nil
+}
+
+// Stop ends the mixing loop and waits for it to return.
+func (mr *Multiplexer) Stop() {
+	mr.Lock()
+	cancel, done := mr.loopCancel, mr.loopDone
+	mr.loopCancel, mr.loopDone = nil, nil
+	mr.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (mr *Multiplexer) run(ctx context.Context, frameDuration time.Duration) {
+	var seq uint64
+	tickFrames(ctx, mr.clock, frameDuration, func() error {
+		mr.produceFrame(frameDuration, seq)
+		seq++
+		return nil
+	})
+}
+
+// tickFrames calls fn every frameDuration until ctx is done, returning its
+// error, or until fn fails. Ticks are scheduled against the start time rather
+// than the previous tick so timing errors do not accumulate; after falling
+// more than maxFrameLag frames behind the schedule restarts from the current
+// time.
+func tickFrames(ctx context.Context, clock Clock, frameDuration time.Duration, fn func() error) error {
+	start := clock.Now()
+	timer := clock.NewTimer(0)
+	defer timer.Stop()
+	for tick := int64(1); ; tick++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+
+		next := start.Add(time.Duration(tick) * frameDuration)
+		now := clock.Now()
+		wait := next.Sub(now)
+		if wait < -maxFrameLag*frameDuration {
+			start, tick, wait = now, 0, 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// idle reports whether the Multiplexer has no sources, not even one fading
+// out.
+func (mr *Multiplexer) idle() bool {
+	mr.RLock()
+	defer mr.RUnlock()
+	return len(mr.sources) == 0 && len(mr.departing) == 0
+}
+
+// frameSamples returns the number of interleaved samples in a frame.
+func (mr *Multiplexer) frameSamples(frameDuration time.Duration) int {
+	mr.RLock()
+	enc := mr.encoder
+	mr.RUnlock()
+	if enc != nil {
+		return mr.encoderFrameSize(enc)
+	}
+	return int(int64(mr.sampleRate)*int64(frameDuration)/int64(time.Second)) * mr.channels
+}
+
+func (mr *Multiplexer) produceFrame(frameDuration time.Duration, seq uint64) {
+	size := mr.frameSamples(frameDuration)
+	pcm := mr.ReadPCM(size)
+	frame := MixFrame{
+		PCM:      pcm,
+		Duration: frameDuration,
+		Silent:   len(pcm) == 0,
+		Sequence: seq,
+	}
+	if len(pcm) < size {
+		frame.PCM = make([]int16, size)
+		copy(frame.PCM, pcm)
+	}
+
+	mr.RLock()
+	frame.Idle = len(mr.sources) == 0 && len(mr.departing) == 0
+	enc := mr.encoder
+	sinks := make([]MixSink, 0, len(mr.sinks))
+	for _, sink := range mr.sinks {
+		sinks = append(sinks, sink)
+	}
+	mr.RUnlock()
+
+	if enc != nil {
+		buf := make([]byte, maxEncodedFrameSize)
+		mr.Lock()
+		pcm, err := mr.toEncoder(&mr.encoderFIFO, enc, frame.PCM)
+		mr.Unlock()
+		var n int
+		if err == nil {
+			n, err = enc.Encode(pcm, buf)
+		}
+		if err != nil {
+			log.Printf("failed to encode mixed frame: %v", err)
+		} else {
+			frame.Encoded = buf[:n]
+		}
+	}
+	for _, sink := range sinks {
+		if err := sink.WriteFrame(frame); err != nil {
+			log.Printf("failed to write mixed frame to sink: %v", err)
+		}
+	}
+}
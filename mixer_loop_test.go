@@ -0,0 +1,169 @@
+package avmuxer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type loopFixture struct {
+	mux    *Multiplexer
+	clock  *ManualClock
+	frames chan MixFrame
+}
+
+func newLoopFixture(t *testing.T, opts MixerOptions) *loopFixture {
+	clock := NewManualClock(time.Unix(0, 0))
+	opts.Clock = clock
+	f := &loopFixture{
+		mux:    NewMultiplexer(opts),
+		clock:  clock,
+		frames: make(chan MixFrame, 100),
+	}
+	assert.NoError(t, f.mux.AddSink("ch", MixSinkFunc(func(frame MixFrame) error {
+		f.frames <- frame
+		return nil
+	})))
+	return f
+}
+
+// next returns the next frame delivered by the loop.
+func (f *loopFixture) next(t *testing.T) MixFrame {
+	select {
+	case frame := <-f.frames:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("no frame produced")
+		return MixFrame{}
+	}
+}
+
+// advance waits for the loop to be idle and moves the clock by d.
+func (f *loopFixture) advance(t *testing.T, d time.Duration) {
+	assert.Eventually(t, func() bool { return f.clock.Timers() == 1 }, time.Second, time.Millisecond)
+	f.clock.Advance(d)
+}
+
+func TestMultiplexer_Start(t *testing.T) {
+	f := newLoopFixture(t, MixerOptions{SampleRate: 8000, Channels: 1})
+	assert.NoError(t, f.mux.AddSourceStream("a", &constantStream{value: 7}))
+	assert.Error(t, f.mux.AddSink("ch", NewPCMWriterSink(&bytes.Buffer{})))
+
+	assert.Error(t, f.mux.Start(context.Background(), 0))
+	assert.NoError(t, f.mux.Start(context.Background(), 20*time.Millisecond))
+	assert.Error(t, f.mux.Start(context.Background(), 20*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			f.advance(t, 20*time.Millisecond)
+		}
+		frame := f.next(t)
+		assert.Equal(t, uint64(i), frame.Sequence)
+		assert.Len(t, frame.PCM, 160)
+		assert.Equal(t, int16(7), frame.PCM[0])
+		assert.False(t, frame.Silent)
+		assert.Nil(t, frame.Encoded)
+	}
+	f.mux.Stop()
+	f.mux.Stop()
+	assert.NoError(t, f.mux.RemoveSink("ch"))
+	assert.Error(t, f.mux.RemoveSink("ch"))
+}
+
+func TestMultiplexer_StartSchedule(t *testing.T) {
+	f := newLoopFixture(t, MixerOptions{SampleRate: 8000, Channels: 1})
+	assert.NoError(t, f.mux.Start(context.Background(), 20*time.Millisecond))
+	defer f.mux.Stop()
+	f.next(t)
+
+	// nothing is produced before the frame is due
+	f.advance(t, 19*time.Millisecond)
+	f.advance(t, time.Millisecond)
+	assert.Equal(t, uint64(1), f.next(t).Sequence)
+
+	// a late wakeup is caught up so the schedule does not drift
+	f.advance(t, 65*time.Millisecond)
+	for seq := uint64(2); seq <= 4; seq++ {
+		assert.Equal(t, seq, f.next(t).Sequence)
+	}
+	f.advance(t, 15*time.Millisecond)
+	assert.Equal(t, uint64(5), f.next(t).Sequence)
+
+	// falling far behind restarts the schedule instead of bursting
+	f.advance(t, time.Second)
+	assert.Equal(t, uint64(6), f.next(t).Sequence)
+	f.advance(t, 20*time.Millisecond)
+	assert.Equal(t, uint64(7), f.next(t).Sequence)
+	assert.Len(t, f.frames, 0)
+}
+
+func TestMultiplexer_StartStarvation(t *testing.T) {
+	f := newLoopFixture(t, MixerOptions{SampleRate: 8000, Channels: 1, Strategy: MixStrategySum})
+	residual := make([]int16, 120)
+	for i := range residual {
+		residual[i] = 1000
+	}
+	assert.NoError(t, f.mux.AddSourceStream("a", newBufferStream(residual)))
+	assert.NoError(t, f.mux.Start(context.Background(), 10*time.Millisecond))
+	defer f.mux.Stop()
+
+	frame := f.next(t)
+	assert.False(t, frame.Silent)
+	assert.Equal(t, residual[:80], frame.PCM)
+
+	// the source runs dry halfway through the second frame
+	f.advance(t, 10*time.Millisecond)
+	frame = f.next(t)
+	assert.False(t, frame.Silent)
+	assert.Equal(t, residual[80:], frame.PCM[:40])
+	assert.Equal(t, make([]int16, 40), frame.PCM[40:])
+
+	f.advance(t, 10*time.Millisecond)
+	frame = f.next(t)
+	assert.True(t, frame.Silent)
+	assert.Equal(t, make([]int16, 80), frame.PCM)
+}
+
+func TestMultiplexer_StartFrameDuration(t *testing.T) {
+	f := newLoopFixture(t, MixerOptions{SampleRate: 8000, Channels: 1})
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.NoError(t, f.mux.AddEncoder("pcmu", enc))
+	assert.Error(t, f.mux.Start(context.Background(), 10*time.Millisecond))
+
+	// nor may the mix-minus encoders differ
+	minus, err := NewOpusEncoder(8000, 1, 80)
+	assert.NoError(t, err)
+	assert.NoError(t, f.mux.AddEncoderFor("a", minus))
+	assert.Error(t, f.mux.Start(context.Background(), 20*time.Millisecond))
+}
+
+func TestMultiplexer_StartWithEncoder(t *testing.T) {
+	f := newLoopFixture(t, MixerOptions{Channels: 1})
+	enc := new(MockEncoder)
+	enc.On("SampleSize").Return(4)
+	enc.On("ChannelCount").Return(1)
+	enc.On("Encode", []int16{0, 0, 0, 0}, mock.Anything).Return(3, nil)
+	assert.NoError(t, f.mux.AddEncoder("enc", enc))
+
+	encoded := &bytes.Buffer{}
+	assert.NoError(t, f.mux.AddSink("enc", NewEncodedWriterSink(encoded)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, f.mux.Start(ctx, time.Millisecond))
+	frame := f.next(t)
+	f.advance(t, time.Millisecond)
+	f.next(t)
+	cancel()
+	f.mux.Stop()
+
+	// silence is padded to a full frame and still encoded
+	assert.True(t, frame.Silent)
+	assert.Equal(t, []int16{0, 0, 0, 0}, frame.PCM)
+	assert.Len(t, frame.Encoded, 3)
+	assert.Equal(t, 6, encoded.Len())
+}
@@ -0,0 +1,191 @@
+package avmuxer
+
+import (
+	"fmt"
+	"math"
+)
+
+// MixStrategy selects how the summed sources are brought back into the int16
+// range.
+type MixStrategy int
+
+const (
+	// MixStrategySoftKnee leaves the sum untouched below the knee threshold and
+	// smoothly compresses anything above it towards full scale.
+	MixStrategySoftKnee MixStrategy = iota
+	// MixStrategySum is a plain sum with hard clipping.
+	MixStrategySum
+	// MixStrategyRMSNormalized scales the sum by 1/sqrt(n) of the active
+	// sources, which keeps the loudness of uncorrelated voices steady as
+	// sources start and stop, then hard clips.
+	MixStrategyRMSNormalized
+)
+
+const (
+	defaultKneeThreshold   = -6.0
+	defaultFadeOutSamples  = 960
+	defaultGainRampSamples = 480
+)
+
+// silenceFloor is the RMS level, roughly -60 dBFS, under which a source does
+// not count as active when normalising the mix.
+const silenceFloor = 32
+
+// MixerOptions configures a Multiplexer.
+type MixerOptions struct {
+	// Strategy defaults to MixStrategySoftKnee.
+	Strategy MixStrategy
+	// KneeThreshold is the level in dBFS, below 0, at which the soft-knee
+	// limiter starts compressing. Defaults to -6 dBFS.
+	KneeThreshold float64
+	// FadeOutSamples is the number of interleaved samples over which the
+	// residual audio of a removed or replaced source is faded out. Defaults to
+	// 960, 10 ms of 48 kHz stereo; a negative value drops it immediately.
+	FadeOutSamples int
+	// GainRampSamples is the number of interleaved samples over which gain,
+	// mute and solo changes are ramped. Defaults to 480, 5 ms of 48 kHz
+	// stereo; a negative value applies changes immediately.
+	GainRampSamples int
+	// SampleRate and Channels describe the mix. They size the frames of the
+	// mixing loop when no encoder is configured and default to 48 kHz stereo.
+	SampleRate int
+	Channels   int
+	// Clock drives the mixing loop, defaults to SystemClock.
+	Clock Clock
+	// Binaural renders the position set by SetPan with inter-aural delay
+	// and level differences rather than the constant-power pan law, which
+	// separates voices more clearly on headphones.
+	Binaural bool
+	// VAD configures the voice activity detection run on every source.
+	VAD VADOptions
+	// OnSpeech, when set, is called whenever a source starts or stops
+	// speaking. It is called from the goroutine reading the mix, after the
+	// frame has been mixed.
+	OnSpeech func(SpeechEvent)
+	// MaxSpeakers, when positive, limits the mix to that many sources, the
+	// ones with the highest smoothed speech level, so a large room doesn't
+	// turn into a wall of noise. The others are faded out with the gain
+	// ramp until they speak up.
+	MaxSpeakers int
+	// SpeakerHysteresis is how many dB louder than a mixed source another
+	// source has to be to take its place, and than the dominant speaker to
+	// take over. Defaults to 6 dB.
+	SpeakerHysteresis float64
+	// OnDominantSpeaker, when set, is called whenever the dominant speaker
+	// changes, from the goroutine reading the mix like OnSpeech.
+	OnDominantSpeaker func(DominantSpeakerEvent)
+}
+
+// Validate reports options a Multiplexer cannot use. Zero values are valid
+// and replaced by their defaults.
+func (o MixerOptions) Validate() error {
+	switch {
+	case o.Strategy < MixStrategySoftKnee || o.Strategy > MixStrategyRMSNormalized:
+		return fmt.Errorf("unknown mix strategy: %v", o.Strategy)
+	case o.KneeThreshold > 0 || math.IsNaN(o.KneeThreshold):
+		return fmt.Errorf("knee threshold must not be above 0 dBFS: %v", o.KneeThreshold)
+	case o.SampleRate < 0:
+		return fmt.Errorf("invalid mix sample rate: %v", o.SampleRate)
+	case o.Channels < 0 || o.Channels > 2:
+		return fmt.Errorf("invalid mix channel count: %v", o.Channels)
+	case o.MaxSpeakers < 0:
+		return fmt.Errorf("invalid max speakers: %v", o.MaxSpeakers)
+	case o.SpeakerHysteresis < 0 || math.IsNaN(o.SpeakerHysteresis):
+		return fmt.Errorf("invalid speaker hysteresis: %v dB", o.SpeakerHysteresis)
+	}
+	return nil
+}
+
+func (o MixerOptions) withDefaults() MixerOptions {
+	if o.Strategy < MixStrategySoftKnee || o.Strategy > MixStrategyRMSNormalized {
+		o.Strategy = MixStrategySoftKnee
+	}
+	if o.KneeThreshold >= 0 || math.IsNaN(o.KneeThreshold) {
+		o.KneeThreshold = defaultKneeThreshold
+	}
+	if o.FadeOutSamples == 0 {
+		o.FadeOutSamples = defaultFadeOutSamples
+	}
+	if o.GainRampSamples == 0 {
+		o.GainRampSamples = defaultGainRampSamples
+	}
+	if o.GainRampSamples < 0 {
+		o.GainRampSamples = 0
+	}
+	if o.SampleRate <= 0 {
+		o.SampleRate = 48000
+	}
+	if o.Channels <= 0 || o.Channels > 2 {
+		o.Channels = 2
+	}
+	if o.MaxSpeakers < 0 {
+		o.MaxSpeakers = 0
+	}
+	if o.SpeakerHysteresis <= 0 || math.IsNaN(o.SpeakerHysteresis) {
+		o.SpeakerHysteresis = defaultSpeakerHysteresis
+	}
+	if o.Clock == nil {
+		o.Clock = SystemClock
+	}
+	return o
+}
+
+// mixer turns accumulated sums back into int16 samples.
+type mixer struct {
+	strategy MixStrategy
+	knee     float64
+}
+
+func newMixer(opts MixerOptions) mixer {
+	return mixer{
+		strategy: opts.Strategy,
+		knee:     math.Pow(10, opts.KneeThreshold/20) * 32767,
+	}
+}
+
+// gain returns the scale applied to a sum of active sources.
+func (m mixer) gain(active int) float64 {
+	if m.strategy == MixStrategyRMSNormalized && active > 1 {
+		return 1 / math.Sqrt(float64(active))
+	}
+	return 1
+}
+
+func (m mixer) sample(v int32, gain float64) int16 {
+	switch m.strategy {
+	case MixStrategySoftKnee:
+		return softKnee(float64(v), m.knee)
+	case MixStrategyRMSNormalized:
+		return clampInt16(int32(math.Round(float64(v) * gain)))
+	default:
+		return clampInt16(v)
+	}
+}
+
+// softKnee passes samples under knee through and maps the rest onto the range
+// between knee and full scale with a tanh curve, whose slope at the knee is
+// one so there is no audible corner.
+func softKnee(v, knee float64) int16 {
+	a := math.Abs(v)
+	if a <= knee {
+		return clampInt16(int32(v))
+	}
+	headroom := 32767 - knee
+	a = knee + headroom*math.Tanh((a-knee)/headroom)
+	if v < 0 {
+		a = -a
+	}
+	return clampInt16(int32(math.Round(a)))
+}
+
+// isAudible reports whether the RMS level of pcm is above the silence floor.
+func isAudible(pcm []int16) bool {
+	if len(pcm) == 0 {
+		return false
+	}
+	var sum float64
+	for _, v := range pcm {
+		sum += float64(v) * float64(v)
+	}
+	return sum/float64(len(pcm)) > silenceFloor*silenceFloor
+}
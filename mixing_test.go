@@ -0,0 +1,100 @@
+package avmuxer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplexer_LoneSpeakerNotAttenuated(t *testing.T) {
+	for _, strategy := range []MixStrategy{MixStrategySoftKnee, MixStrategySum, MixStrategyRMSNormalized} {
+		mux := NewMultiplexer(MixerOptions{Strategy: strategy})
+		assert.NoError(t, mux.AddSourceStream("speaker", &constantStream{value: 1000}))
+		assert.NoError(t, mux.AddSourceStream("silent1", &constantStream{}))
+		assert.NoError(t, mux.AddSourceStream("silent2", &constantStream{}))
+
+		pcm := mux.ReadPCM(4)
+		assert.Equal(t, []int16{1000, 1000, 1000, 1000}, pcm, "strategy %v", strategy)
+	}
+}
+
+func TestMixStrategySum_HardClips(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 30000}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 30000}))
+	assert.Equal(t, []int16{32767, 32767}, mux.ReadPCM(2))
+
+	mux = NewMultiplexer(MixerOptions{Strategy: MixStrategySum})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: -30000}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: -30000}))
+	assert.Equal(t, []int16{-32768, -32768}, mux.ReadPCM(2))
+}
+
+func TestMixStrategySoftKnee(t *testing.T) {
+	m := newMixer(MixerOptions{Strategy: MixStrategySoftKnee}.withDefaults())
+
+	// below the knee samples are untouched
+	assert.Equal(t, int16(12000), m.sample(12000, 1))
+	assert.Equal(t, int16(-12000), m.sample(-12000, 1))
+
+	// above it the curve is monotonic and never reaches clipping
+	prev := m.sample(int32(m.knee), 1)
+	for v := int32(m.knee) + 1000; v < 200000; v += 1000 {
+		s := m.sample(v, 1)
+		assert.GreaterOrEqual(t, s, prev)
+		assert.Equal(t, -s, m.sample(-v, 1))
+		prev = s
+	}
+	assert.Less(t, m.sample(40000, 1), int16(32767))
+	// the extremes of a sum stay in range
+	assert.Equal(t, int16(32767), m.sample(math.MaxInt32, 1))
+	assert.Equal(t, int16(-32767), m.sample(math.MinInt32+1, 1))
+}
+
+func TestMixerOptions_Validate(t *testing.T) {
+	assert.NoError(t, MixerOptions{}.Validate())
+	assert.NoError(t, MixerOptions{KneeThreshold: -3}.Validate())
+	assert.Error(t, MixerOptions{KneeThreshold: 3}.Validate())
+	assert.Error(t, MixerOptions{KneeThreshold: math.NaN()}.Validate())
+	assert.NoError(t, MixerOptions{Strategy: MixStrategyRMSNormalized, SampleRate: 16000, Channels: 1, MaxSpeakers: 3, SpeakerHysteresis: 3}.Validate())
+	for _, o := range []MixerOptions{
+		{Strategy: -1},
+		{Strategy: MixStrategyRMSNormalized + 1},
+		{SampleRate: -48000},
+		{Channels: -1},
+		{Channels: 3},
+		{MaxSpeakers: -1},
+		{SpeakerHysteresis: -6},
+		{SpeakerHysteresis: math.NaN()},
+	} {
+		assert.Error(t, o.Validate(), "%+v", o)
+		_, err := NewMultiplexerWithOptions(o)
+		assert.Error(t, err, "%+v", o)
+
+		// NewMultiplexer falls back to the defaults
+		d := o.withDefaults()
+		assert.NoError(t, d.Validate(), "%+v", o)
+	}
+
+	mux, err := NewMultiplexerWithOptions(MixerOptions{SampleRate: 16000, Channels: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 16000, mux.sampleRate)
+	assert.Equal(t, 1, mux.channels)
+
+	// a knee at or above full scale falls back to the default
+	m := newMixer(MixerOptions{KneeThreshold: 3}.withDefaults())
+	assert.Equal(t, newMixer(MixerOptions{}.withDefaults()).knee, m.knee)
+}
+
+func TestMixStrategyRMSNormalized(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategyRMSNormalized})
+	for _, id := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, mux.AddSourceStream(id, &constantStream{value: 1000}))
+	}
+
+	// four active sources are scaled by 1/2
+	assert.Equal(t, []int16{2000, 2000}, mux.ReadPCM(2))
+	// the mix-minus of one of them has three
+	assert.Equal(t, []int16{1732, 1732}, mux.ReadPCMFor("a", 2))
+}
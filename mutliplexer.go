@@ -1,25 +1,73 @@
 package avmuxer
 
 import (
+	"context"
 	"errors"
 	"log"
+	"math"
+	"sort"
 	"sync"
 
 	"gopkg.in/hraban/opus.v2"
 )
 
-var int16BufferPool sync.Pool
-
 type Multiplexer struct {
 	sync.RWMutex
-	encoder Encoder
+	encoder       Encoder
+	minusEncoders map[string]Encoder
+	mixer         mixer
+
+	// encoderFIFO and minusFIFOs resample the mix for encoders that do not
+	// run at the mix rate.
+	encoderFIFO *resampleFIFO
+	minusFIFOs  map[string]*resampleFIFO
+
+	sources map[string]*mixSource
+	// departing holds streams that were removed or replaced and are still
+	// fading out their residual audio.
+	departing       []*mixSource
+	fadeOutSamples  int
+	gainRampSamples int
+	// panDelay is the largest binaural delay in frames, 0 without binaural
+	// cues.
+	panDelay int
+
+	vadOptions VADOptions
+	onSpeech   func(SpeechEvent)
+	// maxSpeakers limits the mix to the loudest speakers when positive,
+	// dominant is the id of the dominant speaker.
+	maxSpeakers       int
+	speakerHysteresis float64
+	dominant          string
+	onDominantSpeaker func(DominantSpeakerEvent)
+	candidates        []*mixSource
+	// events are queued while mixing and delivered once the lock is
+	// released.
+	events mixEvents
+
+	// frame is the sum of every source's contribution to the most recently
+	// mixed frame. Each reader consumes a frame once; asking again for a frame
+	// it has already seen mixes the next one.
+	frame       []int32
+	frameActive int
+	mixLevel    AudioLevel
+	frameSeq    uint64
+	frameSize   int
+	mixReadSeq  uint64
+	readSeq     map[string]uint64
 
-	sources map[string]Stream
+	clock      Clock
+	sampleRate int
+	channels   int
+	sinks      map[string]MixSink
+	loopCancel context.CancelFunc
+	loopDone   chan struct{}
 }
 
 type Stream interface {
 	ReadPCM([]int16) (int, error)
 	WritePCM([]int16) (int, error)
+	Format() Format
 }
 
 type DecodingStream interface {
@@ -34,40 +82,77 @@ type Encoder interface {
 	Encode([]int16, []byte) (int, error)
 	SampleSize() int
 	ChannelCount() int
+	Format() Format
 }
 
 type Decoder interface {
 	Decode([]byte, []int16) (int, error)
+	Format() Format
 }
 
 type OpusDecoder struct {
+	sampleRate int
+	channel    int
+	size       int
+
 	od     *opus.Decoder
 	buffer *RingBuffer[int16]
 }
 
+func (od *OpusDecoder) Format() Format {
+	return pcmFormat(od.sampleRate, od.channel, frameDuration(od.size, od.sampleRate))
+}
+
 func (od *OpusDecoder) Decode(in []byte, out []int16) (int, error) {
 	return od.od.Decode(in, out)
 }
 
+// DecodePLC synthesizes len(out) samples of packet loss concealment audio
+// for a lost packet.
+func (od *OpusDecoder) DecodePLC(out []int16) error {
+	return od.od.DecodePLC(out[:len(out):len(out)])
+}
+
+// DecodeFEC recovers len(out) samples of the packet lost before in from the
+// in-band FEC data of in, falling back to packet loss concealment when in
+// carries none.
+func (od *OpusDecoder) DecodeFEC(in []byte, out []int16) error {
+	return od.od.DecodeFEC(in, out[:len(out):len(out)])
+}
+
 func NewOpusDecoder(sampleRate, channel, size int) (Decoder, error) {
 	decoder, err := opus.NewDecoder(sampleRate, channel)
 	if err != nil {
 		return nil, err
 	}
 	return &OpusDecoder{
-		od:     decoder,
-		buffer: NewRingBuffer[int16](size * channel),
+		sampleRate: sampleRate,
+		channel:    channel,
+		size:       size,
+		od:         decoder,
+		buffer:     NewRingBuffer[int16](size * channel),
 	}, nil
 }
 
 type OpusEncoder struct {
-	size    int
-	channel int
+	sampleRate int
+	size       int
+	channel    int
 
-	oe     *opus.Encoder
+	// mu guards oe, which can be retuned while another goroutine encodes.
+	mu     sync.Mutex
+	oe     *libopusEncoder
 	buffer *RingBuffer[byte]
 }
 
+func (oe *OpusEncoder) SampleRate() int {
+	return oe.sampleRate
+}
+
+func (oe *OpusEncoder) Format() Format {
+	return pcmFormat(oe.sampleRate, oe.channel, frameDuration(oe.size, oe.sampleRate))
+}
+
 func (oe *OpusEncoder) SampleSize() int {
 	return oe.size
 }
@@ -77,29 +162,80 @@ func (oe *OpusEncoder) ChannelCount() int {
 }
 
 func (oe *OpusEncoder) Encode(in []int16, out []byte) (int, error) {
-	return oe.oe.Encode(in, out)
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.oe.encode(in, out)
 }
 
-func NewOpusEncoder(sampleRate, channel, size int) (Encoder, error) {
-	enc, err := opus.NewEncoder(sampleRate, channel, opus.AppAudio)
+// NewOpusEncoder creates an Opus Encoder, optionally configured by cfg.
+func NewOpusEncoder(sampleRate, channel, size int, cfg ...OpusEncoderConfig) (Encoder, error) {
+	var c OpusEncoderConfig
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	enc, err := newLibopusEncoder(sampleRate, channel, c.Application)
 	if err != nil {
 		return nil, err
 	}
-	err = enc.SetBitrate(int(opus.Fullband))
-	if err != nil {
+	oe := &OpusEncoder{
+		sampleRate: sampleRate,
+		size:       size,
+		channel:    channel,
+		oe:         enc,
+		buffer:     NewRingBuffer[byte](size * channel * 2), // int16 data holds 2 byte, size is sample size
+	}
+	if err := c.apply(oe); err != nil {
 		return nil, err
 	}
-	return &OpusEncoder{
-		size:    size,
-		channel: channel,
-		oe:      enc,
-		buffer:  NewRingBuffer[byte](size * channel * 2), // int16 data holds 2 byte, size is sample size
-	}, nil
+	return oe, nil
 }
 
-func NewMultiplexer() *Multiplexer {
+// NewMultiplexer creates a Multiplexer, optionally configured by opts. Invalid
+// options, as reported by MixerOptions.Validate, are logged and replaced with
+// their defaults; use NewMultiplexerWithOptions to have them rejected.
+func NewMultiplexer(opts ...MixerOptions) *Multiplexer {
+	var o MixerOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if err := o.Validate(); err != nil {
+		log.Printf("invalid mixer options: %v", err)
+	}
+	return newMultiplexer(o.withDefaults())
+}
+
+// NewMultiplexerWithOptions creates a Multiplexer configured by opts, failing
+// when MixerOptions.Validate rejects them.
+func NewMultiplexerWithOptions(opts MixerOptions) (*Multiplexer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return newMultiplexer(opts.withDefaults()), nil
+}
+
+func newMultiplexer(o MixerOptions) *Multiplexer {
+	panDelay := 0
+	if o.Binaural {
+		panDelay = int(math.Round(binauralMaxDelay.Seconds() * float64(o.SampleRate)))
+	}
 	return &Multiplexer{
-		sources: make(map[string]Stream),
+		mixer:             newMixer(o),
+		fadeOutSamples:    o.FadeOutSamples,
+		gainRampSamples:   o.GainRampSamples,
+		panDelay:          panDelay,
+		vadOptions:        o.VAD,
+		onSpeech:          o.OnSpeech,
+		maxSpeakers:       o.MaxSpeakers,
+		speakerHysteresis: o.SpeakerHysteresis,
+		onDominantSpeaker: o.OnDominantSpeaker,
+		sources:           make(map[string]*mixSource),
+		minusEncoders:     make(map[string]Encoder),
+		minusFIFOs:        make(map[string]*resampleFIFO),
+		readSeq:           make(map[string]uint64),
+		clock:             o.Clock,
+		sampleRate:        o.SampleRate,
+		channels:          o.Channels,
+		sinks:             make(map[string]MixSink),
 	}
 }
 
@@ -107,6 +243,9 @@ func (mr *Multiplexer) AddEncoder(id string, enc Encoder) error {
 	if mr.encoder != nil {
 		return errors.New("encoder already configured")
 	}
+	if err := validateEncoder(enc, mr.sampleRate); err != nil {
+		return err
+	}
 
 	mr.Lock()
 	mr.encoder = enc
@@ -114,56 +253,225 @@ func (mr *Multiplexer) AddEncoder(id string, enc Encoder) error {
 	return nil
 }
 
-// size should be calculated as clock_rate*sample_duration_in_ms/1000
+// encoderFormat returns the format of the encoder, zero without one.
+func (mr *Multiplexer) encoderFormat() Format {
+	mr.RLock()
+	defer mr.RUnlock()
+	if mr.encoder == nil {
+		return Format{}
+	}
+	return mr.encoder.Format()
+}
+
+// AddEncoderFor configures the encoder used by ReadFor to encode the mix-minus
+// output of the given source.
+func (mr *Multiplexer) AddEncoderFor(id string, enc Encoder) error {
+	mr.Lock()
+	defer mr.Unlock()
+	if _, ok := mr.minusEncoders[id]; ok {
+		return errors.New("encoder already configured")
+	}
+	if err := validateEncoder(enc, mr.sampleRate); err != nil {
+		return err
+	}
+
+	mr.minusEncoders[id] = enc
+	return nil
+}
+
+// AddSourceStream adds stream to the mix. A stream whose Format has a sample
+// rate or channel count other than the MixerOptions ones is resampled and up
+// or down mixed to the mix format.
 func (mr *Multiplexer) AddSourceStream(id string, stream Stream) error {
 	mr.Lock()
 	defer mr.Unlock()
 	if _, ok := mr.sources[id]; ok {
 		return errors.New("stream already exists")
 	}
+	if err := validateSource(id, stream); err != nil {
+		return err
+	}
 
-	mr.sources[id] = stream
+	s := newMixSource(id, stream)
+	if err := s.convertTo(mr.sampleRate, mr.channels); err != nil {
+		return err
+	}
+	s.vad = NewVAD(mr.sampleRate, mr.channels, mr.vadOptions)
+	// in top-N mode a source joins the mix once it is selected
+	s.benched = mr.maxSpeakers > 0
+	mr.sources[id] = s
 	return nil
 }
 
-func (mr *Multiplexer) interleavedMultiplex(sampleSize int) []int16 {
-	buffs := [][]int16{}
-	maxBufSize := 0
+// RemoveSourceStream removes the source registered as id. Audio it still has
+// buffered is faded out over the next frames so the removal does not click.
+func (mr *Multiplexer) RemoveSourceStream(id string) error {
+	return mr.removeSourceStream(id, nil)
+}
+
+// removeSourceStream removes the source id when its stream is stream, or
+// whatever its stream is when stream is nil, so a stream that ends doesn't
+// remove the one that replaced it.
+func (mr *Multiplexer) removeSourceStream(id string, stream Stream) error {
+	mr.Lock()
+	s, ok := mr.sources[id]
+	if !ok || (stream != nil && s.stream != stream) {
+		mr.Unlock()
+		return ErrSourceNotFound
+	}
+
+	mr.retire(s)
+	delete(mr.sources, id)
+	delete(mr.readSeq, id)
+	delete(mr.minusEncoders, id)
+	delete(mr.minusFIFOs, id)
+	if s.vad != nil && s.vad.Speaking() {
+		mr.events.speech = append(mr.events.speech, SpeechEvent{ID: id})
+	}
+	if mr.dominant == id {
+		mr.events.dominant = append(mr.events.dominant, DominantSpeakerEvent{Previous: id})
+		mr.dominant = ""
+	}
+	events := mr.takeEvents()
+	mr.Unlock()
+	mr.emit(events)
+	return nil
+}
+
+// ReplaceSourceStream swaps the stream of an existing source, fading out the
+// old stream's residual audio.
+func (mr *Multiplexer) ReplaceSourceStream(id string, stream Stream) error {
+	mr.Lock()
+	defer mr.Unlock()
+	s, ok := mr.sources[id]
+	if !ok {
+		return ErrSourceNotFound
+	}
+	if err := validateSource(id, stream); err != nil {
+		return err
+	}
+	next := newMixSource(id, stream)
+	if err := next.convertTo(mr.sampleRate, mr.channels); err != nil {
+		return err
+	}
+
+	mr.retire(s)
+	s.stream, s.conv = next.stream, next.conv
+	return nil
+}
+
+// Sources returns the ids of the registered sources in sorted order.
+func (mr *Multiplexer) Sources() []string {
 	mr.RLock()
+	defer mr.RUnlock()
+	ids := make([]string, 0, len(mr.sources))
+	for id := range mr.sources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// retire queues the stream of s to be faded out at its current gain. Must be
+// called with the lock held.
+func (mr *Multiplexer) retire(s *mixSource) {
+	if mr.fadeOutSamples <= 0 {
+		return
+	}
+	d := newMixSource(s.id, s.stream)
+	d.conv = s.conv
+	d.panner = s.panner
+	s.panner.history, s.panner.scratch = nil, nil
+	d.level, d.gain, d.rampTarget = s.gain, s.gain, s.gain
+	d.fadeLeft = mr.fadeOutSamples
+	d.fadeTotal = mr.fadeOutSamples
+	mr.departing = append(mr.departing, d)
+}
+
+// needsMix reports whether a reader that last consumed frame seen has to mix a
+// new frame. Must be called with the lock held.
+func (mr *Multiplexer) needsMix(seen uint64, sampleSize int) bool {
+	return mr.frameSeq == 0 || seen == mr.frameSeq || mr.frameSize != sampleSize
+}
+
+// interleavedMultiplex reads one frame from every source and sums it into
+// mr.frame, remembering each source's contribution. Must be called with the
+// lock held.
+func (mr *Multiplexer) interleavedMultiplex(sampleSize int) {
+	anySolo := mr.anySolo()
+	active := 0
+	maxBufSize := 0
+	read := func(s *mixSource, gain float64) {
+		s.readFrame(sampleSize, gain, mr.gainRampSamples)
+		if mr.channels == 2 && s.read > 0 {
+			s.panner.process(s.pcm[:s.read], mr.gainRampSamples, mr.panDelay)
+		}
+		if s.read > maxBufSize {
+			maxBufSize = s.read
+		}
+		if s.audible {
+			active++
+		}
+	}
+	for _, s := range mr.sources {
+		read(s, s.targetGain(anySolo))
+	}
+	for _, s := range mr.departing {
+		read(s, s.level)
+	}
+	mr.queueSpeechEvents()
+	mr.selectSpeakers(anySolo)
+
+	mr.frame = resizeInt32(mr.frame, maxBufSize)
 	for _, s := range mr.sources {
-		bufI := int16BufferPool.Get()
-		var buf []int16
-		if bufI == nil {
-			buf = make([]int16, sampleSize)
-		} else {
-			buf = *bufI.(*[]int16)
+		s.accumulate(mr.frame)
+	}
+	departing := mr.departing[:0]
+	for _, s := range mr.departing {
+		s.accumulate(mr.frame)
+		if s.read > 0 && s.fadeLeft > 0 {
+			departing = append(departing, s)
 		}
-		n, err := s.ReadPCM(buf)
-		if err != nil {
-			continue
+	}
+	for i := len(departing); i < len(mr.departing); i++ {
+		mr.departing[i] = nil
+	}
+	mr.departing = departing
+	mr.frameActive = active
+	mr.frameSize = sampleSize
+	mr.meterMix(sampleSize, anySolo)
+	mr.frameSeq++
+}
+
+// render converts the current frame to PCM with the configured mix strategy,
+// leaving out everything the source id contributed when it is not empty.
+func (mr *Multiplexer) render(id string) []int16 {
+	active := mr.frameActive
+	var minus []*mixSource
+	if id != "" {
+		if s, ok := mr.sources[id]; ok {
+			minus = append(minus, s)
 		}
-		buf = buf[:n]
-		if n > maxBufSize {
-			maxBufSize = n
+		for _, s := range mr.departing {
+			if s.id == id {
+				minus = append(minus, s)
+			}
 		}
-		buffs = append(buffs, buf)
 	}
-	mr.RUnlock()
-	size := len(buffs)
-	out := make([]int16, maxBufSize)
-	// for i := maxBufSize - 1; i >= 0; i-- {
-	for i := 0; i < maxBufSize; i++ {
-		var sum int16
-		for _, buf := range buffs {
-			sum += (buf[i] / int16(size))
+	for _, s := range minus {
+		if s.audible {
+			active--
 		}
-		out[i] = sum
 	}
-	for _, buf := range buffs {
-		if cap(buf) < 8184 {
-			buf = buf[:0]
-			int16BufferPool.Put(&buf)
+	gain := mr.mixer.gain(active)
+	out := make([]int16, len(mr.frame))
+	for i, v := range mr.frame {
+		for _, s := range minus {
+			if i < s.read {
+				v -= s.contribution[i]
+			}
 		}
+		out[i] = mr.mixer.sample(v, gain)
 	}
 	return out
 }
@@ -173,14 +481,99 @@ func (mr *Multiplexer) WritePCM([]int16) (int, error) {
 }
 
 func (mr *Multiplexer) ReadPCM(sampleSize int) []int16 {
-	return mr.interleavedMultiplex(sampleSize)
+	mr.Lock()
+	if mr.needsMix(mr.mixReadSeq, sampleSize) {
+		mr.interleavedMultiplex(sampleSize)
+	}
+	mr.mixReadSeq = mr.frameSeq
+	out := mr.render("")
+	events := mr.takeEvents()
+	mr.Unlock()
+	mr.emit(events)
+	return out
+}
+
+// ReadPCMFor returns the mix of every source except the one registered as id
+// (mix-minus). The sources are read once per frame and shared by all readers,
+// so calling it for every participant does not drain the streams N times. An
+// id that is not a source, such as a listen-only participant, gets the full
+// mix; RemoveListener releases what is kept for it once it leaves.
+func (mr *Multiplexer) ReadPCMFor(id string, sampleSize int) []int16 {
+	mr.Lock()
+	if mr.needsMix(mr.readSeq[id], sampleSize) {
+		mr.interleavedMultiplex(sampleSize)
+	}
+	mr.readSeq[id] = mr.frameSeq
+	out := mr.render(id)
+	events := mr.takeEvents()
+	mr.Unlock()
+	mr.emit(events)
+	return out
 }
 
+// RemoveListener releases the read position and the AddEncoderFor encoder kept
+// for the reader id, a listen-only participant that has left. The state of a
+// source is released by RemoveSourceStream, removing a listener that is also
+// a source only makes it start over from the next frame.
+func (mr *Multiplexer) RemoveListener(id string) {
+	mr.Lock()
+	defer mr.Unlock()
+	delete(mr.readSeq, id)
+	delete(mr.minusEncoders, id)
+	delete(mr.minusFIFOs, id)
+}
+
+// encoderFrameSize returns the number of interleaved samples of the mix that
+// make up one frame of enc.
+func (mr *Multiplexer) encoderFrameSize(enc Encoder) int {
+	size := enc.SampleSize()
+	if rate := enc.Format().rate(mr.sampleRate); rate != mr.sampleRate {
+		size = size * mr.sampleRate / rate
+	}
+	return size * mr.channels
+}
+
+// toEncoder converts a frame of the mix to the channel layout and sample rate
+// of enc, resampling through the converter in fifo, which is created on first
+// use. Must be called with the lock held.
+func (mr *Multiplexer) toEncoder(fifo **resampleFIFO, enc Encoder, pcm []int16) ([]int16, error) {
+	channels := enc.ChannelCount()
+	if channels != mr.channels {
+		out := make([]int16, len(pcm)/mr.channels*channels)
+		DefaultChannelMatrix(mr.channels, channels).apply(out, pcm)
+		pcm = out
+	}
+	rate := enc.Format().rate(mr.sampleRate)
+	if rate == mr.sampleRate {
+		return pcm, nil
+	}
+	r := *fifo
+	if r == nil || r.resampler.OutputRate() != rate || r.resampler.ChannelCount() != channels {
+		f, err := newResampleFIFO(mr.sampleRate, rate, channels)
+		if err != nil {
+			return nil, err
+		}
+		*fifo = f
+	}
+	(*fifo).push(pcm)
+	out := make([]int16, enc.SampleSize()*channels)
+	return out[:(*fifo).pop(out)], nil
+}
+
+// Read encodes the next frame of the mix with the encoder configured by
+// AddEncoder, converting the mix to the encoder's channel layout and, when it
+// reports one, sample rate.
 func (mr *Multiplexer) Read(dst []byte) (int, error) {
-	data := mr.ReadPCM(mr.encoder.SampleSize() * mr.encoder.ChannelCount())
+	data := mr.ReadPCM(mr.encoderFrameSize(mr.encoder))
 	if len(data) == 0 {
 		return 0, nil
 	}
+	mr.Lock()
+	data, err := mr.toEncoder(&mr.encoderFIFO, mr.encoder, data)
+	mr.Unlock()
+	if err != nil {
+		return 0, err
+	}
 
 	n, err := mr.encoder.Encode(data, dst)
 	if err != nil {
@@ -189,3 +582,30 @@ func (mr *Multiplexer) Read(dst []byte) (int, error) {
 	log.Printf("encoded data: size(pcm): %v, n: %v, slicecap: %v", len(data), n, len(dst))
 	return n, nil
 }
+
+// ReadFor encodes the mix-minus output of id with the encoder configured by
+// AddEncoderFor.
+func (mr *Multiplexer) ReadFor(id string, dst []byte) (int, error) {
+	mr.RLock()
+	enc, ok := mr.minusEncoders[id]
+	mr.RUnlock()
+	if !ok {
+		return 0, errors.New("encoder is not configured for source")
+	}
+
+	data := mr.ReadPCMFor(id, mr.encoderFrameSize(enc))
+	if len(data) == 0 {
+		return 0, nil
+	}
+	mr.Lock()
+	fifo := mr.minusFIFOs[id]
+	data, err := mr.toEncoder(&fifo, enc, data)
+	if _, ok := mr.minusEncoders[id]; ok && fifo != nil {
+		mr.minusFIFOs[id] = fifo
+	}
+	mr.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return enc.Encode(data, dst)
+}
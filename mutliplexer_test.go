@@ -1,101 +1,51 @@
 package avmuxer
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
-	"log"
 	"os"
 	"testing"
 	"time"
 
-	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
-type sampleData struct {
-	data []byte
-	id   string
-}
-
-func newOggReader(inputFile string) (*oggreader.OggReader, *os.File, error) {
-	// Open the input OGG file
-	file, err := os.Open(inputFile)
-	if err != nil {
-		log.Fatalf("Error opening input file: %v", err)
-	}
-	// Decode the Opus data from the OGG file
-	oggReader, _, err := oggreader.NewWith(file)
-	return oggReader, file, err
-}
-
-func readOpusPayloadFromOgg(id string, oggReader *oggreader.OggReader, ch chan<- sampleData, closeCh chan struct{}) error {
-	maxReadUptoIndex := 100
-	var lastGranule uint64 = 0
-	for {
-		opusData, header, err := oggReader.ParseNextPage()
-		if err != nil {
-			if err == io.EOF {
-				closeCh <- struct{}{}
-				break
-			} else {
-				return err
-			}
-		}
-		sampleCount := float64(header.GranulePosition - lastGranule)
-		lastGranule = header.GranulePosition
-		if sampleCount == 0 {
-			continue
-		}
-		log.Printf("ogg header: %+v, lastGranule: %v", header, lastGranule)
-		if (header.GranulePosition / uint64(sampleCount)) == uint64(maxReadUptoIndex) {
-			closeCh <- struct{}{}
-			break
-		}
-		ch <- sampleData{data: opusData, id: id}
-		time.Sleep(20 * time.Millisecond)
-	}
-	return nil
-}
-
 func TestOpusStream_Decode(t *testing.T) {
 	// Load an Ogg file with Opus data from the testdata folder
-	reader, file, err := newOggReader("testdata/1.ogg")
+	reader, err := NewOggOpusFileStream("testdata/1.ogg")
 	assert.NoError(t, err)
-	defer file.Close()
+	defer reader.Close()
 
 	// Initialize the Opus decoder stream
 	stream, err := NewDecodingOpusStream("testStream", 48000, 20, 2)
 	assert.NoError(t, err)
 
-	ch := make(chan sampleData)
-	closeCh := make(chan struct{})
-	go readOpusPayloadFromOgg("1", reader, ch, closeCh)
 	writeFile, err := os.Create("testdata/1.pcm")
 	assert.NoError(t, err)
 	defer writeFile.Close()
-	for {
-		select {
-		case data := <-ch:
-			// Create a buffer for the decoded PCM data
-			pcm := make([]int16, stream.SampleCount()*stream.ChannelCount())
-
-			// Decode the Opus data
-			_, err = stream.Write(data.data)
-			assert.NoError(t, err)
-
-			_, err = stream.ReadPCM(pcm)
-			assert.NoError(t, err)
-			// Validate that the decoded PCM data is non-empty
-			assert.NotEmpty(t, pcm)
-			for _, sample := range pcm {
-				err = binary.Write(writeFile, binary.LittleEndian, sample)
-				assert.NoError(t, err)
-			}
-		case <-closeCh:
-			return
+	for i := 0; i < 99; i++ {
+		data, err := nextOpusPacket(reader)
+		if err == io.EOF {
+			break
 		}
-	}
+		assert.NoError(t, err)
+
+		// Create a buffer for the decoded PCM data
+		pcm := make([]int16, stream.SampleCount()*stream.ChannelCount())
 
+		// Decode the Opus data
+		_, err = stream.Write(data)
+		assert.NoError(t, err)
+
+		_, err = stream.ReadPCM(pcm)
+		assert.NoError(t, err)
+		// Validate that the decoded PCM data is non-empty
+		assert.NotEmpty(t, pcm)
+		err = binary.Write(writeFile, binary.LittleEndian, pcm)
+		assert.NoError(t, err)
+	}
 }
 
 func TestOpusStream_Encode(t *testing.T) {
@@ -152,8 +102,17 @@ func TestMultiplexer_AddOpusSourceStream(t *testing.T) {
 	assert.Contains(t, mux.sources, "testStream")
 }
 
+// nextOpusPacket returns the next audio packet of an Ogg Opus stream without
+// decoding it.
+func nextOpusPacket(s *OggOpusStream) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextPacket()
+}
+
 func TestMultiplexer_ReadPCM16(t *testing.T) {
-	mux := NewMultiplexer()
+	clock := NewManualClock(time.Unix(0, 0))
+	mux := NewMultiplexer(MixerOptions{Clock: clock})
 
 	// Initialize and add an Opus decoding stream to the multiplexer
 	stream1, err := NewDecodingOpusStream("1", 48000, 20, 2)
@@ -168,59 +127,58 @@ func TestMultiplexer_ReadPCM16(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Load an Ogg file with Opus data from the testdata folder
-	reader1, file1, err := newOggReader("testdata/1.ogg")
+	reader1, err := NewOggOpusFileStream("testdata/1.ogg")
 	assert.NoError(t, err)
-	defer file1.Close()
+	defer reader1.Close()
 
 	// Load an Ogg file with Opus data from the testdata folder
-	reader2, file2, err := newOggReader("testdata/2.ogg")
+	reader2, err := NewOggOpusFileStream("testdata/2.ogg")
 	assert.NoError(t, err)
-	defer file2.Close()
+	defer reader2.Close()
 
-	ch := make(chan sampleData)
-	closeCh := make(chan struct{}, 2)
-	closedCount := 0
-	go readOpusPayloadFromOgg("1", reader1, ch, closeCh)
-	go readOpusPayloadFromOgg("2", reader2, ch, closeCh)
 	writeFile, err := os.Create("testdata/muxed.pcm")
 	assert.NoError(t, err)
 	defer writeFile.Close()
 
-	go func() {
-		for {
-			select {
-			case data := <-ch:
-				if data.id == "1" {
-					// Simulate writing the Opus data to the stream
-					_, err = stream1.Write(data.data)
-				} else {
-					_, err = stream2.Write(data.data)
-				}
-				assert.NoError(t, err)
-
-			case <-closeCh:
-				closedCount += 1
-				if closedCount == 2 {
-					return
-				}
-			}
+	frames := make(chan MixFrame, 1)
+	err = mux.AddSink("test", MixSinkFunc(func(f MixFrame) error {
+		frames <- f
+		return nil
+	}))
+	assert.NoError(t, err)
+
+	// feed one packet per stream for every 20ms frame of virtual time
+	feed := func() bool {
+		data1, err1 := nextOpusPacket(reader1)
+		data2, err2 := nextOpusPacket(reader2)
+		if err1 != nil || err2 != nil {
+			return false
 		}
-	}()
-	startTime := time.Now()
-	for {
-		if startTime.Add(2*time.Second).Compare(time.Now()) < 0 {
-			break
+		_, err = stream1.Write(data1)
+		assert.NoError(t, err)
+		_, err = stream2.Write(data2)
+		assert.NoError(t, err)
+		return true
+	}
+
+	assert.True(t, feed())
+	assert.NoError(t, mux.Start(context.Background(), 20*time.Millisecond))
+	defer mux.Stop()
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			if !feed() {
+				break
+			}
+			assert.Eventually(t, func() bool { return clock.Timers() == 1 }, time.Second, time.Millisecond)
+			clock.Advance(20 * time.Millisecond)
 		}
-		// Decode the Opus data
-		pcm := mux.ReadPCM(960 * 2)
+		frame := <-frames
 
 		// Validate that the decoded PCM data is non-empty
-		assert.NotEmpty(t, pcm)
-		for _, sample := range pcm {
-			err = binary.Write(writeFile, binary.LittleEndian, sample)
-			assert.NoError(t, err)
-		}
-		time.Sleep(20 * time.Millisecond)
+		assert.False(t, frame.Silent)
+		assert.Len(t, frame.PCM, 960*2)
+		err = binary.Write(writeFile, binary.LittleEndian, frame.PCM)
+		assert.NoError(t, err)
 	}
 }
 
@@ -233,3 +191,161 @@ func generateTestPCM(sampleCount, repeatCount int) []int16 {
 	}
 	return pcm
 }
+
+// constantStream is a Stream producing samples of a fixed value
+type constantStream struct {
+	value int16
+	reads int
+}
+
+func (cs *constantStream) ReadPCM(dst []int16) (int, error) {
+	cs.reads++
+	for i := range dst {
+		dst[i] = cs.value
+	}
+	return len(dst), nil
+}
+
+func (cs *constantStream) WritePCM([]int16) (int, error) {
+	return 0, nil
+}
+
+func (cs *constantStream) Format() Format {
+	return Format{}
+}
+
+func TestMultiplexer_ReadPCMFor(t *testing.T) {
+	mux := NewMultiplexer()
+	streams := map[string]*constantStream{
+		"a": {value: 300},
+		"b": {value: 600},
+		"c": {value: 900},
+	}
+	for id, s := range streams {
+		assert.NoError(t, mux.AddSourceStream(id, s))
+	}
+
+	for round := 1; round <= 3; round++ {
+		full := mux.ReadPCM(4)
+		a := mux.ReadPCMFor("a", 4)
+		b := mux.ReadPCMFor("b", 4)
+		c := mux.ReadPCMFor("c", 4)
+		listener := mux.ReadPCMFor("listener", 4)
+
+		assert.Equal(t, []int16{1800, 1800, 1800, 1800}, full)
+		assert.Equal(t, []int16{1500, 1500, 1500, 1500}, a)
+		assert.Equal(t, []int16{1200, 1200, 1200, 1200}, b)
+		assert.Equal(t, []int16{900, 900, 900, 900}, c)
+		assert.Equal(t, full, listener)
+
+		// every reader shares the frame, sources are only read once per round
+		for _, s := range streams {
+			assert.Equal(t, round, s.reads)
+		}
+	}
+
+	// a listener that left is forgotten
+	mux.RemoveListener("listener")
+	mux.RLock()
+	_, ok := mux.readSeq["listener"]
+	mux.RUnlock()
+	assert.False(t, ok)
+	assert.Equal(t, []int16{1500, 1500, 1500, 1500}, mux.ReadPCMFor("a", 4))
+}
+
+func TestMultiplexer_ReadFor(t *testing.T) {
+	mux := NewMultiplexer()
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 100}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 200}))
+
+	_, err := mux.ReadFor("a", make([]byte, 100))
+	assert.Error(t, err)
+
+	enc := new(MockEncoder)
+	enc.On("SampleSize").Return(2)
+	enc.On("ChannelCount").Return(1)
+	enc.On("Encode", []int16{200, 200}, mock.Anything).Return(10, nil)
+	assert.NoError(t, mux.AddEncoderFor("a", enc))
+	assert.Error(t, mux.AddEncoderFor("a", enc))
+
+	n, err := mux.ReadFor("a", make([]byte, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	enc.AssertExpectations(t)
+}
+
+// bufferStream is a Stream backed by a RingBuffer
+type bufferStream struct {
+	*RingBuffer[int16]
+}
+
+func newBufferStream(samples []int16) *bufferStream {
+	bs := &bufferStream{NewRingBuffer[int16](len(samples) + 1)}
+	_, _ = bs.Write(samples)
+	return bs
+}
+
+func (bs *bufferStream) ReadPCM(dst []int16) (int, error) {
+	return bs.Read(dst)
+}
+
+func (bs *bufferStream) WritePCM(pcm []int16) (int, error) {
+	return bs.Write(pcm)
+}
+
+func (bs *bufferStream) Format() Format {
+	return Format{}
+}
+
+func TestMultiplexer_RemoveSourceStream(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, FadeOutSamples: 8})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 100}))
+	residual := make([]int16, 32)
+	for i := range residual {
+		residual[i] = 9000
+	}
+	assert.NoError(t, mux.AddSourceStream("b", newBufferStream(residual)))
+	assert.Equal(t, []string{"a", "b"}, mux.Sources())
+
+	assert.Equal(t, []int16{9100, 9100, 9100, 9100}, mux.ReadPCM(4))
+
+	assert.NoError(t, mux.RemoveSourceStream("b"))
+	assert.Error(t, mux.RemoveSourceStream("b"))
+	assert.Equal(t, []string{"a"}, mux.Sources())
+
+	// the residual of b is ramped down over 8 samples
+	fade := append(mux.ReadPCM(4), mux.ReadPCM(4)...)
+	for i := 1; i < len(fade); i++ {
+		assert.Less(t, fade[i], fade[i-1])
+	}
+	assert.Greater(t, fade[0], int16(8000))
+	assert.Less(t, fade[7], int16(1200))
+
+	// and gone afterwards
+	assert.Equal(t, []int16{100, 100, 100, 100}, mux.ReadPCM(4))
+	assert.Empty(t, mux.departing)
+}
+
+func TestMultiplexer_ReplaceSourceStream(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, FadeOutSamples: -1})
+	assert.Error(t, mux.ReplaceSourceStream("a", &constantStream{value: 1}))
+
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 100}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 10}))
+	assert.Equal(t, []int16{110, 110}, mux.ReadPCM(2))
+
+	assert.NoError(t, mux.ReplaceSourceStream("a", &constantStream{value: 200}))
+	assert.Equal(t, []int16{210, 210}, mux.ReadPCM(2))
+	assert.Equal(t, []int16{10, 10}, mux.ReadPCMFor("a", 2))
+	assert.Equal(t, []string{"a", "b"}, mux.Sources())
+}
+
+func TestMultiplexer_ReplaceExcludesFadingStreamFromMinus(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, FadeOutSamples: 4})
+	assert.NoError(t, mux.AddSourceStream("a", newBufferStream([]int16{500, 500, 500, 500, 500, 500})))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 10}))
+	mux.ReadPCM(2)
+
+	assert.NoError(t, mux.ReplaceSourceStream("a", &constantStream{value: 200}))
+	assert.Equal(t, []int16{10, 10}, mux.ReadPCMFor("a", 2))
+}
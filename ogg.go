@@ -0,0 +1,207 @@
+package avmuxer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidOggPage = errors.New("invalid ogg page")
+	ErrOggChecksum    = errors.New("ogg page checksum mismatch")
+)
+
+const (
+	oggHeaderSize = 27
+	// oggMaxSegments is the largest number of lacing values, and so of 255
+	// byte segments, a page holds.
+	oggMaxSegments = 255
+
+	oggFlagContinued = 0x01
+	oggFlagBOS       = 0x02
+	oggFlagEOS       = 0x04
+
+	// oggNoGranule is the granule position of a page on which no packet
+	// ends.
+	oggNoGranule = -1
+)
+
+// oggCRCTable is the table of the CRC-32 of the Ogg framing, polynomial
+// 0x04c11db7 without reflection.
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggPage is a page of an Ogg bitstream.
+type oggPage struct {
+	flags   byte
+	granule int64
+	serial  uint32
+	seq     uint32
+	// lacing holds the segment sizes of body.
+	lacing []byte
+	body   []byte
+}
+
+// packets splits the body of the page into packets. The last one is partial,
+// to be continued on the next page, when partial is true.
+func (p *oggPage) packets() (packets [][]byte, partial bool) {
+	start, end := 0, 0
+	for i, l := range p.lacing {
+		end += int(l)
+		if l < 255 {
+			packets = append(packets, p.body[start:end])
+			start = end
+		} else if i == len(p.lacing)-1 {
+			return append(packets, p.body[start:end]), true
+		}
+	}
+	return packets, false
+}
+
+// oggPageReader reads the pages of an Ogg bitstream, keeping track of the
+// offset of the next one.
+type oggPageReader struct {
+	r      *bufio.Reader
+	offset int64
+	header [oggHeaderSize]byte
+}
+
+func newOggPageReader(r io.Reader) *oggPageReader {
+	return &oggPageReader{r: bufio.NewReader(r)}
+}
+
+// reset restarts reading from r, which is at offset.
+func (pr *oggPageReader) reset(r io.Reader, offset int64) {
+	pr.r.Reset(r)
+	pr.offset = offset
+}
+
+// next reads the next page, returning io.EOF at the end of the bitstream.
+// When skipBody is true the body is discarded instead of read.
+func (pr *oggPageReader) next(skipBody bool) (*oggPage, error) {
+	h := pr.header[:]
+	if _, err := io.ReadFull(pr.r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidOggPage
+		}
+		return nil, err
+	}
+	if string(h[:4]) != "OggS" || h[4] != 0 {
+		return nil, ErrInvalidOggPage
+	}
+	p := &oggPage{
+		flags:   h[5],
+		granule: int64(binary.LittleEndian.Uint64(h[6:14])),
+		serial:  binary.LittleEndian.Uint32(h[14:18]),
+		seq:     binary.LittleEndian.Uint32(h[18:22]),
+		lacing:  make([]byte, h[26]),
+	}
+	if _, err := io.ReadFull(pr.r, p.lacing); err != nil {
+		return nil, ErrInvalidOggPage
+	}
+	size := 0
+	for _, l := range p.lacing {
+		size += int(l)
+	}
+	pr.offset += int64(oggHeaderSize + len(p.lacing) + size)
+	if skipBody {
+		if _, err := pr.r.Discard(size); err != nil {
+			return nil, ErrInvalidOggPage
+		}
+		return p, nil
+	}
+
+	p.body = make([]byte, size)
+	if _, err := io.ReadFull(pr.r, p.body); err != nil {
+		return nil, ErrInvalidOggPage
+	}
+	crc := binary.LittleEndian.Uint32(h[22:26])
+	h[22], h[23], h[24], h[25] = 0, 0, 0, 0
+	sum := oggCRC(0, h)
+	sum = oggCRC(sum, p.lacing)
+	if oggCRC(sum, p.body) != crc {
+		return nil, ErrOggChecksum
+	}
+	return p, nil
+}
+
+// oggPageWriter writes the pages of a logical Ogg bitstream.
+type oggPageWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+	buf    []byte
+}
+
+// writePage frames body, made of segments of the sizes in lacing, as the next
+// page of the bitstream.
+func (pw *oggPageWriter) writePage(flags byte, granule int64, lacing, body []byte) error {
+	page := pw.buf[:0]
+	page = append(page, "OggS"...)
+	page = append(page, 0, flags)
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, pw.serial)
+	page = binary.LittleEndian.AppendUint32(page, pw.seq)
+	page = append(page, 0, 0, 0, 0, byte(len(lacing)))
+	page = append(page, lacing...)
+	page = append(page, body...)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(0, page))
+	pw.buf = page
+	pw.seq++
+	_, err := pw.w.Write(page)
+	return err
+}
+
+// writePacket writes pkt on pages of its own, continuing it over as many as
+// it takes.
+func (pw *oggPageWriter) writePacket(flags byte, granule int64, pkt []byte) error {
+	lacing := oggLacing(nil, len(pkt))
+	for {
+		n := min(len(lacing), oggMaxSegments)
+		size := 0
+		for _, l := range lacing[:n] {
+			size += int(l)
+		}
+		last := n == len(lacing)
+		g := int64(oggNoGranule)
+		if last {
+			g = granule
+		}
+		if err := pw.writePage(flags, g, lacing[:n], pkt[:size]); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		flags = oggFlagContinued
+		lacing, pkt = lacing[n:], pkt[size:]
+	}
+}
+
+// oggLacing appends the segment sizes of a packet of size bytes to lacing.
+func oggLacing(lacing []byte, size int) []byte {
+	for ; size >= 255; size -= 255 {
+		lacing = append(lacing, 255)
+	}
+	return append(lacing, byte(size))
+}
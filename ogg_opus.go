@@ -0,0 +1,184 @@
+package avmuxer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// opusGranuleRate is the rate Ogg Opus granule positions and pre-skip are
+// counted at, whatever the rate of the audio.
+const opusGranuleRate = 48000
+
+var (
+	ErrInvalidOpusHead   = errors.New("invalid OpusHead packet")
+	ErrInvalidOpusTags   = errors.New("invalid OpusTags packet")
+	ErrInvalidOpusPacket = errors.New("invalid opus packet")
+)
+
+// OpusHead is the identification header of an Ogg Opus stream, RFC 7845
+// section 5.1.
+type OpusHead struct {
+	Version  uint8
+	Channels int
+	// PreSkip is the number of samples at 48 kHz to discard from the start
+	// of the decoded audio.
+	PreSkip uint16
+	// InputSampleRate is the rate of the audio before it was encoded, for
+	// information only.
+	InputSampleRate uint32
+	// OutputGain is the gain to apply to the decoded audio in dB, Q7.8.
+	OutputGain int16
+	// MappingFamily is the channel mapping family, 0 for mono or stereo
+	// streams.
+	MappingFamily uint8
+}
+
+// gain returns the linear factor of the output gain.
+func (h OpusHead) gain() float64 {
+	return math.Pow(10, float64(h.OutputGain)/(20*256))
+}
+
+func parseOpusHead(pkt []byte) (OpusHead, error) {
+	if len(pkt) < 19 || string(pkt[:8]) != "OpusHead" {
+		return OpusHead{}, ErrInvalidOpusHead
+	}
+	h := OpusHead{
+		Version:         pkt[8],
+		Channels:        int(pkt[9]),
+		PreSkip:         binary.LittleEndian.Uint16(pkt[10:12]),
+		InputSampleRate: binary.LittleEndian.Uint32(pkt[12:16]),
+		OutputGain:      int16(binary.LittleEndian.Uint16(pkt[16:18])),
+		MappingFamily:   pkt[18],
+	}
+	// only the major version, the upper four bits, is incompatible
+	if h.Version>>4 != 0 || h.Channels == 0 {
+		return OpusHead{}, ErrInvalidOpusHead
+	}
+	if h.MappingFamily != 0 && len(pkt) < 21+h.Channels {
+		return OpusHead{}, ErrInvalidOpusHead
+	}
+	return h, nil
+}
+
+// marshal writes the header of a mono or stereo stream, channel mapping
+// family 0.
+func (h OpusHead) marshal() []byte {
+	pkt := append([]byte("OpusHead"), 1, byte(h.Channels))
+	pkt = binary.LittleEndian.AppendUint16(pkt, h.PreSkip)
+	pkt = binary.LittleEndian.AppendUint32(pkt, h.InputSampleRate)
+	pkt = binary.LittleEndian.AppendUint16(pkt, uint16(h.OutputGain))
+	return append(pkt, 0)
+}
+
+// validate reports streams that decode to more than one Opus stream, which
+// the decoder doesn't support.
+func (h OpusHead) validate() error {
+	if h.Channels > 2 || h.MappingFamily > 1 {
+		return fmt.Errorf("unsupported opus channel mapping family %d with %d channels", h.MappingFamily, h.Channels)
+	}
+	return nil
+}
+
+// OpusTags is the comment header of an Ogg Opus stream, RFC 7845 section 5.2.
+type OpusTags struct {
+	Vendor string
+	// Comments maps the upper case field names, such as TITLE or ARTIST, to
+	// their value.
+	Comments map[string]string
+}
+
+func parseOpusTags(pkt []byte) (OpusTags, error) {
+	if len(pkt) < 16 || string(pkt[:8]) != "OpusTags" {
+		return OpusTags{}, ErrInvalidOpusTags
+	}
+	pkt = pkt[8:]
+	next := func() (string, bool) {
+		if len(pkt) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(pkt)
+		if uint64(n) > uint64(len(pkt)-4) {
+			return "", false
+		}
+		s := string(pkt[4 : 4+n])
+		pkt = pkt[4+n:]
+		return s, true
+	}
+
+	vendor, ok := next()
+	if !ok || len(pkt) < 4 {
+		return OpusTags{}, ErrInvalidOpusTags
+	}
+	tags := OpusTags{Vendor: vendor, Comments: make(map[string]string)}
+	count := binary.LittleEndian.Uint32(pkt)
+	pkt = pkt[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return OpusTags{}, ErrInvalidOpusTags
+		}
+		if name, value, ok := strings.Cut(comment, "="); ok {
+			tags.Comments[strings.ToUpper(name)] = value
+		}
+	}
+	return tags, nil
+}
+
+// marshal writes the comments in the order of their names.
+func (t OpusTags) marshal() []byte {
+	names := make([]string, 0, len(t.Comments))
+	for name := range t.Comments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pkt := []byte("OpusTags")
+	pkt = binary.LittleEndian.AppendUint32(pkt, uint32(len(t.Vendor)))
+	pkt = append(pkt, t.Vendor...)
+	pkt = binary.LittleEndian.AppendUint32(pkt, uint32(len(names)))
+	for _, name := range names {
+		comment := strings.ToUpper(name) + "=" + t.Comments[name]
+		pkt = binary.LittleEndian.AppendUint32(pkt, uint32(len(comment)))
+		pkt = append(pkt, comment...)
+	}
+	return pkt
+}
+
+// opusFrameSamples are the frame sizes at 48 kHz of the TOC configurations,
+// RFC 6716 section 3.1.
+var opusFrameSamples = [32]int{
+	// SILK
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880,
+	// Hybrid
+	480, 960, 480, 960,
+	// CELT
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960,
+}
+
+// opusPacketSamples returns the number of samples at 48 kHz an Opus packet
+// decodes to, from its TOC byte.
+func opusPacketSamples(pkt []byte) (int, error) {
+	if len(pkt) == 0 {
+		return 0, ErrInvalidOpusPacket
+	}
+	frames := 1
+	switch pkt[0] & 0x3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(pkt) < 2 {
+			return 0, ErrInvalidOpusPacket
+		}
+		frames = int(pkt[1] & 0x3f)
+	}
+	samples := frames * opusFrameSamples[pkt[0]>>3]
+	// a packet holds at least one frame and at most 120ms
+	if frames == 0 || samples > opusGranuleRate*opusMaxPacketMs/1000 {
+		return 0, ErrInvalidOpusPacket
+	}
+	return samples, nil
+}
@@ -0,0 +1,401 @@
+package avmuxer
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrNotSeekable = errors.New("stream is not seekable")
+
+const (
+	// opusMaxPacketMs is the longest duration an Opus packet can hold.
+	opusMaxPacketMs = 120
+	// opusSeekPreRoll is the audio decoded ahead of a seek target, in
+	// samples at 48 kHz, for the decoder to converge, RFC 7845 section 4.6.
+	opusSeekPreRoll = 3840
+)
+
+// OggOpusOptions configures an OggOpusStream.
+type OggOpusOptions struct {
+	// SampleRate is the rate the audio is decoded at, one of the rates Opus
+	// supports. Defaults to 48000.
+	SampleRate int
+	// Loop restarts the stream from the beginning when it ends, which
+	// requires a seekable reader.
+	Loop bool
+}
+
+// OggOpusStream is a Stream decoding an Ogg Opus file on demand, such as hold
+// music or an announcement to mix.
+type OggOpusStream struct {
+	mu sync.Mutex
+
+	r      io.Reader
+	closer io.Closer
+	pages  *oggPageReader
+	// audioOffset is the offset of the first audio page.
+	audioOffset int64
+
+	head       OpusHead
+	tags       OpusTags
+	gain       float64
+	sampleRate int
+	channels   int
+	loop       bool
+
+	decoder *OpusDecoder
+	decoded []int16
+	// packets are the complete packets of the current page that are still
+	// to decode, partial is the start of a packet continued on the next
+	// page.
+	packets [][]byte
+	partial []byte
+
+	// granule is the granule position at the end of the last decoded
+	// packet, end is the one of the last page when it was read, -1 before.
+	granule int64
+	end     int64
+	// skip is the number of samples per channel still to discard, pcm holds
+	// the decoded samples not read yet.
+	skip     int
+	pcm      []int16
+	position int64
+	ended    bool
+}
+
+// NewOggOpusFileStream opens the Ogg Opus file at path as a Stream. The file
+// is closed by Close.
+func NewOggOpusFileStream(path string, opts ...OggOpusOptions) (*OggOpusStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewOggOpusStream(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// NewOggOpusStream reads an Ogg Opus stream from r as a Stream. The headers
+// are parsed straight away, the audio is decoded as it is read. Looping and
+// Seek need r to be an io.Seeker.
+func NewOggOpusStream(r io.Reader, opts ...OggOpusOptions) (*OggOpusStream, error) {
+	var o OggOpusOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.SampleRate == 0 {
+		o.SampleRate = opusGranuleRate
+	}
+	if _, ok := r.(io.Seeker); o.Loop && !ok {
+		return nil, ErrNotSeekable
+	}
+
+	s := &OggOpusStream{
+		r:          r,
+		pages:      newOggPageReader(r),
+		sampleRate: o.SampleRate,
+		loop:       o.Loop,
+	}
+	if err := s.readHeaders(); err != nil {
+		return nil, err
+	}
+	s.channels = s.head.Channels
+	s.gain = s.head.gain()
+	if err := s.restart(0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readHeaders parses the OpusHead and OpusTags packets that start the stream.
+func (s *OggOpusStream) readHeaders() error {
+	page, err := s.pages.next(false)
+	if err != nil {
+		return err
+	}
+	pkts, _ := page.packets()
+	if page.flags&oggFlagBOS == 0 || len(pkts) != 1 {
+		return ErrInvalidOpusHead
+	}
+	if s.head, err = parseOpusHead(pkts[0]); err != nil {
+		return err
+	}
+	if err := s.head.validate(); err != nil {
+		return err
+	}
+
+	// the comment header may span several pages, the audio starts on the
+	// page after it
+	var tags []byte
+	for {
+		page, err := s.pages.next(false)
+		if err != nil {
+			if err == io.EOF {
+				return ErrInvalidOpusTags
+			}
+			return err
+		}
+		pkts, partial := page.packets()
+		if len(pkts) > 0 {
+			tags = append(tags, pkts[0]...)
+		}
+		if !partial || len(pkts) > 1 {
+			break
+		}
+	}
+	s.audioOffset = s.pages.offset
+	s.tags, err = parseOpusTags(tags)
+	return err
+}
+
+// Head returns the identification header of the stream.
+func (s *OggOpusStream) Head() OpusHead {
+	return s.head
+}
+
+// Tags returns the comment header of the stream.
+func (s *OggOpusStream) Tags() OpusTags {
+	return s.tags
+}
+
+func (s *OggOpusStream) SampleRate() int {
+	return s.sampleRate
+}
+
+func (s *OggOpusStream) ChannelCount() int {
+	return s.channels
+}
+
+func (s *OggOpusStream) Format() Format {
+	return pcmFormat(s.sampleRate, s.channels, 0)
+}
+
+// Position returns the position in the audio of the next sample ReadPCM
+// returns.
+func (s *OggOpusStream) Position() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.position) * time.Second / time.Duration(s.sampleRate)
+}
+
+// Seek moves the stream to the position d in the audio. The pages are
+// scanned from the start for the one to resume decoding from, a little ahead
+// of d for the decoder to converge. Seeking past the end ends the stream.
+func (s *OggOpusStream) Seek(d time.Duration) error {
+	if d < 0 {
+		return errors.New("invalid seek position")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pcm = s.pcm[:0]
+	return s.restart(d)
+}
+
+// restart resumes decoding at position d of the audio. The samples decoded
+// but not read yet are kept, position is the one of the first sample decoded
+// from d. Must be called with the lock held.
+func (s *OggOpusStream) restart(d time.Duration) error {
+	target := int64(s.head.PreSkip) + int64(d)*opusGranuleRate/int64(time.Second)
+	offset, granule := s.audioOffset, int64(0)
+	if target-opusSeekPreRoll > 0 {
+		var err error
+		if offset, granule, err = s.findPage(target - opusSeekPreRoll); err != nil {
+			return err
+		}
+	} else if err := s.seekTo(offset); err != nil {
+		return err
+	}
+
+	dec, err := NewOpusDecoder(s.sampleRate, s.channels, s.sampleRate*opusMaxPacketMs/1000)
+	if err != nil {
+		return err
+	}
+	s.decoder = dec.(*OpusDecoder)
+	s.decoded = make([]int16, s.sampleRate*opusMaxPacketMs/1000*s.channels)
+	s.packets, s.partial = nil, nil
+	s.granule, s.end = granule, -1
+	s.skip = s.samples(target - granule)
+	s.position = int64(s.samples(target - int64(s.head.PreSkip)))
+	s.ended = false
+	return nil
+}
+
+// findPage scans the audio pages for the last one before granule that starts
+// with a new packet, returning its offset and the granule position of the
+// audio before it. The stream is left at that page.
+func (s *OggOpusStream) findPage(granule int64) (int64, int64, error) {
+	if err := s.seekTo(s.audioOffset); err != nil {
+		return 0, 0, err
+	}
+	offset, start := s.audioOffset, int64(0)
+	prev := int64(0)
+	for prev < granule {
+		pageOffset := s.pages.offset
+		page, err := s.pages.next(true)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if page.flags&oggFlagContinued == 0 {
+			offset, start = pageOffset, prev
+		}
+		if page.granule != oggNoGranule {
+			prev = page.granule
+		}
+	}
+	return offset, start, s.seekTo(offset)
+}
+
+// seekTo moves the reader to offset, which is where a page starts.
+func (s *OggOpusStream) seekTo(offset int64) error {
+	if offset == s.pages.offset {
+		return nil
+	}
+	seeker, ok := s.r.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.pages.reset(s.r, offset)
+	return nil
+}
+
+// samples converts a number of samples at 48 kHz to the decoding rate.
+func (s *OggOpusStream) samples(granules int64) int {
+	return int(granules * int64(s.sampleRate) / opusGranuleRate)
+}
+
+// nextPacket returns the next audio packet, or io.EOF after the last one.
+// Must be called with the lock held.
+func (s *OggOpusStream) nextPacket() ([]byte, error) {
+	for len(s.packets) == 0 {
+		if s.end >= 0 {
+			return nil, io.EOF
+		}
+		page, err := s.pages.next(false)
+		if err != nil {
+			return nil, err
+		}
+		pkts, partial := page.packets()
+		if page.flags&oggFlagContinued != 0 && len(pkts) > 0 {
+			switch {
+			case s.partial != nil:
+				pkts[0] = append(s.partial, pkts[0]...)
+			case partial && len(pkts) == 1:
+				// a continued packet whose start was not read is
+				// dropped
+				pkts, partial = nil, false
+			default:
+				pkts = pkts[1:]
+			}
+		}
+		s.partial = nil
+		if partial {
+			s.partial = pkts[len(pkts)-1]
+			pkts = pkts[:len(pkts)-1]
+		}
+		s.packets = pkts
+		if page.flags&oggFlagEOS != 0 {
+			s.end = page.granule
+		}
+	}
+	pkt := s.packets[0]
+	s.packets = s.packets[1:]
+	return pkt, nil
+}
+
+// decodeNext decodes the next packet into pcm, trimming the pre-skip, seek
+// pre-roll and the padding of the last packet. Must be called with the lock
+// held.
+func (s *OggOpusStream) decodeNext() error {
+	pkt, err := s.nextPacket()
+	if err != nil {
+		return err
+	}
+	n, err := s.decoder.Decode(pkt, s.decoded)
+	if err != nil {
+		log.Printf("failed to decode ogg opus packet: %v", err)
+		return nil
+	}
+	start := s.granule
+	s.granule += int64(n) * opusGranuleRate / int64(s.sampleRate)
+	if s.end >= 0 && s.granule > s.end {
+		n = max(0, s.samples(s.end-start))
+	}
+	pcm := s.decoded[:n*s.channels]
+	skip := min(s.skip, n)
+	s.skip -= skip
+	pcm = pcm[skip*s.channels:]
+
+	if s.gain != 1 {
+		for i, v := range pcm {
+			pcm[i] = clampInt16(int32(float64(v) * s.gain))
+		}
+	}
+	s.pcm = append(s.pcm, pcm...)
+	return nil
+}
+
+// ReadPCM decodes the audio on demand. It returns io.EOF once the stream
+// ended, unless it loops.
+func (s *OggOpusStream) ReadPCM(dst []int16) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	looped := false
+	for len(s.pcm) < len(dst) && !s.ended {
+		before := len(s.pcm)
+		err := s.decodeNext()
+		if err == io.EOF && s.loop && !looped {
+			// a stream without audio doesn't loop forever
+			looped = true
+			if err = s.restart(0); err == nil {
+				// the tail of the previous pass is read first
+				s.position -= int64(len(s.pcm) / s.channels)
+				continue
+			}
+		}
+		if err == io.EOF {
+			s.ended = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(s.pcm) > before {
+			looped = false
+		}
+	}
+	if len(s.pcm) == 0 && s.ended {
+		return 0, io.EOF
+	}
+
+	n := copy(dst, s.pcm)
+	n -= n % s.channels
+	s.pcm = s.pcm[:copy(s.pcm, s.pcm[n:])]
+	s.position += int64(n / s.channels)
+	return n, nil
+}
+
+func (s *OggOpusStream) WritePCM([]int16) (int, error) {
+	return 0, errors.New("ogg opus stream doesn't support write pcm")
+}
+
+// Close closes the file of a stream created by NewOggOpusFileStream.
+func (s *OggOpusStream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,199 @@
+package avmuxer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// oggTestPage frames body, made of segments of the given sizes, as a page
+func oggTestPage(flags byte, granule int64, seq uint32, lacing, body []byte) []byte {
+	page := make([]byte, oggHeaderSize, oggHeaderSize+len(lacing)+len(body))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], 1)
+	binary.LittleEndian.PutUint32(page[18:], seq)
+	page[26] = byte(len(lacing))
+	page = append(append(page, lacing...), body...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(0, page))
+	return page
+}
+
+// lace returns the segment sizes and body of a page holding pkts, the last one
+// continued on the next page when partial is true
+func lace(partial bool, pkts ...[]byte) (lacing, body []byte) {
+	for i, pkt := range pkts {
+		n := len(pkt)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		if !partial || i < len(pkts)-1 {
+			lacing = append(lacing, byte(n))
+		}
+		body = append(body, pkt...)
+	}
+	return lacing, body
+}
+
+func opusHeadPacket(channels int, preSkip uint16) []byte {
+	pkt := []byte("OpusHead\x01")
+	pkt = append(pkt, byte(channels))
+	pkt = binary.LittleEndian.AppendUint16(pkt, preSkip)
+	pkt = binary.LittleEndian.AppendUint32(pkt, 48000)
+	return append(pkt, 0, 0, 0)
+}
+
+func opusTagsPacket(comments ...string) []byte {
+	pkt := []byte("OpusTags")
+	pkt = binary.LittleEndian.AppendUint32(pkt, 4)
+	pkt = append(pkt, "test"...)
+	pkt = binary.LittleEndian.AppendUint32(pkt, uint32(len(comments)))
+	for _, c := range comments {
+		pkt = binary.LittleEndian.AppendUint32(pkt, uint32(len(c)))
+		pkt = append(pkt, c...)
+	}
+	return pkt
+}
+
+// oggOpusTone returns an Ogg Opus file of ten 20ms packets of a 440 Hz tone
+// with a pre-skip of 312 samples and the last 100 samples trimmed. The fifth
+// packet spans two pages.
+func oggOpusTone(t *testing.T) []byte {
+	enc, err := NewOpusEncoder(48000, 1, 960, OpusEncoderConfig{Bitrate: 128000})
+	assert.NoError(t, err)
+	tone := sineWave(48000, 440, 9600, 8000)
+	pkts := make([][]byte, 10)
+	for i := range pkts {
+		buf := make([]byte, 4000)
+		n, err := enc.Encode(tone[i*960:(i+1)*960], buf)
+		assert.NoError(t, err)
+		pkts[i] = buf[:n]
+	}
+	assert.Greater(t, len(pkts[4]), 255)
+
+	var file []byte
+	lacing, body := lace(false, opusHeadPacket(1, 312))
+	file = append(file, oggTestPage(oggFlagBOS, 0, 0, lacing, body)...)
+	lacing, body = lace(false, opusTagsPacket("title=hold"))
+	file = append(file, oggTestPage(0, 0, 1, lacing, body)...)
+	lacing, body = lace(false, pkts[:3]...)
+	file = append(file, oggTestPage(0, 3*960, 2, lacing, body)...)
+	lacing, body = lace(true, pkts[3], pkts[4][:255])
+	file = append(file, oggTestPage(0, 4*960, 3, lacing, body)...)
+	lacing, body = lace(false, append([][]byte{pkts[4][255:]}, pkts[5:]...)...)
+	file = append(file, oggTestPage(oggFlagContinued|oggFlagEOS, 10*960-100, 4, lacing, body)...)
+	return file
+}
+
+// readAll reads s until it ends
+func readAll(t *testing.T, s Stream) []int16 {
+	var pcm []int16
+	buf := make([]int16, 480)
+	for {
+		n, err := s.ReadPCM(buf)
+		if err == io.EOF {
+			return pcm
+		}
+		assert.NoError(t, err)
+		pcm = append(pcm, buf[:n]...)
+	}
+}
+
+func TestOggOpusStream(t *testing.T) {
+	s, err := NewOggOpusStream(bytes.NewReader(oggOpusTone(t)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.Head().Channels)
+	assert.Equal(t, uint16(312), s.Head().PreSkip)
+	assert.Equal(t, OpusTags{Vendor: "test", Comments: map[string]string{"TITLE": "hold"}}, s.Tags())
+	assert.Equal(t, pcmFormat(48000, 1, 0), s.Format())
+
+	pcm := readAll(t, s)
+	assert.Len(t, pcm, 9600-312-100)
+	amplitude, _ := toneFit(pcm[2000:6000], 48000, 440)
+	assert.InDelta(t, 8000, amplitude, 800)
+	assert.Equal(t, time.Duration(len(pcm))*time.Second/48000, s.Position())
+
+	assert.NoError(t, s.Seek(100*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, s.Position())
+	assert.Len(t, readAll(t, s), 9600-312-100-4800)
+
+	assert.NoError(t, s.Seek(time.Second))
+	_, err = s.ReadPCM(make([]int16, 480))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestOggOpusStream_Loop(t *testing.T) {
+	file := oggOpusTone(t)
+	_, err := NewOggOpusStream(struct{ io.Reader }{bytes.NewReader(file)}, OggOpusOptions{Loop: true})
+	assert.ErrorIs(t, err, ErrNotSeekable)
+
+	s, err := NewOggOpusStream(bytes.NewReader(file), OggOpusOptions{Loop: true, SampleRate: 16000})
+	assert.NoError(t, err)
+	assert.Equal(t, 16000, s.SampleRate())
+	buf := make([]int16, 320)
+	for i := 0; i < 20; i++ {
+		n, err := s.ReadPCM(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 320, n)
+	}
+
+	// reads that straddle the end of the file lose nothing of it
+	s, err = NewOggOpusStream(bytes.NewReader(file), OggOpusOptions{Loop: true})
+	assert.NoError(t, err)
+	const length = 9600 - 312 - 100
+	var pcm []int16
+	buf = make([]int16, 1000)
+	for i := 0; i < 19; i++ {
+		n, err := s.ReadPCM(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, n)
+		pcm = append(pcm, buf...)
+	}
+	assert.Equal(t, pcm[:length], pcm[length:2*length])
+	assert.Equal(t, time.Duration(19000-2*length)*time.Second/48000, s.Position())
+}
+
+func TestOggOpusStream_Invalid(t *testing.T) {
+	file := oggOpusTone(t)
+	_, err := NewOggOpusStream(bytes.NewReader(file[:20]))
+	assert.ErrorIs(t, err, ErrInvalidOggPage)
+
+	corrupt := append([]byte(nil), file...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	s, err := NewOggOpusStream(bytes.NewReader(corrupt))
+	assert.NoError(t, err)
+	_, err = s.ReadPCM(make([]int16, 9600))
+	assert.ErrorIs(t, err, ErrOggChecksum)
+
+	_, err = NewOggOpusStream(bytes.NewReader(file[len(file)-100:]))
+	assert.Error(t, err)
+}
+
+func TestOggOpusFileStream(t *testing.T) {
+	_, err := NewOggOpusFileStream("testdata/missing.ogg")
+	assert.Error(t, err)
+
+	s, err := NewOggOpusFileStream("testdata/1.ogg")
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, 1, s.ChannelCount())
+	assert.Equal(t, uint32(24000), s.Head().InputSampleRate)
+	assert.NotEmpty(t, s.Tags().Vendor)
+	// a minute of audio, once the pre-skip and padding are trimmed
+	assert.Len(t, readAll(t, s), 60*48000)
+}
+
+func TestMultiplexer_OggOpusSource(t *testing.T) {
+	s, err := NewOggOpusStream(bytes.NewReader(oggOpusTone(t)))
+	assert.NoError(t, err)
+	mux := NewMultiplexer(MixerOptions{SampleRate: 16000, Channels: 1, GainRampSamples: -1})
+	assert.NoError(t, mux.AddSourceStream("hold", s))
+	mux.ReadPCM(320)
+	amplitude, _ := toneFit(mux.ReadPCM(960), 16000, 440)
+	assert.InDelta(t, 8000, amplitude, 800)
+}
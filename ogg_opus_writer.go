@@ -0,0 +1,209 @@
+package avmuxer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// opusDefaultPreSkip is the lookahead of the libopus encoder at 48 kHz.
+	opusDefaultPreSkip = 312
+	// oggOpusPageSamples is the audio, at 48 kHz, after which a page is
+	// written out.
+	oggOpusPageSamples = opusGranuleRate
+)
+
+// OggOpusWriterOptions configures an OggOpusWriter.
+type OggOpusWriterOptions struct {
+	// Channels is the channel count of the encoded audio, 1 or 2. Defaults
+	// to 1.
+	Channels int
+	// PreSkip is the number of samples at 48 kHz for players to discard from
+	// the start of the decoded audio. Defaults to 312, the lookahead of the
+	// libopus encoder.
+	PreSkip uint16
+	// InputSampleRate is the rate of the audio before it was encoded, for
+	// information only. Defaults to 48000.
+	InputSampleRate uint32
+	// OutputGain is the gain for players to apply in dB, Q7.8.
+	OutputGain int16
+	// Vendor is the vendor string of the OpusTags header, defaults to
+	// "avmuxer".
+	Vendor string
+	// Comments are written to the OpusTags header, such as TITLE or DATE.
+	Comments map[string]string
+	// Serial is the serial number of the Ogg bitstream, random when zero.
+	Serial uint32
+}
+
+// OggOpusWriter records Opus packets as an Ogg Opus file, RFC 7845. It is an
+// io.Writer taking one packet per Write, which the output of Multiplexer.Read
+// or an encoding OpusStream connected to it is, and a MixSink for the mixing
+// loop.
+type OggOpusWriter struct {
+	mu     sync.Mutex
+	pages  oggPageWriter
+	closer io.Closer
+	closed bool
+
+	// lacing and body hold the packets of the page not written yet.
+	lacing      []byte
+	body        []byte
+	pageSamples int
+	granule     int64
+}
+
+// NewOggOpusFileWriter creates the file at path and records to it. The file
+// is closed by Close.
+func NewOggOpusFileWriter(path string, opts ...OggOpusWriterOptions) (*OggOpusWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	ow, err := NewOggOpusWriter(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ow.closer = f
+	return ow, nil
+}
+
+// NewOggOpusWriter writes the OpusHead and OpusTags headers to w and returns
+// a writer recording the packets that follow.
+func NewOggOpusWriter(w io.Writer, opts ...OggOpusWriterOptions) (*OggOpusWriter, error) {
+	var o OggOpusWriterOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Channels == 0 {
+		o.Channels = 1
+	}
+	if o.Channels < 0 || o.Channels > 2 {
+		return nil, fmt.Errorf("unsupported channel count: %v", o.Channels)
+	}
+	if o.PreSkip == 0 {
+		o.PreSkip = opusDefaultPreSkip
+	}
+	if o.InputSampleRate == 0 {
+		o.InputSampleRate = opusGranuleRate
+	}
+	if o.Vendor == "" {
+		o.Vendor = "avmuxer"
+	}
+	if o.Serial == 0 {
+		o.Serial = rand.Uint32()
+	}
+
+	ow := &OggOpusWriter{pages: oggPageWriter{w: w, serial: o.Serial}}
+	head := OpusHead{
+		Version:         1,
+		Channels:        o.Channels,
+		PreSkip:         o.PreSkip,
+		InputSampleRate: o.InputSampleRate,
+		OutputGain:      o.OutputGain,
+	}
+	if err := ow.pages.writePacket(oggFlagBOS, 0, head.marshal()); err != nil {
+		return nil, err
+	}
+	tags := OpusTags{Vendor: o.Vendor, Comments: o.Comments}
+	if err := ow.pages.writePacket(0, 0, tags.marshal()); err != nil {
+		return nil, err
+	}
+	return ow, nil
+}
+
+// Write records an Opus packet, whose duration is read from its TOC byte.
+func (ow *OggOpusWriter) Write(pkt []byte) (int, error) {
+	samples, err := opusPacketSamples(pkt)
+	if err != nil {
+		return 0, err
+	}
+	if err := ow.WritePacket(pkt, samples); err != nil {
+		return 0, err
+	}
+	return len(pkt), nil
+}
+
+// WriteFrame records the encoded frame of the mixing loop. Frames that were
+// not encoded are skipped.
+func (ow *OggOpusWriter) WriteFrame(frame MixFrame) error {
+	if len(frame.Encoded) == 0 {
+		return nil
+	}
+	return ow.WritePacket(frame.Encoded, int(frame.Duration*opusGranuleRate/time.Second))
+}
+
+// WritePacket records an Opus packet of samples at 48 kHz. Packets are
+// gathered in pages that are written out once they hold a second of audio.
+func (ow *OggOpusWriter) WritePacket(pkt []byte, samples int) error {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	if ow.closed {
+		return errors.New("ogg opus writer is closed")
+	}
+	if len(pkt) == 0 || samples <= 0 {
+		return ErrInvalidOpusPacket
+	}
+	segments := len(pkt)/255 + 1
+	if len(ow.lacing)+segments > oggMaxSegments || ow.pageSamples >= oggOpusPageSamples {
+		if err := ow.flush(0); err != nil {
+			return err
+		}
+	}
+	ow.lacing = oggLacing(ow.lacing, len(pkt))
+	ow.body = append(ow.body, pkt...)
+	ow.pageSamples += samples
+	ow.granule += int64(samples)
+	return nil
+}
+
+// Flush writes out the packets recorded since the last page.
+func (ow *OggOpusWriter) Flush() error {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	if ow.closed || len(ow.lacing) == 0 {
+		return nil
+	}
+	return ow.flush(0)
+}
+
+// flush writes the pending packets as a page. Must be called with the lock
+// held.
+func (ow *OggOpusWriter) flush(flags byte) error {
+	err := ow.pages.writePage(flags, ow.granule, ow.lacing, ow.body)
+	ow.lacing, ow.body = ow.lacing[:0], ow.body[:0]
+	ow.pageSamples = 0
+	return err
+}
+
+// Duration returns the duration of the audio recorded so far, pre-skip
+// included.
+func (ow *OggOpusWriter) Duration() time.Duration {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	return time.Duration(ow.granule) * time.Second / opusGranuleRate
+}
+
+// Close writes the last page, which ends the bitstream, and closes the file
+// of a writer created by NewOggOpusFileWriter.
+func (ow *OggOpusWriter) Close() error {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	if ow.closed {
+		return nil
+	}
+	ow.closed = true
+	err := ow.flush(oggFlagEOS)
+	if ow.closer != nil {
+		if cErr := ow.closer.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package avmuxer
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+	"github.com/stretchr/testify/assert"
+)
+
+// tonePackets encodes a 440 Hz tone as Opus packets of 20ms
+func tonePackets(t *testing.T, channels, count int) [][]byte {
+	enc, err := NewOpusEncoder(48000, channels, 960)
+	assert.NoError(t, err)
+	tone := sineWave(48000, 440, 960*count, 8000)
+	pkts := make([][]byte, count)
+	for i := range pkts {
+		pcm := make([]int16, 0, 960*channels)
+		for _, v := range tone[i*960 : (i+1)*960] {
+			for c := 0; c < channels; c++ {
+				pcm = append(pcm, v)
+			}
+		}
+		buf := make([]byte, 4000)
+		n, err := enc.Encode(pcm, buf)
+		assert.NoError(t, err)
+		pkts[i] = buf[:n]
+	}
+	return pkts
+}
+
+// readPages returns the granule position and flags of the pages of an Ogg
+// bitstream
+func readPages(t *testing.T, data []byte) (granules []int64, flags []byte) {
+	pages := newOggPageReader(bytes.NewReader(data))
+	for {
+		page, err := pages.next(false)
+		if err == io.EOF {
+			return granules, flags
+		}
+		assert.NoError(t, err)
+		granules = append(granules, page.granule)
+		flags = append(flags, page.flags)
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	for _, tc := range []struct {
+		pkt     []byte
+		samples int
+	}{
+		{[]byte{1 << 3}, 960},
+		{[]byte{3 << 3}, 2880},
+		{[]byte{16 << 3}, 120},
+		{[]byte{31<<3 | 1}, 1920},
+		{[]byte{31<<3 | 3, 6}, 5760},
+	} {
+		samples, err := opusPacketSamples(tc.pkt)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.samples, samples)
+	}
+	for _, pkt := range [][]byte{nil, {31<<3 | 3}, {31<<3 | 3, 0}, {3<<3 | 3, 3}} {
+		_, err := opusPacketSamples(pkt)
+		assert.ErrorIs(t, err, ErrInvalidOpusPacket)
+	}
+}
+
+func TestOggOpusWriter(t *testing.T) {
+	_, err := NewOggOpusWriter(io.Discard, OggOpusWriterOptions{Channels: 3})
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	w, err := NewOggOpusWriter(&buf, OggOpusWriterOptions{
+		Channels:        2,
+		InputSampleRate: 16000,
+		Comments:        map[string]string{"title": "conference"},
+	})
+	assert.NoError(t, err)
+	for _, pkt := range tonePackets(t, 2, 120) {
+		assert.NoError(t, w.WritePacket(pkt, 960))
+	}
+	assert.Equal(t, 2400*time.Millisecond, w.Duration())
+	assert.NoError(t, w.Close())
+	assert.NoError(t, w.Close())
+	assert.Error(t, w.WritePacket([]byte{1 << 3}, 960))
+
+	granules, flags := readPages(t, buf.Bytes())
+	assert.Equal(t, int64(115200), granules[len(granules)-1])
+	assert.Equal(t, byte(oggFlagBOS), flags[0])
+	assert.Equal(t, byte(oggFlagEOS), flags[len(flags)-1])
+
+	s, err := NewOggOpusStream(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, OpusHead{Version: 1, Channels: 2, PreSkip: 312, InputSampleRate: 16000}, s.Head())
+	assert.Equal(t, OpusTags{Vendor: "avmuxer", Comments: map[string]string{"TITLE": "conference"}}, s.Tags())
+	pcm := readAll(t, s)
+	assert.Len(t, pcm, (115200-312)*2)
+	left := make([]int16, 4800)
+	for i := range left {
+		left[i] = pcm[(9600+i)*2]
+	}
+	amplitude, _ := toneFit(left, 48000, 440)
+	assert.InDelta(t, 8000, amplitude, 800)
+
+	// other readers accept the file too
+	ogg, head, err := oggreader.NewWith(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), head.Channels)
+	assert.Equal(t, uint16(312), head.PreSkip)
+	for {
+		_, _, err := ogg.ParseNextPage()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+}
+
+func TestOggOpusWriter_Write(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewOggOpusWriter(&buf, OggOpusWriterOptions{
+		Comments: map[string]string{"COMMENT": strings.Repeat("a", 70000)},
+	})
+	assert.NoError(t, err)
+	_, err = w.Write([]byte{0xff})
+	assert.ErrorIs(t, err, ErrInvalidOpusPacket)
+	n, err := w.Write([]byte{1 << 3, 1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	_, err = w.Write([]byte{31<<3 | 3, 3, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 80*time.Millisecond, w.Duration())
+	assert.NoError(t, w.Flush())
+	// pages are written once they hold a second of audio
+	for i := 0; i < 120; i++ {
+		assert.NoError(t, w.WritePacket([]byte{1 << 3, byte(i)}, 960))
+	}
+	assert.NoError(t, w.Close())
+
+	// the comment header spans two pages
+	granules, flags := readPages(t, buf.Bytes())
+	assert.Equal(t, []int64{0, oggNoGranule, 0, 3840, 3840 + 48000, 3840 + 96000, 3840 + 115200}, granules)
+	assert.Equal(t, []byte{oggFlagBOS, 0, oggFlagContinued, 0, 0, 0, oggFlagEOS}, flags)
+	s, err := NewOggOpusStream(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Len(t, s.Tags().Comments["COMMENT"], 70000)
+}
+
+func TestMultiplexer_OggOpusRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mix.ogg")
+	w, err := NewOggOpusFileWriter(path, OggOpusWriterOptions{InputSampleRate: 48000})
+	assert.NoError(t, err)
+
+	mux := NewMultiplexer(MixerOptions{SampleRate: 48000, Channels: 1})
+	enc, err := NewOpusEncoder(48000, 1, 960)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddEncoder("opus", enc))
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 4000}))
+	assert.NoError(t, mux.AddSink("recording", w))
+	for i := 0; i < 5; i++ {
+		mux.produceFrame(20*time.Millisecond, uint64(i))
+	}
+	assert.NoError(t, w.Close())
+
+	s, err := NewOggOpusFileStream(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Len(t, readAll(t, s), 5*960-312)
+}
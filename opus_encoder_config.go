@@ -0,0 +1,204 @@
+package avmuxer
+
+import "fmt"
+
+// OpusApplication selects the libopus encoder mode.
+type OpusApplication int
+
+const (
+	// OpusApplicationAudio favours fidelity for music and mixed content.
+	OpusApplicationAudio OpusApplication = iota
+	// OpusApplicationVoIP favours speech intelligibility.
+	OpusApplicationVoIP
+	// OpusApplicationLowDelay disables the speech optimised mode to get the
+	// lowest possible latency.
+	OpusApplicationLowDelay
+)
+
+// OpusBandwidth limits the audio bandwidth the encoder may use.
+type OpusBandwidth int
+
+const (
+	// OpusBandwidthFull leaves the bandwidth unrestricted (20 kHz passband).
+	OpusBandwidthFull OpusBandwidth = iota
+	OpusBandwidthNarrow
+	OpusBandwidthMedium
+	OpusBandwidthWide
+	OpusBandwidthSuperWide
+)
+
+// OpusEncoderConfig configures an OpusEncoder. The zero value is the libopus
+// defaults for the audio application.
+type OpusEncoderConfig struct {
+	Application OpusApplication
+	// Bitrate in bits per second, 0 lets the encoder pick one.
+	Bitrate int
+	// CBR turns variable bitrate off, so every packet is encoded at Bitrate.
+	CBR bool
+	// Complexity between 1 and 10, 0 keeps the libopus default.
+	Complexity   int
+	MaxBandwidth OpusBandwidth
+	// InBandFEC adds redundancy a decoder can use to rebuild a lost packet
+	// from the one after it. It is only used while PacketLossPercent is set.
+	InBandFEC         bool
+	PacketLossPercent int
+	// DTX stops sending full packets during silence.
+	DTX bool
+}
+
+// OpusEncoderControls is implemented by OpusEncoder and encoding Opus streams
+// so their settings can be changed mid-call, for instance by a congestion
+// controller.
+type OpusEncoderControls interface {
+	SetBitrate(bitrate int) error
+	SetCBR(cbr bool) error
+	SetComplexity(complexity int) error
+	SetMaxBandwidth(bandwidth OpusBandwidth) error
+	SetInBandFEC(fec bool) error
+	SetPacketLossPercent(percent int) error
+	SetDTX(dtx bool) error
+}
+
+// apply configures oe, which must not be in use yet.
+func (cfg OpusEncoderConfig) apply(oe *OpusEncoder) error {
+	if err := oe.setBitrate(cfg.Bitrate); err != nil {
+		return err
+	}
+	if err := oe.oe.setVBR(!cfg.CBR); err != nil {
+		return err
+	}
+	if cfg.Complexity != 0 {
+		if err := oe.setComplexity(cfg.Complexity); err != nil {
+			return err
+		}
+	}
+	if err := oe.setMaxBandwidth(cfg.MaxBandwidth); err != nil {
+		return err
+	}
+	if err := oe.oe.setInBandFEC(cfg.InBandFEC); err != nil {
+		return err
+	}
+	if err := oe.setPacketLossPercent(cfg.PacketLossPercent); err != nil {
+		return err
+	}
+	return oe.oe.setDTX(cfg.DTX)
+}
+
+// SetBitrate changes the target bitrate in bits per second, 0 lets the
+// encoder pick one.
+func (oe *OpusEncoder) SetBitrate(bitrate int) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.setBitrate(bitrate)
+}
+
+// Bitrate returns the current target bitrate in bits per second.
+func (oe *OpusEncoder) Bitrate() (int, error) {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.oe.bitrate()
+}
+
+func (oe *OpusEncoder) setBitrate(bitrate int) error {
+	if bitrate != 0 && (bitrate < 500 || bitrate > 512000) {
+		return fmt.Errorf("opus bitrate out of range: %v", bitrate)
+	}
+	return oe.oe.setBitrate(bitrate)
+}
+
+// SetCBR switches between constant and variable bitrate.
+func (oe *OpusEncoder) SetCBR(cbr bool) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.oe.setVBR(!cbr)
+}
+
+// CBR reports whether the encoder uses constant bitrate.
+func (oe *OpusEncoder) CBR() (bool, error) {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	vbr, err := oe.oe.vbr()
+	return !vbr, err
+}
+
+// SetComplexity changes the computational complexity, between 1 and 10.
+func (oe *OpusEncoder) SetComplexity(complexity int) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.setComplexity(complexity)
+}
+
+func (oe *OpusEncoder) setComplexity(complexity int) error {
+	if complexity < 1 || complexity > 10 {
+		return fmt.Errorf("opus complexity out of range: %v", complexity)
+	}
+	return oe.oe.setComplexity(complexity)
+}
+
+// SetMaxBandwidth limits the audio bandwidth the encoder may use.
+func (oe *OpusEncoder) SetMaxBandwidth(bandwidth OpusBandwidth) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.setMaxBandwidth(bandwidth)
+}
+
+func (oe *OpusEncoder) setMaxBandwidth(bandwidth OpusBandwidth) error {
+	return oe.oe.setMaxBandwidth(bandwidth)
+}
+
+// SetInBandFEC turns in-band forward error correction on or off.
+func (oe *OpusEncoder) SetInBandFEC(fec bool) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.oe.setInBandFEC(fec)
+}
+
+// SetPacketLossPercent tells the encoder the expected packet loss, between 0
+// and 100, which sizes the in-band FEC data.
+func (oe *OpusEncoder) SetPacketLossPercent(percent int) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.setPacketLossPercent(percent)
+}
+
+func (oe *OpusEncoder) setPacketLossPercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("opus packet loss percent out of range: %v", percent)
+	}
+	return oe.oe.setPacketLossPercent(percent)
+}
+
+// SetDTX turns discontinuous transmission on or off.
+func (oe *OpusEncoder) SetDTX(dtx bool) error {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	return oe.oe.setDTX(dtx)
+}
+
+func (oes *opusEncodingStream) SetBitrate(bitrate int) error {
+	return oes.encoder.SetBitrate(bitrate)
+}
+
+func (oes *opusEncodingStream) SetCBR(cbr bool) error {
+	return oes.encoder.SetCBR(cbr)
+}
+
+func (oes *opusEncodingStream) SetComplexity(complexity int) error {
+	return oes.encoder.SetComplexity(complexity)
+}
+
+func (oes *opusEncodingStream) SetMaxBandwidth(bandwidth OpusBandwidth) error {
+	return oes.encoder.SetMaxBandwidth(bandwidth)
+}
+
+func (oes *opusEncodingStream) SetInBandFEC(fec bool) error {
+	return oes.encoder.SetInBandFEC(fec)
+}
+
+func (oes *opusEncodingStream) SetPacketLossPercent(percent int) error {
+	return oes.encoder.SetPacketLossPercent(percent)
+}
+
+func (oes *opusEncodingStream) SetDTX(dtx bool) error {
+	return oes.encoder.SetDTX(dtx)
+}
@@ -0,0 +1,84 @@
+package avmuxer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOpusEncoder_Config(t *testing.T) {
+	enc, err := NewOpusEncoder(48000, 2, 960, OpusEncoderConfig{
+		Application:       OpusApplicationVoIP,
+		Bitrate:           32000,
+		CBR:               true,
+		Complexity:        5,
+		MaxBandwidth:      OpusBandwidthWide,
+		InBandFEC:         true,
+		PacketLossPercent: 10,
+		DTX:               true,
+	})
+	assert.NoError(t, err)
+
+	oe := enc.(*OpusEncoder)
+	bitrate, err := oe.Bitrate()
+	assert.NoError(t, err)
+	assert.Equal(t, 32000, bitrate)
+
+	cbr, err := oe.CBR()
+	assert.NoError(t, err)
+	assert.True(t, cbr)
+
+	complexity, err := oe.oe.complexity()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, complexity)
+
+	fec, err := oe.oe.inBandFEC()
+	assert.NoError(t, err)
+	assert.True(t, fec)
+
+	loss, err := oe.oe.packetLossPercent()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, loss)
+
+	dtx, err := oe.oe.dtx()
+	assert.NoError(t, err)
+	assert.True(t, dtx)
+}
+
+func TestNewOpusEncoder_InvalidConfig(t *testing.T) {
+	for _, cfg := range []OpusEncoderConfig{
+		{Application: OpusApplication(42)},
+		{MaxBandwidth: OpusBandwidth(42)},
+		{Bitrate: 100},
+		{Complexity: 11},
+		{PacketLossPercent: 101},
+	} {
+		_, err := NewOpusEncoder(48000, 2, 960, cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestEncodingStream_Controls(t *testing.T) {
+	stream, err := NewEncodingOpusStream("stream1", 48000, 20, 2, OpusEncoderConfig{Bitrate: 64000})
+	assert.NoError(t, err)
+
+	controls, ok := stream.(OpusEncoderControls)
+	assert.True(t, ok)
+	assert.NoError(t, controls.SetBitrate(24000))
+	assert.Error(t, controls.SetBitrate(1))
+	assert.NoError(t, controls.SetCBR(true))
+	assert.NoError(t, controls.SetComplexity(3))
+	assert.Error(t, controls.SetComplexity(0))
+	assert.NoError(t, controls.SetMaxBandwidth(OpusBandwidthNarrow))
+	assert.NoError(t, controls.SetInBandFEC(true))
+	assert.NoError(t, controls.SetPacketLossPercent(20))
+	assert.Error(t, controls.SetPacketLossPercent(-1))
+	assert.NoError(t, controls.SetDTX(true))
+
+	bitrate, err := stream.(*opusEncodingStream).encoder.Bitrate()
+	assert.NoError(t, err)
+	assert.Equal(t, 24000, bitrate)
+	cbr, err := stream.(*opusEncodingStream).encoder.CBR()
+	assert.NoError(t, err)
+	assert.True(t, cbr)
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // OpusStream interface defines the methods for both encoding and decoding Opus streams
@@ -21,6 +24,21 @@ type OpusStream interface {
 	ID() string
 }
 
+// PacketWriter is implemented by streams that take payloads together with
+// their RTP sequence number and timestamp.
+type PacketWriter interface {
+	WritePacket(seq uint16, timestamp uint32, payload []byte) (int, error)
+}
+
+// JitterBufferedStream is an OpusStream that reorders and paces its input with
+// a JitterBuffer before decoding.
+type JitterBufferedStream interface {
+	OpusStream
+	PacketWriter
+	JitterStats() JitterStats
+	DecoderStats() DecoderStats
+}
+
 // opusEncodingStream implements OpusStream for encoding
 type opusEncodingStream struct {
 	id               string
@@ -45,6 +63,41 @@ type opusDecodingStream struct {
 	sink io.Writer
 
 	decoder *OpusDecoder
+
+	// jitter, when set, holds packets until ReadPCM asks for audio.
+	jitter  *JitterBuffer
+	nextSeq uint16
+	nextTs  uint32
+
+	// mu serialises use of the decoder between the writer, which decodes
+	// packets and conceals sequence gaps, and the reader, which conceals
+	// frames missing at mix time.
+	mu         sync.Mutex
+	lastSeq    uint16
+	haveSeq    bool
+	decoded    bool
+	concealRun int
+	stats      decoderCounters
+}
+
+// maxConcealedFrames is the number of consecutive frames synthesized with
+// loss concealment before a stream that stopped receiving goes silent.
+const maxConcealedFrames = 5
+
+// DecoderStats counts what a decoding stream produced.
+type DecoderStats struct {
+	Decoded uint64
+	// Concealed counts frames synthesized with packet loss concealment.
+	Concealed uint64
+	// FECRecovered counts lost frames rebuilt from the in-band FEC data of
+	// the packet following them.
+	FECRecovered uint64
+}
+
+type decoderCounters struct {
+	decoded      atomic.Uint64
+	concealed    atomic.Uint64
+	fecRecovered atomic.Uint64
 }
 
 // NewDecodingOpusStream creates a new OpusStream for decoding
@@ -52,8 +105,9 @@ func NewDecodingOpusStream(id string, sampleRate, sampleDuration, channel int) (
 	// Calculate sample size based on duration and rate
 	sampleSize := sampleDuration * sampleRate / 1000
 
-	// Create a new OpusDecoder
-	dec, err := NewOpusDecoder(sampleRate, channel, sampleSize)
+	// Create a new OpusDecoder, with room for the frames concealed ahead
+	// of the decoded one
+	dec, err := NewOpusDecoder(sampleRate, channel, sampleSize*(maxConcealedFrames+1))
 	if err != nil {
 		return nil, err
 	}
@@ -70,12 +124,48 @@ func NewDecodingOpusStream(id string, sampleRate, sampleDuration, channel int) (
 	}, err
 }
 
-// NewEncodingOpusStream creates a new OpusStream for encoding
-func NewEncodingOpusStream(id string, sampleRate, sampleDuration, channel int) (OpusStream, error) {
+// NewJitterBufferedOpusStream creates a decoding OpusStream with a jitter
+// buffer in front of the decoder. Packets are decoded when ReadPCM needs
+// them rather than on arrival.
+func NewJitterBufferedOpusStream(id string, sampleRate, sampleDuration, channel int, opts JitterBufferOptions) (JitterBufferedStream, error) {
+	sampleSize := sampleDuration * sampleRate / 1000
+
+	// keep room for a few frames so a packet can be decoded while part of
+	// the previous one is still unread
+	dec, err := NewOpusDecoder(sampleRate, channel, sampleSize*3)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ClockRate == 0 {
+		opts.ClockRate = sampleRate
+	}
+	if opts.FrameDuration == 0 {
+		opts.FrameDuration = time.Duration(sampleDuration) * time.Millisecond
+	}
+	jitter, err := NewJitterBuffer(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &opusDecodingStream{
+		id:               id,
+		sampleRate:       sampleRate,
+		sampleDurationMs: sampleDuration,
+		channel:          channel,
+		size:             sampleSize,
+
+		decoder: dec.(*OpusDecoder),
+		jitter:  jitter,
+	}, nil
+}
+
+// NewEncodingOpusStream creates a new OpusStream for encoding, optionally
+// configured by cfg. The returned stream also implements OpusEncoderControls.
+func NewEncodingOpusStream(id string, sampleRate, sampleDuration, channel int, cfg ...OpusEncoderConfig) (OpusStream, error) {
 	// Similar to NewDecodingOpusStream, but for encoding
 	// ... existing code ...
 	sampleSize := sampleDuration * sampleRate / 1000
-	enc, err := NewOpusEncoder(sampleRate, channel, sampleSize)
+	enc, err := NewOpusEncoder(sampleRate, channel, sampleSize, cfg...)
 	if err != nil {
 		return nil, err
 	}
@@ -102,6 +192,9 @@ func (ods *opusDecodingStream) SampleRate() int {
 func (ods *opusDecodingStream) SampleDurationMs() int {
 	return ods.sampleDurationMs
 }
+func (ods *opusDecodingStream) Format() Format {
+	return pcmFormat(ods.sampleRate, ods.channel, time.Duration(ods.sampleDurationMs)*time.Millisecond)
+}
 func (ods *opusDecodingStream) ID() string {
 	return ods.id
 }
@@ -110,27 +203,166 @@ func (ods *opusDecodingStream) Decode(src []byte, dst []int16) (int, error) {
 	return ods.decoder.Decode(src, dst)
 }
 
-// Write decodes Opus data and writes PCM to the sink
+// Write decodes Opus data and writes PCM to the sink. A jitter buffered
+// stream queues it as the packet following the previous one instead.
 func (ods *opusDecodingStream) Write(data []byte) (int, error) {
-	// Decode Opus data to PCM
+	if ods.jitter != nil {
+		return ods.WritePacket(ods.nextSeq, ods.nextTs, data)
+	}
+	return ods.decode(data)
+}
+
+// WritePacket queues an RTP payload in the jitter buffer. Streams without one
+// decode it straight away and drop packets that arrive out of order; when
+// packets went missing since the previous sequence number their frames are
+// first concealed, the one just before this packet from its FEC data. A
+// packet whose frame was already concealed at mix time only updates the
+// decoder, its audio is dropped so late packets don't add up to latency.
+func (ods *opusDecodingStream) WritePacket(seq uint16, timestamp uint32, payload []byte) (int, error) {
+	if ods.jitter == nil {
+		ods.mu.Lock()
+		defer ods.mu.Unlock()
+		if ods.haveSeq {
+			gap := int16(seq - ods.lastSeq - 1)
+			if gap < 0 {
+				return len(payload), nil
+			}
+			// the frames concealed at mix time since the last decoded
+			// packet already stand in for the first lost ones, and for
+			// this one when there are more of them
+			missing := int(gap) - ods.concealRun
+			if missing < 0 {
+				ahead := -missing - 1
+				ods.lastSeq = seq
+				if _, err := ods.decodeFrame(payload); err != nil {
+					return 0, err
+				}
+				ods.concealRun = ahead
+				return len(payload), nil
+			}
+			if missing > 0 && missing <= maxConcealedFrames {
+				for i := 1; i < missing; i++ {
+					ods.conceal(nil)
+				}
+				ods.conceal(payload)
+			}
+		}
+		ods.lastSeq, ods.haveSeq = seq, true
+		return ods.decodeLocked(payload)
+	}
+	ods.jitter.Push(seq, timestamp, payload)
+	ods.nextSeq = seq + 1
+	ods.nextTs = timestamp + uint32(ods.size)
+	return len(payload), nil
+}
+
+// DecoderStats returns counters of decoded and concealed frames.
+func (ods *opusDecodingStream) DecoderStats() DecoderStats {
+	return DecoderStats{
+		Decoded:      ods.stats.decoded.Load(),
+		Concealed:    ods.stats.concealed.Load(),
+		FECRecovered: ods.stats.fecRecovered.Load(),
+	}
+}
+
+// JitterStats returns the statistics of the jitter buffer, zero when the
+// stream has none.
+func (ods *opusDecodingStream) JitterStats() JitterStats {
+	if ods.jitter == nil {
+		return JitterStats{}
+	}
+	return ods.jitter.Stats()
+}
+
+// fill decodes packets from the jitter buffer until n samples are buffered or
+// the jitter buffer has nothing more to play. Lost packets are concealed,
+// using the FEC data of the following packet when it has already arrived.
+// Must be called with the lock held.
+func (ods *opusDecodingStream) fill(n int) {
+	frame := ods.size * ods.channel
+	for pops := 0; ods.decoder.buffer.Len() < n && pops <= n/frame; pops++ {
+		payload, status := ods.jitter.Pop()
+		if status == jitterEmpty {
+			return
+		}
+		if status == jitterLost {
+			ods.conceal(ods.jitter.peek())
+			continue
+		}
+		if _, err := ods.decodeLocked(payload); err != nil {
+			log.Printf("failed to decode packet: %v", err)
+		}
+	}
+}
+
+func (ods *opusDecodingStream) decode(data []byte) (int, error) {
+	ods.mu.Lock()
+	defer ods.mu.Unlock()
+	return ods.decodeLocked(data)
+}
+
+func (ods *opusDecodingStream) decodeLocked(data []byte) (int, error) {
+	pcm, err := ods.decodeFrame(data)
+	if err != nil {
+		return 0, err
+	}
+	return ods.push(pcm)
+}
+
+// decodeFrame decodes Opus data to PCM. Must be called with the lock held.
+func (ods *opusDecodingStream) decodeFrame(data []byte) ([]int16, error) {
 	pcm := make([]int16, ods.size*ods.channel)
 	n, err := ods.Decode(data, pcm)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	log.Printf("samples decoded: %v, os.size: %v, data size: %v\n", n, ods.size, len(data))
+	ods.decoded = true
+	ods.concealRun = 0
+	ods.stats.decoded.Add(1)
+	return pcm[:n*ods.channel], nil
+}
 
+// conceal synthesizes one frame in place of a lost packet, from the in-band
+// FEC data of next when it carries some and with packet loss concealment
+// otherwise. Must be called with the lock held.
+func (ods *opusDecodingStream) conceal(next []byte) {
+	pcm := make([]int16, ods.size*ods.channel)
+	var err error
+	if opusPacketHasFEC(next) {
+		err = ods.decoder.DecodeFEC(next, pcm)
+		if err == nil {
+			ods.stats.fecRecovered.Add(1)
+		}
+	} else {
+		err = ods.decoder.DecodePLC(pcm)
+		if err == nil {
+			ods.stats.concealed.Add(1)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to conceal lost packet: %v", err)
+		return
+	}
+	ods.concealRun++
+	if _, err = ods.push(pcm); err != nil {
+		log.Printf("failed to write concealed frame: %v", err)
+	}
+}
+
+// push hands decoded PCM to the sink and the read buffer.
+func (ods *opusDecodingStream) push(pcm []int16) (int, error) {
 	// Write decoded PCM to sink if available
 	if ods.sink != nil {
-		_, err := ods.sink.Write(Int16ToByteSlice(pcm[:n*ods.channel]))
+		_, err := ods.sink.Write(Int16ToByteSlice(pcm))
 		if err != nil {
 			return 0, err
 		}
 	}
 
 	// Write PCM data to buffer
-	return ods.decoder.buffer.Write(pcm[:n*ods.channel])
+	return ods.decoder.buffer.Write(pcm)
 }
 
 // ReadPCM reads raw PCM data from the decoding buffer
@@ -138,6 +370,18 @@ func (ods *opusDecodingStream) ReadPCM(dst []int16) (int, error) {
 	if ods.decoder == nil {
 		return 0, errors.New("stream is not decoding supported")
 	}
+	ods.mu.Lock()
+	if ods.jitter != nil {
+		ods.fill(len(dst))
+	}
+	// a frame is missing at mix time, keep the stream going with loss
+	// concealment for a little while. Only streams that know the sequence
+	// of their packets can tell the late one for a concealed frame apart.
+	sequenced := ods.jitter != nil || ods.haveSeq
+	if ods.decoder.buffer.Len() == 0 && sequenced && ods.decoded && ods.concealRun < maxConcealedFrames {
+		ods.conceal(nil)
+	}
+	ods.mu.Unlock()
 	return ods.decoder.buffer.Read(dst)
 }
 
@@ -147,7 +391,7 @@ func (ods *opusDecodingStream) Read(dst []byte) (int, error) {
 		return 0, errors.New("stream is not decoding supported")
 	}
 	int16Buf := make([]int16, len(dst)/2)
-	n, err := ods.decoder.buffer.Read(int16Buf)
+	n, err := ods.ReadPCM(int16Buf)
 	if err != nil {
 		return n, err
 	}
@@ -187,6 +431,9 @@ func (oes *opusEncodingStream) SampleRate() int {
 func (oes *opusEncodingStream) SampleDurationMs() int {
 	return oes.sampleDurationMs
 }
+func (oes *opusEncodingStream) Format() Format {
+	return pcmFormat(oes.sampleRate, oes.channel, time.Duration(oes.sampleDurationMs)*time.Millisecond)
+}
 
 func (oes *opusEncodingStream) ID() string {
 	return oes.id
@@ -248,3 +495,111 @@ func (oes *opusEncodingStream) Connect(writer io.Writer) error {
 	oes.sink = writer
 	return nil
 }
+
+// opusPacketHasFEC reports whether an Opus packet carries in-band FEC data
+// for the packet before it. Only packets with SILK frames can; the flag
+// follows the voice activity flags of the SILK frames in the first bits of the
+// first Opus frame, RFC 6716 section 4.2.3.
+func opusPacketHasFEC(pkt []byte) bool {
+	if len(pkt) == 0 || pkt[0]>>3 >= 16 {
+		return false
+	}
+	frame, err := opusFirstFrame(pkt)
+	if err != nil || len(frame) == 0 {
+		return false
+	}
+	// 40 and 60ms frames hold several 20ms SILK frames
+	silkFrames := max(1, opusFrameSamples[pkt[0]>>3]/960)
+	lbrr := frame[0] >> (7 - silkFrames) & 1
+	if pkt[0]&0x4 != 0 {
+		// the flags of the side channel follow the ones of the mid channel
+		lbrr |= frame[0] >> (6 - 2*silkFrames) & 1
+	}
+	return lbrr == 1
+}
+
+// opusFirstFrame returns the first frame of an Opus packet, RFC 6716 section
+// 3.2.
+func opusFirstFrame(pkt []byte) ([]byte, error) {
+	data := pkt[1:]
+	switch pkt[0] & 0x3 {
+	case 0:
+		return data, nil
+	case 1:
+		if len(data)%2 != 0 {
+			return nil, ErrInvalidOpusPacket
+		}
+		return data[:len(data)/2], nil
+	case 2:
+		size, n := opusFrameLength(data)
+		if n == 0 || size > len(data)-n {
+			return nil, ErrInvalidOpusPacket
+		}
+		return data[n : n+size], nil
+	}
+
+	if len(data) == 0 || data[0]&0x3f == 0 {
+		return nil, ErrInvalidOpusPacket
+	}
+	frames, vbr, padded := int(data[0]&0x3f), data[0]&0x80 != 0, data[0]&0x40 != 0
+	data = data[1:]
+	if padded {
+		padding := 0
+		for {
+			if len(data) == 0 {
+				return nil, ErrInvalidOpusPacket
+			}
+			p := int(data[0])
+			data = data[1:]
+			if p < 255 {
+				padding += p
+				break
+			}
+			padding += 254
+		}
+		if padding > len(data) {
+			return nil, ErrInvalidOpusPacket
+		}
+		data = data[:len(data)-padding]
+	}
+	if !vbr {
+		if len(data)%frames != 0 {
+			return nil, ErrInvalidOpusPacket
+		}
+		return data[:len(data)/frames], nil
+	}
+	// the lengths of all frames but the last one come first
+	size, offset := -1, 0
+	for i := 0; i < frames-1; i++ {
+		length, n := opusFrameLength(data[offset:])
+		if n == 0 {
+			return nil, ErrInvalidOpusPacket
+		}
+		if i == 0 {
+			size = length
+		}
+		offset += n
+	}
+	if size < 0 {
+		size = len(data) - offset
+	}
+	if size > len(data)-offset {
+		return nil, ErrInvalidOpusPacket
+	}
+	return data[offset : offset+size], nil
+}
+
+// opusFrameLength decodes the one or two byte length of a frame, returning the
+// number of bytes it takes or 0 when b is too short.
+func opusFrameLength(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	if b[0] < 252 {
+		return int(b[0]), 1
+	}
+	if len(b) < 2 {
+		return 0, 0
+	}
+	return 4*int(b[1]) + int(b[0]), 2
+}
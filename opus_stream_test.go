@@ -2,6 +2,7 @@ package avmuxer
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -71,3 +72,174 @@ func TestEncodingStream_Read(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, n > 0)
 }
+
+func encodeTestPackets(t *testing.T, count int) [][]byte {
+	enc, err := NewOpusEncoder(48000, 1, 960)
+	assert.NoError(t, err)
+	packets := make([][]byte, count)
+	for i := range packets {
+		packets[i] = make([]byte, 4000)
+		n, err := enc.Encode(generateTestPCM(960, 1), packets[i])
+		assert.NoError(t, err)
+		packets[i] = packets[i][:n]
+	}
+	return packets
+}
+
+// fecTestPacket is a 20ms SILK packet with the LBRR flag set, so it carries
+// the FEC data of the packet before it.
+var fecTestPacket = []byte{1 << 3, 0x40, 0, 0, 0}
+
+func TestDecodingStream_ConcealsSequenceGap(t *testing.T) {
+	stream, err := NewDecodingOpusStream("stream1", 48000, 20, 1)
+	assert.NoError(t, err)
+	ps := stream.(PacketWriter)
+	packets := encodeTestPackets(t, 3)
+	pcm := make([]int16, 960)
+	readFrames := func(count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			n, err := stream.ReadPCM(pcm)
+			assert.NoError(t, err)
+			assert.Equal(t, 960, n)
+		}
+		assert.Equal(t, 0, stream.(*opusDecodingStream).decoder.buffer.Len())
+	}
+
+	_, err = ps.WritePacket(1, 960, packets[0])
+	assert.NoError(t, err)
+	readFrames(1)
+
+	// packets 2 and 3 are lost, the frame of 2 is concealed and the one of
+	// 3 recovered from the FEC data of 4 before it is decoded
+	_, err = ps.WritePacket(4, 4*960, fecTestPacket)
+	assert.NoError(t, err)
+	stats := stream.(JitterBufferedStream).DecoderStats()
+	assert.Equal(t, uint64(1), stats.Concealed)
+	assert.Equal(t, uint64(1), stats.FECRecovered)
+	readFrames(3)
+
+	// packets 5 and 6 are lost, the frame of 5 is concealed at mix time and
+	// only the one of 6 when 7 arrives, which carries no FEC data
+	n, err := stream.ReadPCM(pcm)
+	assert.NoError(t, err)
+	assert.Equal(t, 960, n)
+	_, err = ps.WritePacket(7, 7*960, packets[1])
+	assert.NoError(t, err)
+	readFrames(2)
+
+	// packets arriving out of order are dropped
+	_, err = ps.WritePacket(6, 6*960, packets[2])
+	assert.NoError(t, err)
+
+	stats = stream.(JitterBufferedStream).DecoderStats()
+	assert.Equal(t, uint64(3), stats.Decoded)
+	assert.Equal(t, uint64(3), stats.Concealed)
+	assert.Equal(t, uint64(1), stats.FECRecovered)
+}
+
+func TestDecodingStream_LatePacketAfterConcealment(t *testing.T) {
+	stream, err := NewDecodingOpusStream("stream1", 48000, 20, 1)
+	assert.NoError(t, err)
+	ps := stream.(PacketWriter)
+	packets := encodeTestPackets(t, 3)
+	buffered := func() int { return stream.(*opusDecodingStream).decoder.buffer.Len() }
+	pcm := make([]int16, 960)
+
+	_, err = ps.WritePacket(1, 960, packets[0])
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		n, err := stream.ReadPCM(pcm)
+		assert.NoError(t, err)
+		assert.Equal(t, 960, n)
+	}
+	assert.Equal(t, uint64(1), stream.(JitterBufferedStream).DecoderStats().Concealed)
+
+	// packet 2 was concealed at mix time, it only updates the decoder when
+	// it shows up late
+	_, err = ps.WritePacket(2, 2*960, packets[1])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, buffered())
+	_, err = ps.WritePacket(3, 3*960, packets[2])
+	assert.NoError(t, err)
+	assert.Equal(t, 960, buffered())
+
+	// a stream written without sequence numbers is not concealed
+	stream, err = NewDecodingOpusStream("stream2", 48000, 20, 1)
+	assert.NoError(t, err)
+	_, err = stream.Write(packets[0])
+	assert.NoError(t, err)
+	_, err = stream.ReadPCM(pcm)
+	assert.NoError(t, err)
+	_, err = stream.ReadPCM(pcm)
+	assert.ErrorIs(t, err, ErrEmptyBuffer)
+	_, err = stream.Write(packets[1])
+	assert.NoError(t, err)
+	assert.Equal(t, 960, stream.(*opusDecodingStream).decoder.buffer.Len())
+}
+
+func TestJitterBufferedStream_Concealment(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	stream, err := NewJitterBufferedOpusStream("stream1", 48000, 20, 1, JitterBufferOptions{Clock: clock})
+	assert.NoError(t, err)
+	packets := encodeTestPackets(t, 1)
+
+	_, err = stream.WritePacket(0, 0, packets[0])
+	assert.NoError(t, err)
+	_, err = stream.WritePacket(2, 2*960, fecTestPacket)
+	assert.NoError(t, err)
+
+	// packet 1 is missing at playout, packet 2 carries its FEC data
+	pcm := make([]int16, 960)
+	for i := 0; i < 3; i++ {
+		n, err := stream.ReadPCM(pcm)
+		assert.NoError(t, err)
+		assert.Equal(t, 960, n)
+	}
+	assert.Equal(t, uint64(1), stream.DecoderStats().FECRecovered)
+	assert.Equal(t, uint64(1), stream.JitterStats().Lost)
+
+	// the sender goes away, frames are concealed for a while and then the
+	// stream runs dry
+	for i := 0; i < maxConcealedFrames; i++ {
+		n, err := stream.ReadPCM(pcm)
+		assert.NoError(t, err)
+		assert.Equal(t, 960, n)
+	}
+	_, err = stream.ReadPCM(pcm)
+	assert.ErrorIs(t, err, ErrEmptyBuffer)
+
+	stats := stream.DecoderStats()
+	assert.Equal(t, uint64(2), stats.Decoded)
+	assert.Equal(t, uint64(maxConcealedFrames), stats.Concealed)
+}
+
+func TestOpusPacketHasFEC(t *testing.T) {
+	for _, tc := range []struct {
+		pkt []byte
+		fec bool
+	}{
+		{nil, false},
+		{[]byte{1 << 3}, false},
+		{[]byte{1 << 3, 0x40}, true},
+		{[]byte{1 << 3, 0xbf}, false},
+		// hybrid, CELT
+		{[]byte{13 << 3, 0x40}, true},
+		{[]byte{31 << 3, 0xff}, false},
+		// a 60ms mono and a 20ms stereo packet
+		{[]byte{3 << 3, 0x10}, true},
+		{[]byte{3 << 3, 0x40}, false},
+		{[]byte{1<<3 | 0x4, 0x10}, true},
+		// two frames of equal size, two of different sizes
+		{[]byte{1<<3 | 1, 0x40, 0}, true},
+		{[]byte{1<<3 | 1, 0x40}, false},
+		{[]byte{1<<3 | 2, 1, 0, 0x40}, false},
+		{[]byte{1<<3 | 2, 1, 0x40, 0}, true},
+		// a padded and a VBR code 3 packet
+		{[]byte{1<<3 | 3, 0x42, 1, 0x40, 0, 0xff}, true},
+		{[]byte{1<<3 | 3, 0x82, 1, 0x40, 0}, true},
+		{[]byte{1<<3 | 3, 0x82, 2, 0x40}, false},
+	} {
+		assert.Equal(t, tc.fec, opusPacketHasFEC(tc.pkt), "%x", tc.pkt)
+	}
+}
@@ -0,0 +1,134 @@
+package avmuxer
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	// binauralMaxDelay is the inter-aural time difference of a source at the
+	// side of the head.
+	binauralMaxDelay = 660 * time.Microsecond
+	// binauralMaxLevelDifference is the inter-aural level difference in dB of
+	// a source at the side of the head.
+	binauralMaxLevelDifference = 6.0
+)
+
+// panner places a source in the stereo field of the mix.
+type panner struct {
+	pan float64
+	// positioned is set once the source is placed with SetPan, it is mixed
+	// as is until then.
+	positioned bool
+	// gains are the left and right gains currently applied, ramping towards
+	// target.
+	gains    [2]float64
+	target   [2]float64
+	rampLeft int
+
+	// history holds the last frames of the source, the far ear of a binaural
+	// source hears them delayed.
+	history []int16
+	scratch []int16
+}
+
+func newPanner() panner {
+	return panner{
+		gains:  [2]float64{1, 1},
+		target: [2]float64{1, 1},
+	}
+}
+
+// panGains returns the left and right gains for pan, and how many frames the
+// far channel is delayed by when binaural cues are used. Without them the
+// constant-power law keeps the power of a source the same across the field,
+// so a centred source is 3 dB down in each channel and a hard-panned one at
+// full level in one.
+func panGains(pan float64, binaural bool, maxDelay int) (gains [2]float64, far, delay int) {
+	if !binaural {
+		theta := (pan + 1) * math.Pi / 4
+		return [2]float64{math.Cos(theta), math.Sin(theta)}, 0, 0
+	}
+	side := math.Abs(math.Sin(pan * math.Pi / 2))
+	level := math.Pow(10, -binauralMaxLevelDifference*side/20)
+	delay = int(math.Round(float64(maxDelay) * side))
+	if pan < 0 {
+		return [2]float64{1, level}, 1, delay
+	}
+	return [2]float64{level, 1}, 0, delay
+}
+
+// process pans the interleaved stereo frames of pcm, ramping gain changes over
+// rampSamples. maxDelay is the binaural delay in frames, 0 when binaural cues
+// are off.
+func (p *panner) process(pcm []int16, rampSamples, maxDelay int) {
+	gains, far, delay := panGains(p.pan, maxDelay > 0, maxDelay)
+	if !p.positioned && maxDelay == 0 {
+		gains = [2]float64{1, 1}
+	}
+	if maxDelay > 0 {
+		p.delay(pcm, far, delay, maxDelay)
+	}
+	if gains != p.target {
+		p.target = gains
+		p.rampLeft = rampSamples / 2
+	}
+	if p.rampLeft == 0 {
+		p.gains = p.target
+		if p.gains == [2]float64{1, 1} {
+			return
+		}
+	}
+	for f := 0; f < len(pcm)/2; f++ {
+		if p.rampLeft > 0 {
+			for c := range p.gains {
+				p.gains[c] += (p.target[c] - p.gains[c]) / float64(p.rampLeft)
+			}
+			p.rampLeft--
+		}
+		for c, g := range p.gains {
+			pcm[2*f+c] = clampInt16(int32(math.Round(float64(pcm[2*f+c]) * g)))
+		}
+	}
+}
+
+// delay replaces channel ch of pcm with itself delayed by d frames, keeping
+// maxDelay frames of history for the next call. Changes of d are not
+// smoothed.
+func (p *panner) delay(pcm []int16, ch, d, maxDelay int) {
+	if len(p.history) != 2*maxDelay {
+		p.history = make([]int16, 2*maxDelay)
+	}
+	ext := append(append(p.scratch[:0], p.history...), pcm...)
+	p.scratch = ext
+	for f := 0; f < len(pcm)/2; f++ {
+		pcm[2*f+ch] = ext[2*(maxDelay+f-d)+ch]
+	}
+	copy(p.history, ext[len(ext)-2*maxDelay:])
+}
+
+// SetPan places a source in the stereo field, from -1 for hard left through 0
+// for centre to 1 for hard right. Panning applies when the mix is stereo and
+// is ramped like gain changes. A source is mixed as is until it is placed,
+// after which the constant-power pan law keeps its power the same anywhere in
+// the field, 3 dB down in each channel at the centre. With
+// MixerOptions.Binaural the position is rendered with inter-aural delay and
+// level cues instead.
+func (mr *Multiplexer) SetPan(id string, pan float64) error {
+	if math.IsNaN(pan) || pan < -1 || pan > 1 {
+		return errors.New("invalid pan")
+	}
+	return mr.withSource(id, func(s *mixSource) { s.panner.pan, s.panner.positioned = pan, true })
+}
+
+// Pan returns the position of a source in the stereo field.
+func (mr *Multiplexer) Pan(id string) (float64, error) {
+	mr.RLock()
+	defer mr.RUnlock()
+	s, ok := mr.sources[id]
+	if !ok {
+		return 0, ErrSourceNotFound
+	}
+	return s.panner.pan, nil
+}
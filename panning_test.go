@@ -0,0 +1,88 @@
+package avmuxer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPanGains(t *testing.T) {
+	gains, _, _ := panGains(0, false, 0)
+	assert.InDelta(t, math.Sqrt2/2, gains[0], 1e-9)
+	assert.InDelta(t, math.Sqrt2/2, gains[1], 1e-9)
+
+	gains, _, _ = panGains(-1, false, 0)
+	assert.InDelta(t, 1, gains[0], 1e-9)
+	assert.InDelta(t, 0, gains[1], 1e-9)
+
+	// the power stays constant across the field
+	for _, pan := range []float64{-1, -0.7, -0.2, 0, 0.4, 0.9, 1} {
+		gains, _, _ = panGains(pan, false, 0)
+		assert.InDelta(t, 1, gains[0]*gains[0]+gains[1]*gains[1], 1e-9)
+	}
+
+	gains, far, delay := panGains(1, true, 32)
+	assert.InDelta(t, 0.501, gains[0], 1e-3)
+	assert.Equal(t, 1.0, gains[1])
+	assert.Equal(t, 0, far)
+	assert.Equal(t, 32, delay)
+
+	gains, far, delay = panGains(-0.5, true, 32)
+	assert.Equal(t, 1.0, gains[0])
+	assert.Equal(t, 1, far)
+	assert.Equal(t, 23, delay)
+}
+
+func TestMultiplexer_SetPan(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, GainRampSamples: 8})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 1000}))
+
+	assert.ErrorIs(t, mux.SetPan("missing", 0), ErrSourceNotFound)
+	assert.Error(t, mux.SetPan("a", 1.5))
+	assert.Error(t, mux.SetPan("a", math.NaN()))
+
+	// a source is mixed as is until it is placed, then each channel is
+	// 3 dB down at the centre
+	assert.Equal(t, []int16{1000, 1000}, mux.ReadPCM(2))
+	assert.NoError(t, mux.SetPan("a", 0))
+	assert.Equal(t, []int16{927, 927, 854, 854, 780, 780, 707, 707}, mux.ReadPCM(8))
+
+	assert.NoError(t, mux.SetPan("a", -1))
+	pan, err := mux.Pan("a")
+	assert.NoError(t, err)
+	assert.Equal(t, -1.0, pan)
+
+	// ramped over four frames
+	pcm := mux.ReadPCM(12)
+	for f := 1; f < 4; f++ {
+		assert.Greater(t, pcm[2*f], pcm[2*f-2])
+		assert.Less(t, pcm[2*f+1], pcm[2*f-1])
+	}
+	assert.Equal(t, []int16{1000, 0, 1000, 0}, pcm[8:])
+
+	// a mono mix is not panned
+	mux = NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 1000}))
+	assert.NoError(t, mux.SetPan("a", -1))
+	assert.Equal(t, []int16{1000, 1000}, mux.ReadPCM(2))
+}
+
+func TestMultiplexer_BinauralPan(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, Binaural: true, GainRampSamples: -1})
+	impulse := make([]int16, 128)
+	impulse[80] = 10000
+	assert.NoError(t, mux.AddSourceStream("a", &formatStream{newBufferStream(impulse), Format{Channels: 1}}))
+	assert.NoError(t, mux.SetPan("a", 1))
+
+	var out []int16
+	out = append(out, mux.ReadPCM(128)...)
+	out = append(out, mux.ReadPCM(128)...)
+	out = append(out, mux.ReadPCM(128)...)
+
+	// the right ear hears it first, the left one 660us later and 6 dB lower
+	assert.Equal(t, int16(10000), out[2*80+1])
+	assert.Equal(t, int16(0), out[2*80])
+	assert.Equal(t, int16(5012), out[2*(80+32)])
+	assert.Equal(t, int16(0), out[2*(80+32)+1])
+}
@@ -0,0 +1,238 @@
+package avmuxer
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// resamplerZeroCrossings is the number of zero crossings of the sinc kept
+	// on each side of the filter centre.
+	resamplerZeroCrossings = 16
+	// resamplerRolloff places the cutoff slightly below the lower Nyquist
+	// frequency so the transition band does not alias.
+	resamplerRolloff = 0.9
+	// resamplerKaiserBeta gives roughly 85 dB of stopband attenuation.
+	resamplerKaiserBeta = 8.6
+)
+
+// Resampler converts interleaved PCM from one sample rate to another with a
+// polyphase windowed-sinc filter. It keeps the tail of the previous input, so
+// a stream can be converted in chunks of any size.
+type Resampler struct {
+	inRate   int
+	outRate  int
+	channels int
+
+	// up and down are the conversion ratio outRate/inRate in lowest terms.
+	up   int
+	down int
+	taps int
+	// filter holds the up phases of the prototype low-pass filter, taps
+	// coefficients each.
+	filter []float64
+
+	// buf holds the buffered input frames, the first taps-1 of which are
+	// history for the next output. pos is the frame the next output is
+	// centred on and phase its sub-sample position.
+	buf   []float64
+	pos   int
+	phase int
+}
+
+func NewResampler(inRate, outRate, channels int) (*Resampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, errors.New("invalid sample rate")
+	}
+	if channels <= 0 {
+		return nil, errors.New("invalid channel count")
+	}
+	g := gcd(inRate, outRate)
+	r := &Resampler{
+		inRate:   inRate,
+		outRate:  outRate,
+		channels: channels,
+		up:       outRate / g,
+		down:     inRate / g,
+	}
+	if r.up != r.down {
+		r.design()
+	}
+	r.Reset()
+	return r, nil
+}
+
+// design computes the polyphase filter bank.
+func (r *Resampler) design() {
+	// cutoff in cycles per sample at the intermediate rate inRate*up
+	fc := resamplerRolloff * float64(min(r.inRate, r.outRate)) / 2 / float64(r.inRate*r.up)
+	r.taps = int(math.Ceil(resamplerZeroCrossings / (fc * float64(r.up))))
+	n := r.taps * r.up
+	centre := float64(n-1) / 2
+	proto := make([]float64, n)
+	for j := range proto {
+		x := float64(j) - centre
+		proto[j] = 2 * fc * sinc(2*fc*x) * kaiser(2*x/float64(n-1), resamplerKaiserBeta)
+	}
+
+	// filter[p*taps+k] is the coefficient applied to the input k frames
+	// before the current one at phase p. Each phase is normalised to unity
+	// gain at DC.
+	r.filter = make([]float64, n)
+	for p := 0; p < r.up; p++ {
+		var sum float64
+		for k := 0; k < r.taps; k++ {
+			sum += proto[p+k*r.up]
+		}
+		for k := 0; k < r.taps; k++ {
+			r.filter[p*r.taps+k] = proto[p+k*r.up] / sum
+		}
+	}
+}
+
+func (r *Resampler) InputRate() int {
+	return r.inRate
+}
+
+func (r *Resampler) OutputRate() int {
+	return r.outRate
+}
+
+func (r *Resampler) ChannelCount() int {
+	return r.channels
+}
+
+// Reset drops the buffered input, as if the resampler was newly created.
+func (r *Resampler) Reset() {
+	r.buf = r.buf[:0]
+	if r.taps > 1 {
+		r.buf = append(r.buf, make([]float64, (r.taps-1)*r.channels)...)
+	}
+	r.pos = max(r.taps-1, 0)
+	r.phase = 0
+}
+
+// Process converts in, which has to hold whole interleaved frames, and
+// appends the result to dst. Output that needs input not seen yet is produced
+// by a later call.
+func (r *Resampler) Process(dst, in []int16) []int16 {
+	ch := r.channels
+	in = in[:len(in)/ch*ch]
+	if r.up == r.down {
+		return append(dst, in...)
+	}
+
+	for _, v := range in {
+		r.buf = append(r.buf, float64(v))
+	}
+	frames := len(r.buf) / ch
+	for r.pos < frames {
+		coeffs := r.filter[r.phase*r.taps : (r.phase+1)*r.taps]
+		for c := 0; c < ch; c++ {
+			var acc float64
+			idx := r.pos*ch + c
+			for k, h := range coeffs {
+				acc += h * r.buf[idx-k*ch]
+			}
+			dst = append(dst, clampInt16(int32(math.Round(acc))))
+		}
+		r.phase += r.down
+		r.pos += r.phase / r.up
+		r.phase %= r.up
+	}
+
+	// keep taps-1 frames of history before the next output
+	if drop := r.pos - (r.taps - 1); drop > 0 {
+		keep := copy(r.buf, r.buf[drop*ch:])
+		r.buf = r.buf[:keep]
+		r.pos -= drop
+	}
+	return dst
+}
+
+// InputFor returns the number of interleaved input samples needed to produce
+// about n interleaved output samples.
+func (r *Resampler) InputFor(n int) int {
+	frames := n / r.channels
+	return (frames*r.down + r.up - 1) / r.up * r.channels
+}
+
+// resampleFIFO holds resampled audio until a whole frame of it is asked for.
+type resampleFIFO struct {
+	resampler *Resampler
+	pending   []int16
+	scratch   []int16
+}
+
+func newResampleFIFO(inRate, outRate, channels int) (*resampleFIFO, error) {
+	r, err := NewResampler(inRate, outRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	return &resampleFIFO{resampler: r}, nil
+}
+
+// push resamples in and queues the result.
+func (f *resampleFIFO) push(in []int16) {
+	f.pending = f.resampler.Process(f.pending, in)
+}
+
+// pop moves up to len(dst) queued samples into dst.
+func (f *resampleFIFO) pop(dst []int16) int {
+	n := copy(dst, f.pending)
+	f.pending = f.pending[:copy(f.pending, f.pending[n:])]
+	return n
+}
+
+// readFrom fills dst with audio read from stream, reading only what the queue
+// is missing. The stream's error is returned when nothing was queued.
+func (f *resampleFIFO) readFrom(stream Stream, dst []int16) (int, error) {
+	var err error
+	if need := len(dst) - len(f.pending); need > 0 {
+		in := f.resampler.InputFor(need)
+		if cap(f.scratch) < in {
+			f.scratch = make([]int16, in)
+		}
+		var n int
+		n, err = stream.ReadPCM(f.scratch[:in])
+		if n > 0 {
+			f.push(f.scratch[:n])
+		}
+	}
+	if n := f.pop(dst); n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// kaiser returns the Kaiser window at x in [-1, 1].
+func kaiser(x, beta float64) float64 {
+	return besselI0(beta*math.Sqrt(math.Max(0, 1-x*x))) / besselI0(beta)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / 2) / float64(k)
+		sum += term * term
+		if term*term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
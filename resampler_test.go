@@ -0,0 +1,176 @@
+package avmuxer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zaf/g711"
+)
+
+func sineWave(rate, freq, samples int, amplitude float64) []int16 {
+	pcm := make([]int16, samples)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * math.Sin(2*math.Pi*float64(freq)*float64(i)/float64(rate)))
+	}
+	return pcm
+}
+
+// toneFit returns the amplitude of freq in pcm and the RMS of what remains
+// once that tone is subtracted
+func toneFit(pcm []int16, rate, freq int) (amplitude, residual float64) {
+	var a, b float64
+	w := 2 * math.Pi * float64(freq) / float64(rate)
+	for i, v := range pcm {
+		a += float64(v) * math.Sin(w*float64(i))
+		b += float64(v) * math.Cos(w*float64(i))
+	}
+	a, b = 2*a/float64(len(pcm)), 2*b/float64(len(pcm))
+	var sum float64
+	for i, v := range pcm {
+		d := float64(v) - a*math.Sin(w*float64(i)) - b*math.Cos(w*float64(i))
+		sum += d * d
+	}
+	return math.Hypot(a, b), math.Sqrt(sum / float64(len(pcm)))
+}
+
+func TestNewResampler(t *testing.T) {
+	_, err := NewResampler(0, 48000, 1)
+	assert.Error(t, err)
+	_, err = NewResampler(8000, 48000, 0)
+	assert.Error(t, err)
+
+	r, err := NewResampler(48000, 48000, 2)
+	assert.NoError(t, err)
+	in := []int16{1, 2, 3, 4}
+	assert.Equal(t, in, r.Process(nil, in))
+}
+
+func TestResampler_Tone(t *testing.T) {
+	tests := []struct {
+		name    string
+		in, out int
+	}{
+		{"upsample", 8000, 48000},
+		{"downsample", 48000, 8000},
+		{"fractional", 44100, 48000},
+		{"wideband", 16000, 48000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResampler(tt.in, tt.out, 1)
+			assert.NoError(t, err)
+			out := r.Process(nil, sineWave(tt.in, 1000, tt.in/2, 10000))
+			assert.InDelta(t, tt.out/2, len(out), 1)
+
+			// skip the filter's start up
+			amplitude, residual := toneFit(out[len(out)/4:], tt.out, 1000)
+			assert.InDelta(t, 10000, amplitude, 50)
+			assert.Less(t, residual, 20.0)
+		})
+	}
+}
+
+func TestResampler_RejectsAliases(t *testing.T) {
+	r, err := NewResampler(48000, 8000, 1)
+	assert.NoError(t, err)
+	// 6 kHz is above the Nyquist frequency of 8 kHz
+	out := r.Process(nil, sineWave(48000, 6000, 24000, 10000))
+	_, residual := toneFit(out[len(out)/4:], 8000, 1000)
+	assert.Less(t, residual, 10.0)
+}
+
+func TestResampler_Chunked(t *testing.T) {
+	in := sineWave(8000, 440, 800, 8000)
+	whole, err := NewResampler(8000, 48000, 1)
+	assert.NoError(t, err)
+	expected := whole.Process(nil, in)
+
+	chunked, err := NewResampler(8000, 48000, 1)
+	assert.NoError(t, err)
+	var out []int16
+	for i := 0; i < len(in); i += 37 {
+		out = chunked.Process(out, in[i:min(i+37, len(in))])
+	}
+	assert.Equal(t, expected, out)
+
+	chunked.Reset()
+	assert.Equal(t, expected, chunked.Process(nil, in))
+}
+
+func TestResampler_Stereo(t *testing.T) {
+	left := sineWave(16000, 500, 1600, 12000)
+	in := make([]int16, 2*len(left))
+	for i, v := range left {
+		in[2*i] = v
+	}
+	r, err := NewResampler(16000, 48000, 2)
+	assert.NoError(t, err)
+	out := r.Process(nil, in)
+	assert.Equal(t, 2*3*len(left), len(out))
+
+	l := make([]int16, len(out)/2)
+	for i := range l {
+		l[i] = out[2*i]
+		assert.Zero(t, out[2*i+1])
+	}
+	amplitude, _ := toneFit(l[len(l)/4:], 48000, 500)
+	assert.InDelta(t, 12000, amplitude, 60)
+}
+
+func TestResampler_InputFor(t *testing.T) {
+	r, err := NewResampler(48000, 8000, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1920, r.InputFor(320))
+
+	r, err = NewResampler(44100, 48000, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 882, r.InputFor(960))
+}
+
+func TestMultiplexer_MixesDifferentRates(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, SampleRate: 48000, Channels: 1})
+	narrow := &formatStream{newBufferStream(sineWave(8000, 1000, 8000, 8000)), Format{SampleRate: 8000}}
+	wide := &formatStream{newBufferStream(sineWave(48000, 3000, 48000, 4000)), Format{SampleRate: 48000}}
+	assert.NoError(t, mux.AddSourceStream("narrow", narrow))
+	assert.NoError(t, mux.AddSourceStream("wide", wide))
+
+	var mixed []int16
+	for i := 0; i < 25; i++ {
+		frame := mux.ReadPCM(960)
+		assert.Len(t, frame, 960)
+		mixed = append(mixed, frame...)
+	}
+	// both sources advanced by half a second of audio
+	assert.Equal(t, 4000, narrow.Len())
+	assert.Equal(t, 24000, wide.Len())
+
+	narrowAmp, _ := toneFit(mixed[4800:], 48000, 1000)
+	wideAmp, _ := toneFit(mixed[4800:], 48000, 3000)
+	assert.InDelta(t, 8000, narrowAmp, 80)
+	assert.InDelta(t, 4000, wideAmp, 40)
+}
+
+func TestMultiplexer_EncoderRate(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, SampleRate: 48000, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 1000}))
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddEncoder("pstn", enc))
+	assert.NoError(t, mux.AddEncoderFor("a", enc))
+
+	out := make([]byte, 400)
+	for i := 0; i < 3; i++ {
+		n, err := mux.Read(out)
+		assert.NoError(t, err)
+		assert.Equal(t, 160, n)
+	}
+	// the filter has settled on the constant level
+	assert.Equal(t, g711.EncodeUlawFrame(1000), out[159])
+
+	// a's mix-minus is silence at the encoder rate
+	n, err := mux.ReadFor("a", out)
+	assert.NoError(t, err)
+	assert.Equal(t, 160, n)
+	assert.Equal(t, g711.EncodeUlawFrame(0), out[159])
+}
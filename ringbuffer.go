@@ -78,3 +78,8 @@ func (rb *RingBuffer[T]) Read(buf []T) (int, error) {
 
 	return int(toRead), nil
 }
+
+// Len returns the number of elements available to read
+func (rb *RingBuffer[T]) Len() int {
+	return int(atomic.LoadUint64(&rb.head) - atomic.LoadUint64(&rb.tail))
+}
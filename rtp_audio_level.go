@@ -0,0 +1,165 @@
+package avmuxer
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// maxContributingSources is the number of CSRCs an RTP header can list.
+const maxContributingSources = 15
+
+// ContributingSource is a source mixed into a packet together with its audio
+// level in -dBov, as listed by the RFC 6465 mixer-to-client audio level
+// header extension.
+type ContributingSource struct {
+	SSRC  uint32
+	Level uint8
+}
+
+// ReadAudioLevel returns the RFC 6464 client-to-mixer audio level carried by
+// pkt in the header extension extID, ok is false when pkt carries none.
+func ReadAudioLevel(pkt *rtp.Packet, extID uint8) (level rtp.AudioLevelExtension, ok bool, err error) {
+	payload := pkt.GetExtension(extID)
+	if payload == nil {
+		return level, false, nil
+	}
+	if err := level.Unmarshal(payload); err != nil {
+		return level, false, err
+	}
+	return level, true, nil
+}
+
+// WriteAudioLevel sets the RFC 6464 client-to-mixer audio level extension
+// extID of pkt to level.
+func WriteAudioLevel(pkt *rtp.Packet, extID uint8, level AudioLevel) error {
+	payload, err := rtp.AudioLevelExtension{Level: level.Level, Voice: level.Voice}.Marshal()
+	if err != nil {
+		return err
+	}
+	return pkt.SetExtension(extID, payload)
+}
+
+// ReadMixerAudioLevels returns the CSRCs of pkt together with their levels
+// from the RFC 6465 mixer-to-client audio level extension extID, or nil when
+// pkt carries none.
+func ReadMixerAudioLevels(pkt *rtp.Packet, extID uint8) ([]ContributingSource, error) {
+	payload := pkt.GetExtension(extID)
+	if payload == nil {
+		return nil, nil
+	}
+	if len(payload) < len(pkt.CSRC) {
+		return nil, errors.New("fewer audio levels than contributing sources")
+	}
+	sources := make([]ContributingSource, len(pkt.CSRC))
+	for i, ssrc := range pkt.CSRC {
+		sources[i] = ContributingSource{SSRC: ssrc, Level: payload[i] & 0x7f}
+	}
+	return sources, nil
+}
+
+// WriteMixerAudioLevels sets the CSRCs of pkt to sources and lists their
+// levels in the RFC 6465 mixer-to-client audio level extension extID.
+func WriteMixerAudioLevels(pkt *rtp.Packet, extID uint8, sources []ContributingSource) error {
+	if len(sources) > maxContributingSources {
+		return errors.New("too many contributing sources")
+	}
+	if len(sources) == 0 {
+		pkt.CSRC = nil
+		if pkt.GetExtension(extID) != nil {
+			return pkt.DelExtension(extID)
+		}
+		return nil
+	}
+	csrc := make([]uint32, len(sources))
+	payload := make([]byte, len(sources))
+	for i, s := range sources {
+		if s.Level > audioLevelSilence {
+			return errors.New("invalid audio level")
+		}
+		csrc[i] = s.SSRC
+		payload[i] = s.Level
+	}
+	if err := pkt.SetExtension(extID, payload); err != nil {
+		return err
+	}
+	pkt.CSRC = csrc
+	return nil
+}
+
+// SetSourceSSRC sets the SSRC the source id is listed with in
+// ContributingSources.
+func (mr *Multiplexer) SetSourceSSRC(id string, ssrc uint32) error {
+	return mr.withSource(id, func(s *mixSource) {
+		s.ssrc = ssrc
+		s.hasSSRC = true
+	})
+}
+
+// ReportAudioLevel feeds the source id the audio level its sender put in an
+// RFC 6464 client-to-mixer audio level extension. Voice activity detection
+// then trusts the sender instead of analysing the audio, and speaker
+// selection is updated right away, timed by MixerOptions.Clock, so sources
+// whose audio isn't decoded or mixed still become speakers.
+func (mr *Multiplexer) ReportAudioLevel(id string, level rtp.AudioLevelExtension) error {
+	now := mr.clock.Now()
+	mr.Lock()
+	s, ok := mr.sources[id]
+	if !ok {
+		mr.Unlock()
+		return ErrSourceNotFound
+	}
+	if s.vad != nil {
+		var d time.Duration
+		if !s.reportedAt.IsZero() {
+			d = now.Sub(s.reportedAt)
+		}
+		s.reportedAt = now
+		if _, changed := s.vad.reportFor(level.Level, level.Voice, d); changed {
+			mr.events.speech = append(mr.events.speech, SpeechEvent{ID: id, Speaking: s.vad.Speaking()})
+		}
+		mr.selectSpeakers(mr.anySolo())
+	}
+	events := mr.takeEvents()
+	mr.Unlock()
+	mr.emit(events)
+	return nil
+}
+
+// ContributingSources returns the sources with an SSRC that are audible in
+// the most recently mixed frame, loudest first and at most 15, with their
+// level in the mix. They are what the RTP packets of the mix list as CSRCs.
+func (mr *Multiplexer) ContributingSources() []ContributingSource {
+	return mr.ContributingSourcesFor("")
+}
+
+// ContributingSourcesFor is ContributingSources for the mix-minus output of
+// the source id, which leaves it out.
+func (mr *Multiplexer) ContributingSourcesFor(id string) []ContributingSource {
+	mr.RLock()
+	defer mr.RUnlock()
+	var sources []ContributingSource
+	for sid, s := range mr.sources {
+		if sid == id || !s.hasSSRC || !s.audible || s.gain <= 0 {
+			continue
+		}
+		level := math.Round(-(s.meter.DBov() + 20*math.Log10(s.gain)))
+		sources = append(sources, ContributingSource{
+			SSRC:  s.ssrc,
+			Level: uint8(math.Max(0, math.Min(level, audioLevelSilence))),
+		})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Level != sources[j].Level {
+			return sources[i].Level < sources[j].Level
+		}
+		return sources[i].SSRC < sources[j].SSRC
+	})
+	if len(sources) > maxContributingSources {
+		sources = sources[:maxContributingSources]
+	}
+	return sources
+}
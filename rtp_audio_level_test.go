@@ -0,0 +1,127 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudioLevelExtension(t *testing.T) {
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1}, Payload: []byte{1, 2, 3}}
+	_, ok, err := ReadAudioLevel(pkt, 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, WriteAudioLevel(pkt, 1, AudioLevel{Level: 30, Voice: true}))
+	assert.Equal(t, []byte{0x80 | 30}, pkt.GetExtension(1))
+	assert.Error(t, WriteAudioLevel(pkt, 1, AudioLevel{Level: 200}))
+
+	raw, err := pkt.Marshal()
+	assert.NoError(t, err)
+	var received rtp.Packet
+	assert.NoError(t, received.Unmarshal(raw))
+	level, ok, err := ReadAudioLevel(&received, 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, rtp.AudioLevelExtension{Level: 30, Voice: true}, level)
+}
+
+func TestMixerAudioLevelExtension(t *testing.T) {
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1}}
+	sources := []ContributingSource{{SSRC: 10, Level: 6}, {SSRC: 20, Level: 40}}
+	assert.NoError(t, WriteMixerAudioLevels(pkt, 2, sources))
+	assert.Equal(t, []uint32{10, 20}, pkt.CSRC)
+
+	raw, err := pkt.Marshal()
+	assert.NoError(t, err)
+	var received rtp.Packet
+	assert.NoError(t, received.Unmarshal(raw))
+	read, err := ReadMixerAudioLevels(&received, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, sources, read)
+
+	assert.EqualError(t, WriteMixerAudioLevels(pkt, 2, make([]ContributingSource, 16)), "too many contributing sources")
+	assert.Error(t, WriteMixerAudioLevels(pkt, 2, []ContributingSource{{SSRC: 1, Level: 128}}))
+
+	received.CSRC = append(received.CSRC, 30)
+	_, err = ReadMixerAudioLevels(&received, 2)
+	assert.Error(t, err)
+
+	assert.NoError(t, WriteMixerAudioLevels(pkt, 2, nil))
+	assert.Empty(t, pkt.CSRC)
+	read, err = ReadMixerAudioLevels(pkt, 2)
+	assert.NoError(t, err)
+	assert.Nil(t, read)
+}
+
+func TestMultiplexer_ContributingSources(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, GainRampSamples: -1, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 16384}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 1638}))
+	assert.NoError(t, mux.AddSourceStream("no-ssrc", &constantStream{value: 1638}))
+	assert.NoError(t, mux.AddSourceStream("muted", &constantStream{value: 1638}))
+	assert.NoError(t, mux.AddSourceStream("silent", &constantStream{}))
+	assert.NoError(t, mux.SetSourceSSRC("a", 1))
+	assert.NoError(t, mux.SetSourceSSRC("b", 2))
+	assert.NoError(t, mux.SetSourceSSRC("muted", 3))
+	assert.NoError(t, mux.SetSourceSSRC("silent", 4))
+	assert.ErrorIs(t, mux.SetSourceSSRC("missing", 5), ErrSourceNotFound)
+	assert.NoError(t, mux.Mute("muted"))
+
+	mux.ReadPCM(960)
+	assert.Equal(t, []ContributingSource{{SSRC: 1, Level: 6}, {SSRC: 2, Level: 26}}, mux.ContributingSources())
+	assert.Equal(t, []ContributingSource{{SSRC: 2, Level: 26}}, mux.ContributingSourcesFor("a"))
+
+	// levels are the ones in the mix
+	assert.NoError(t, mux.SetGain("b", -6))
+	mux.ReadPCM(960)
+	assert.Equal(t, []ContributingSource{{SSRC: 1, Level: 6}, {SSRC: 2, Level: 32}}, mux.ContributingSources())
+}
+
+func TestMultiplexer_ReportAudioLevel(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	var events []SpeechEvent
+	mux := NewMultiplexer(MixerOptions{
+		Channels: 1,
+		Clock:    clock,
+		OnSpeech: func(e SpeechEvent) { events = append(events, e) },
+	})
+	assert.NoError(t, mux.AddSourceStream("a", &formatStream{newBufferStream(nil), Format{Channels: 1}}))
+	assert.NoError(t, mux.AddSourceStream("b", &formatStream{newBufferStream(nil), Format{Channels: 1}}))
+	assert.ErrorIs(t, mux.ReportAudioLevel("missing", rtp.AudioLevelExtension{}), ErrSourceNotFound)
+
+	// the sender's voice flag is trusted without analysing, or even
+	// reading, the audio
+	report := func(id string, level uint8, voice bool) {
+		assert.NoError(t, mux.ReportAudioLevel(id, rtp.AudioLevelExtension{Level: level, Voice: voice}))
+	}
+	report("a", 20, true)
+	assert.False(t, mux.IsSpeaking("a"))
+	clock.Advance(20 * time.Millisecond)
+	report("a", 20, true)
+	assert.True(t, mux.IsSpeaking("a"))
+	assert.Equal(t, "a", mux.DominantSpeaker())
+	assert.Equal(t, []SpeechEvent{{ID: "a", Speaking: true}}, events)
+
+	// a louder speaker takes over
+	report("b", 3, true)
+	for i := 0; i < 20; i++ {
+		clock.Advance(20 * time.Millisecond)
+		report("a", 30, true)
+		report("b", 3, true)
+	}
+	assert.Equal(t, "b", mux.DominantSpeaker())
+
+	// reports count as silence once the sender stops sending them
+	clock.Advance(time.Second)
+	report("b", 3, true)
+	assert.False(t, mux.IsSpeaking("b"))
+
+	// without reports the audio is analysed again
+	for i := 0; i < 25; i++ {
+		mux.ReadPCM(960)
+	}
+	assert.False(t, mux.IsSpeaking("a"))
+}
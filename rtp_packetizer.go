@@ -0,0 +1,176 @@
+package avmuxer
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// RTPWriter takes RTP packets, as webrtc.TrackLocalStaticRTP does.
+type RTPWriter interface {
+	WriteRTP(*rtp.Packet) error
+}
+
+type rtpWriter struct {
+	w io.Writer
+}
+
+// NewRTPWriter returns an RTPWriter writing every packet marshalled to w with
+// a single Write call, as needed for a UDP connection.
+func NewRTPWriter(w io.Writer) RTPWriter {
+	return &rtpWriter{w: w}
+}
+
+func (rw *rtpWriter) WriteRTP(pkt *rtp.Packet) error {
+	raw, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.Write(raw)
+	return err
+}
+
+// RTPPacketizerOptions configures an RTPPacketizer.
+type RTPPacketizerOptions struct {
+	PayloadType uint8
+	// SSRC of the packets, random when zero.
+	SSRC uint32
+	// ClockRate is the rate of the RTP timestamps, defaults to 48000, which
+	// is what Opus always uses. G.711 uses 8000.
+	ClockRate int
+	// FrameDuration is the duration of the frames passed to Write, defaults
+	// to 20ms.
+	FrameDuration time.Duration
+	// SkipSilence leaves out the frames the mixing loop marks as silent.
+	// Their timestamps are skipped all the same.
+	SkipSilence bool
+	// CSRCs, when set, is called for every packet to list the sources mixed
+	// into it, typically Multiplexer.ContributingSources.
+	CSRCs func() []ContributingSource
+	// MixerLevelExtensionID, when set, is the id of the RFC 6465
+	// mixer-to-client audio level extension carrying the levels of the
+	// CSRCs.
+	MixerLevelExtensionID uint8
+}
+
+func (o RTPPacketizerOptions) withDefaults() RTPPacketizerOptions {
+	if o.SSRC == 0 {
+		o.SSRC = rand.Uint32()
+	}
+	if o.ClockRate == 0 {
+		o.ClockRate = 48000
+	}
+	if o.FrameDuration == 0 {
+		o.FrameDuration = 20 * time.Millisecond
+	}
+	return o
+}
+
+// RTPPacketizer wraps encoded frames into RTP packets. Sequence numbers
+// count the packets sent, timestamps advance by the duration of every frame
+// whether it was sent or not, and the marker bit flags the first packet
+// after silence. It is a MixSink for the mixing loop and an io.Writer for
+// the frames read from a Transcoder or Multiplexer.
+type RTPPacketizer struct {
+	w    RTPWriter
+	opts RTPPacketizerOptions
+
+	mu sync.Mutex
+	// seq and timestamp are those of the next packet, fraction the part of
+	// a timestamp tick frames added on top, in nanoseconds times the clock
+	// rate.
+	seq       uint16
+	timestamp uint32
+	fraction  int64
+	// silent is set when the previous frame was silent or not sent.
+	silent bool
+}
+
+// NewRTPPacketizer creates an RTPPacketizer writing its packets to w. The
+// first sequence number and timestamp are random as RFC 3550 recommends.
+func NewRTPPacketizer(w RTPWriter, opts RTPPacketizerOptions) (*RTPPacketizer, error) {
+	if opts.PayloadType > 127 {
+		return nil, errors.New("invalid payload type")
+	}
+	if opts.ClockRate < 0 || opts.FrameDuration < 0 {
+		return nil, errors.New("invalid clock rate or frame duration")
+	}
+	return &RTPPacketizer{
+		w:         w,
+		opts:      opts.withDefaults(),
+		seq:       uint16(rand.Uint32()),
+		timestamp: rand.Uint32(),
+		silent:    true,
+	}, nil
+}
+
+// SSRC returns the SSRC of the packets.
+func (p *RTPPacketizer) SSRC() uint32 {
+	return p.opts.SSRC
+}
+
+// WriteFrame sends the encoded frame of the mixing loop. Frames without
+// encoded data, which the loop produces without an encoder, are not sent.
+func (p *RTPPacketizer) WriteFrame(frame MixFrame) error {
+	if frame.Silent && p.opts.SkipSilence {
+		return p.WritePayload(nil, frame.Duration, true)
+	}
+	return p.WritePayload(frame.Encoded, frame.Duration, frame.Silent)
+}
+
+// Write sends payload as a frame of RTPPacketizerOptions.FrameDuration.
+func (p *RTPPacketizer) Write(payload []byte) (int, error) {
+	if err := p.WritePayload(payload, p.opts.FrameDuration, false); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// WritePayload sends payload as a frame of duration d. An empty payload is
+// not sent but still advances the timestamp.
+func (p *RTPPacketizer) WritePayload(payload []byte, d time.Duration, silent bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	timestamp := p.timestamp
+	p.fraction += int64(d) * int64(p.opts.ClockRate)
+	p.timestamp += uint32(p.fraction / int64(time.Second))
+	p.fraction %= int64(time.Second)
+	if len(payload) == 0 {
+		p.silent = true
+		return nil
+	}
+
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         p.silent && !silent,
+			PayloadType:    p.opts.PayloadType,
+			SequenceNumber: p.seq,
+			Timestamp:      timestamp,
+			SSRC:           p.opts.SSRC,
+		},
+		Payload: payload,
+	}
+	if p.opts.CSRCs != nil {
+		sources := p.opts.CSRCs()
+		if len(sources) > maxContributingSources {
+			sources = sources[:maxContributingSources]
+		}
+		if p.opts.MixerLevelExtensionID != 0 {
+			if err := WriteMixerAudioLevels(pkt, p.opts.MixerLevelExtensionID, sources); err != nil {
+				return err
+			}
+		} else {
+			for _, s := range sources {
+				pkt.CSRC = append(pkt.CSRC, s.SSRC)
+			}
+		}
+	}
+	p.seq++
+	p.silent = silent
+	return p.w.WriteRTP(pkt)
+}
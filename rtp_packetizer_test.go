@@ -0,0 +1,148 @@
+package avmuxer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+// rtpCapture is an RTPWriter keeping the packets written to it
+type rtpCapture struct {
+	packets []*rtp.Packet
+}
+
+func (rc *rtpCapture) WriteRTP(pkt *rtp.Packet) error {
+	rc.packets = append(rc.packets, pkt.Clone())
+	return nil
+}
+
+func TestRTPPacketizer(t *testing.T) {
+	_, err := NewRTPPacketizer(&rtpCapture{}, RTPPacketizerOptions{PayloadType: 128})
+	assert.Error(t, err)
+
+	out := &rtpCapture{}
+	p, err := NewRTPPacketizer(out, RTPPacketizerOptions{PayloadType: 0, SSRC: 1234, ClockRate: 8000})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1234), p.SSRC())
+
+	payload := []byte{1, 2, 3}
+	for i := 0; i < 2; i++ {
+		n, err := p.Write(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	}
+	// a frame that wasn't encoded leaves a gap in the timestamps only
+	assert.NoError(t, p.WritePayload(nil, 20*time.Millisecond, false))
+	assert.NoError(t, p.WritePayload(payload, 20*time.Millisecond, false))
+
+	assert.Len(t, out.packets, 3)
+	first := out.packets[0]
+	assert.Equal(t, uint8(2), first.Version)
+	assert.Equal(t, uint8(0), first.PayloadType)
+	assert.Equal(t, uint32(1234), first.SSRC)
+	assert.Equal(t, payload, first.Payload)
+	assert.Equal(t, []bool{true, false, true}, []bool{out.packets[0].Marker, out.packets[1].Marker, out.packets[2].Marker})
+	assert.Equal(t, first.SequenceNumber+1, out.packets[1].SequenceNumber)
+	assert.Equal(t, first.SequenceNumber+2, out.packets[2].SequenceNumber)
+	assert.Equal(t, first.Timestamp+160, out.packets[1].Timestamp)
+	assert.Equal(t, first.Timestamp+480, out.packets[2].Timestamp)
+}
+
+func TestRTPPacketizer_Silence(t *testing.T) {
+	frame := func(silent bool) MixFrame {
+		return MixFrame{Encoded: []byte{1}, Duration: 20 * time.Millisecond, Silent: silent}
+	}
+
+	out := &rtpCapture{}
+	p, err := NewRTPPacketizer(out, RTPPacketizerOptions{PayloadType: 111, SkipSilence: true})
+	assert.NoError(t, err)
+	for _, silent := range []bool{false, false, true, true, false} {
+		assert.NoError(t, p.WriteFrame(frame(silent)))
+	}
+	assert.Len(t, out.packets, 3)
+	assert.False(t, out.packets[1].Marker)
+	assert.True(t, out.packets[2].Marker)
+	assert.Equal(t, out.packets[1].Timestamp+3*960, out.packets[2].Timestamp)
+	assert.Equal(t, out.packets[1].SequenceNumber+1, out.packets[2].SequenceNumber)
+
+	// silence that is sent still ends with a marker
+	out = &rtpCapture{}
+	p, err = NewRTPPacketizer(out, RTPPacketizerOptions{PayloadType: 111})
+	assert.NoError(t, err)
+	for _, silent := range []bool{true, false, true, false} {
+		assert.NoError(t, p.WriteFrame(frame(silent)))
+	}
+	var markers []bool
+	for _, pkt := range out.packets {
+		markers = append(markers, pkt.Marker)
+	}
+	assert.Equal(t, []bool{false, true, false, true}, markers)
+}
+
+func TestRTPPacketizer_FractionalTimestamps(t *testing.T) {
+	out := &rtpCapture{}
+	p, err := NewRTPPacketizer(out, RTPPacketizerOptions{ClockRate: 44100, FrameDuration: 15 * time.Millisecond})
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := p.Write([]byte{1})
+		assert.NoError(t, err)
+	}
+	// 661.5 ticks per frame
+	assert.Equal(t, out.packets[0].Timestamp+1323, out.packets[2].Timestamp)
+	assert.Equal(t, out.packets[0].Timestamp+1984, out.packets[3].Timestamp)
+}
+
+func TestRTPPacketizer_CSRCs(t *testing.T) {
+	sources := []ContributingSource{{SSRC: 1, Level: 10}, {SSRC: 2, Level: 30}}
+	out := &rtpCapture{}
+	p, err := NewRTPPacketizer(out, RTPPacketizerOptions{
+		CSRCs:                 func() []ContributingSource { return sources },
+		MixerLevelExtensionID: 3,
+	})
+	assert.NoError(t, err)
+	_, err = p.Write([]byte{1})
+	assert.NoError(t, err)
+	read, err := ReadMixerAudioLevels(out.packets[0], 3)
+	assert.NoError(t, err)
+	assert.Equal(t, sources, read)
+
+	// without the extension only the CSRCs are listed, at most 15
+	sources = make([]ContributingSource, 20)
+	for i := range sources {
+		sources[i].SSRC = uint32(i)
+	}
+	out = &rtpCapture{}
+	p, err = NewRTPPacketizer(out, RTPPacketizerOptions{CSRCs: func() []ContributingSource { return sources }})
+	assert.NoError(t, err)
+	_, err = p.Write([]byte{1})
+	assert.NoError(t, err)
+	assert.Len(t, out.packets[0].CSRC, 15)
+	assert.Nil(t, out.packets[0].GetExtension(3))
+}
+
+func TestMultiplexer_RTPSink(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{SampleRate: 8000, Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 4000}))
+	assert.NoError(t, mux.SetSourceSSRC("a", 99))
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddEncoder("pcmu", enc))
+
+	var buf bytes.Buffer
+	p, err := NewRTPPacketizer(NewRTPWriter(&buf), RTPPacketizerOptions{
+		ClockRate: 8000,
+		CSRCs:     mux.ContributingSources,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddSink("rtp", p))
+	mux.produceFrame(20*time.Millisecond, 0)
+
+	var pkt rtp.Packet
+	assert.NoError(t, pkt.Unmarshal(buf.Bytes()))
+	assert.Len(t, pkt.Payload, 160)
+	assert.Equal(t, []uint32{99}, pkt.CSRC)
+	assert.True(t, pkt.Marker)
+}
@@ -0,0 +1,200 @@
+package avmuxer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	ErrUnexpectedPayloadType = errors.New("unexpected payload type")
+	ErrUnexpectedSSRC        = errors.New("unexpected ssrc")
+)
+
+// RTPStreamOptions configures an RTPStream.
+type RTPStreamOptions struct {
+	// SSRC is the only SSRC accepted. When zero the stream locks onto the
+	// SSRC of the first packet.
+	SSRC uint32
+	// ClockRate is the rate of the RTP timestamps, defaults to the sample
+	// rate of the wrapped stream or 48000 when it doesn't report one.
+	ClockRate int
+	// Clock timestamps packet arrivals, defaults to SystemClock.
+	Clock Clock
+}
+
+// RTPStats is a snapshot of the reception statistics of an RTPStream, as
+// described in RFC 3550 section 6.4.1.
+type RTPStats struct {
+	SSRC uint32
+	// Received counts accepted packets, duplicates included.
+	Received uint64
+	// Lost is the number of packets expected less the number received. It
+	// can be negative when packets were duplicated.
+	Lost int64
+	// Late counts packets that arrived after a newer one and were dropped
+	// because the wrapped stream cannot reorder them.
+	Late uint64
+	// Rejected counts packets with an unexpected payload type or SSRC.
+	Rejected uint64
+	// HighestSeq is the highest sequence number received, extended with
+	// the number of wraparounds.
+	HighestSeq uint32
+	// LastTimestamp is the RTP timestamp of the newest packet.
+	LastTimestamp uint32
+	// Jitter is the interarrival jitter estimate.
+	Jitter time.Duration
+}
+
+// RTPStream takes RTP packets, checks their payload type and SSRC, tracks
+// their sequence numbers and timestamps and feeds the payloads to the
+// wrapped decoding stream, which is what it reads PCM from. A stream
+// implementing PacketWriter, such as a jitter buffered Opus stream, gets the
+// sequence number and timestamp of every payload and does its own
+// reordering; any other stream gets the payloads through Write in order,
+// with late packets dropped.
+type RTPStream struct {
+	stream      Stream
+	payloadType uint8
+	opts        RTPStreamOptions
+
+	mu sync.Mutex
+	// started is set by the first accepted packet, which sets ssrc and
+	// baseSeq.
+	started       bool
+	ssrc          uint32
+	baseSeq       uint16
+	maxSeq        uint16
+	cycles        uint32
+	lastTimestamp uint32
+	arrivals      interarrivalJitter
+	received      uint64
+	late          uint64
+	rejected      uint64
+}
+
+// NewRTPStream creates an RTPStream feeding stream with the payloads of
+// packets of the given payload type. stream has to implement PacketWriter
+// or io.Writer.
+func NewRTPStream(stream Stream, payloadType uint8, opts ...RTPStreamOptions) (*RTPStream, error) {
+	var o RTPStreamOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	switch stream.(type) {
+	case PacketWriter, io.Writer:
+	default:
+		return nil, fmt.Errorf("stream %T doesn't take payloads", stream)
+	}
+	if o.ClockRate == 0 {
+		o.ClockRate = stream.Format().rate(48000)
+	}
+	if o.Clock == nil {
+		o.Clock = SystemClock
+	}
+	return &RTPStream{
+		stream:      stream,
+		payloadType: payloadType,
+		opts:        o,
+		ssrc:        o.SSRC,
+		arrivals:    interarrivalJitter{clockRate: o.ClockRate},
+	}, nil
+}
+
+// Write takes a marshalled RTP packet.
+func (rs *RTPStream) Write(raw []byte) (int, error) {
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(raw); err != nil {
+		return 0, err
+	}
+	if err := rs.WriteRTP(&pkt); err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
+
+// WriteRTP takes an RTP packet. Packets with another payload type or SSRC
+// are counted and rejected with ErrUnexpectedPayloadType or
+// ErrUnexpectedSSRC.
+func (rs *RTPStream) WriteRTP(pkt *rtp.Packet) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if pkt.PayloadType != rs.payloadType {
+		rs.rejected++
+		return ErrUnexpectedPayloadType
+	}
+	if (rs.started || rs.opts.SSRC != 0) && pkt.SSRC != rs.ssrc {
+		rs.rejected++
+		return ErrUnexpectedSSRC
+	}
+
+	rs.arrivals.update(rs.opts.Clock.Now(), pkt.Timestamp)
+	inOrder := true
+	if !rs.started {
+		rs.started = true
+		rs.ssrc = pkt.SSRC
+		rs.baseSeq, rs.maxSeq = pkt.SequenceNumber, pkt.SequenceNumber
+		rs.lastTimestamp = pkt.Timestamp
+	} else if delta := int16(pkt.SequenceNumber - rs.maxSeq); delta > 0 {
+		if pkt.SequenceNumber < rs.maxSeq {
+			rs.cycles += 1 << 16
+		}
+		rs.maxSeq = pkt.SequenceNumber
+		rs.lastTimestamp = pkt.Timestamp
+	} else {
+		inOrder = false
+	}
+	rs.received++
+
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+	if pw, ok := rs.stream.(PacketWriter); ok {
+		_, err := pw.WritePacket(pkt.SequenceNumber, pkt.Timestamp, pkt.Payload)
+		return err
+	}
+	if !inOrder {
+		rs.late++
+		return nil
+	}
+	_, err := rs.stream.(io.Writer).Write(pkt.Payload)
+	return err
+}
+
+// Stats returns the reception statistics.
+func (rs *RTPStream) Stats() RTPStats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	stats := RTPStats{
+		SSRC:          rs.ssrc,
+		Received:      rs.received,
+		Late:          rs.late,
+		Rejected:      rs.rejected,
+		LastTimestamp: rs.lastTimestamp,
+		Jitter:        rs.arrivals.duration(),
+	}
+	if rs.started {
+		stats.HighestSeq = rs.cycles + uint32(rs.maxSeq)
+		expected := int64(stats.HighestSeq) - int64(rs.baseSeq) + 1
+		stats.Lost = expected - int64(rs.received)
+	}
+	return stats
+}
+
+// ReadPCM reads decoded audio from the wrapped stream. It doesn't take the
+// lock guarding the RTP state, so packets keep coming in while it decodes.
+func (rs *RTPStream) ReadPCM(dst []int16) (int, error) {
+	return rs.stream.ReadPCM(dst)
+}
+
+func (rs *RTPStream) WritePCM([]int16) (int, error) {
+	return 0, errors.New("rtp stream doesn't support write pcm")
+}
+
+func (rs *RTPStream) Format() Format {
+	return rs.stream.Format()
+}
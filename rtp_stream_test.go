@@ -0,0 +1,172 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+// packetStream is a Stream recording the packets written to it
+type packetStream struct {
+	*bufferStream
+	seqs []uint16
+}
+
+func (ps *packetStream) WritePacket(seq uint16, timestamp uint32, payload []byte) (int, error) {
+	ps.seqs = append(ps.seqs, seq)
+	return len(payload), nil
+}
+
+func rtpPacket(pt uint8, ssrc uint32, seq uint16, ts uint32, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    pt,
+			SSRC:           ssrc,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+		},
+		Payload: payload,
+	}
+}
+
+func TestRTPStream_G711(t *testing.T) {
+	g711, err := NewG711Stream("pstn", G711Type_Ulaw)
+	assert.NoError(t, err)
+	clock := NewManualClock(time.Unix(0, 0))
+	rs, err := NewRTPStream(g711, 0, RTPStreamOptions{Clock: clock})
+	assert.NoError(t, err)
+	assert.Equal(t, g711.Format(), rs.Format())
+
+	pcm := sineWave(8000, 400, 160, 8000)
+	payload := make([]byte, 160)
+	enc, _ := NewG711Encoder(G711Type_Ulaw)
+	_, err = enc.Encode(pcm, payload)
+	assert.NoError(t, err)
+
+	raw, err := rtpPacket(0, 42, 100, 1000, payload).Marshal()
+	assert.NoError(t, err)
+	n, err := rs.Write(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, len(raw), n)
+
+	assert.ErrorIs(t, rs.WriteRTP(rtpPacket(8, 42, 101, 1160, payload)), ErrUnexpectedPayloadType)
+	// the stream locked onto the first SSRC
+	assert.ErrorIs(t, rs.WriteRTP(rtpPacket(0, 43, 101, 1160, payload)), ErrUnexpectedSSRC)
+
+	dst := make([]int16, 320)
+	n, err = rs.ReadPCM(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 160, n)
+	amplitude, _ := toneFit(dst[:n], 8000, 400)
+	assert.InDelta(t, 8000, amplitude, 400)
+
+	// 102 is lost, 101 arrives late and is dropped
+	clock.Advance(20 * time.Millisecond)
+	assert.NoError(t, rs.WriteRTP(rtpPacket(0, 42, 103, 1480, payload)))
+	assert.NoError(t, rs.WriteRTP(rtpPacket(0, 42, 101, 1160, payload)))
+	_, err = rs.Write([]byte{1, 2})
+	assert.Error(t, err)
+
+	stats := rs.Stats()
+	assert.Equal(t, uint32(42), stats.SSRC)
+	assert.Equal(t, uint64(3), stats.Received)
+	assert.Equal(t, int64(1), stats.Lost)
+	assert.Equal(t, uint64(1), stats.Late)
+	assert.Equal(t, uint64(2), stats.Rejected)
+	assert.Equal(t, uint32(103), stats.HighestSeq)
+	assert.Equal(t, uint32(1480), stats.LastTimestamp)
+	n, _ = rs.ReadPCM(dst)
+	assert.Equal(t, 160, n)
+}
+
+func TestRTPStream_PacketWriter(t *testing.T) {
+	ps := &packetStream{bufferStream: newBufferStream(nil)}
+	clock := NewManualClock(time.Unix(0, 0))
+	rs, err := NewRTPStream(ps, 111, RTPStreamOptions{SSRC: 7, Clock: clock})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, rs.WriteRTP(rtpPacket(111, 8, 1, 0, []byte{1})), ErrUnexpectedSSRC)
+
+	// sequence numbers wrap around and reordered packets are passed on
+	ts := uint32(0)
+	for _, seq := range []uint16{65534, 0, 65535, 1} {
+		assert.NoError(t, rs.WriteRTP(rtpPacket(111, 7, seq, ts, []byte{1})))
+		ts += 960
+		clock.Advance(20 * time.Millisecond)
+	}
+	assert.Equal(t, []uint16{65534, 0, 65535, 1}, ps.seqs)
+	stats := rs.Stats()
+	assert.Equal(t, uint32(1<<16+1), stats.HighestSeq)
+	assert.Equal(t, int64(0), stats.Lost)
+	assert.Equal(t, uint64(0), stats.Late)
+}
+
+// slowStream is a packetStream whose ReadPCM blocks until released
+type slowStream struct {
+	*packetStream
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (ss *slowStream) ReadPCM(dst []int16) (int, error) {
+	close(ss.reading)
+	<-ss.release
+	return 0, ErrEmptyBuffer
+}
+
+func TestRTPStream_WriteWhileReading(t *testing.T) {
+	ss := &slowStream{
+		packetStream: &packetStream{bufferStream: newBufferStream(nil)},
+		reading:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	rs, err := NewRTPStream(ss, 111, RTPStreamOptions{Clock: NewManualClock(time.Unix(0, 0))})
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := rs.ReadPCM(make([]int16, 960))
+		done <- err
+	}()
+	<-ss.reading
+
+	// a packet is accepted while the wrapped stream is decoding
+	assert.NoError(t, rs.WriteRTP(rtpPacket(111, 7, 1, 0, []byte{1})))
+	assert.Equal(t, uint64(1), rs.Stats().Received)
+	close(ss.release)
+	assert.ErrorIs(t, <-done, ErrEmptyBuffer)
+}
+
+func TestRTPStream_Jitter(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	rs, err := NewRTPStream(&packetStream{bufferStream: newBufferStream(nil)}, 111, RTPStreamOptions{Clock: clock})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, rs.WriteRTP(rtpPacket(111, 1, uint16(i), uint32(i*960), nil)))
+		clock.Advance(20 * time.Millisecond)
+	}
+	assert.Equal(t, time.Duration(0), rs.Stats().Jitter)
+
+	// a packet 16ms late adds a sixteenth of it
+	clock.Advance(16 * time.Millisecond)
+	assert.NoError(t, rs.WriteRTP(rtpPacket(111, 1, 10, 9600, nil)))
+	assert.InDelta(t, time.Millisecond, rs.Stats().Jitter, float64(time.Microsecond))
+
+	// reordered packets are compared to the one that arrived before them
+	rs, err = NewRTPStream(&packetStream{bufferStream: newBufferStream(nil)}, 111, RTPStreamOptions{Clock: clock})
+	assert.NoError(t, err)
+	for _, seq := range []uint16{0, 2, 1, 3} {
+		assert.NoError(t, rs.WriteRTP(rtpPacket(111, 1, seq, uint32(seq)*960, nil)))
+		clock.Advance(20 * time.Millisecond)
+	}
+	// transit differences of 960, 1920 and 960 timestamp units
+	jitter := 960.0 / 16
+	jitter += (1920 - jitter) / 16
+	jitter += (960 - jitter) / 16
+	assert.InDelta(t, jitter/48000*float64(time.Second), rs.Stats().Jitter, float64(time.Microsecond))
+
+	_, err = NewRTPStream(&constantStream{}, 0)
+	assert.Error(t, err)
+}
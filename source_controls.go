@@ -0,0 +1,104 @@
+package avmuxer
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrSourceNotFound = errors.New("stream doesn't exist")
+
+// SetGain sets the gain of a source in dB. Changes are ramped over
+// MixerOptions.GainRampSamples to avoid zipper noise.
+func (mr *Multiplexer) SetGain(id string, dB float64) error {
+	if math.IsNaN(dB) || math.IsInf(dB, 1) {
+		return errors.New("invalid gain")
+	}
+	return mr.withSource(id, func(s *mixSource) {
+		s.level = math.Pow(10, dB/20)
+	})
+}
+
+// Gain returns the gain of a source in dB.
+func (mr *Multiplexer) Gain(id string) (float64, error) {
+	mr.RLock()
+	defer mr.RUnlock()
+	s, ok := mr.sources[id]
+	if !ok {
+		return 0, ErrSourceNotFound
+	}
+	return 20 * math.Log10(s.level), nil
+}
+
+// Mute silences a source while still draining its stream.
+func (mr *Multiplexer) Mute(id string) error {
+	return mr.withSource(id, func(s *mixSource) { s.muted = true })
+}
+
+// Unmute undoes Mute.
+func (mr *Multiplexer) Unmute(id string) error {
+	return mr.withSource(id, func(s *mixSource) { s.muted = false })
+}
+
+// Solo makes the mix contain only soloed sources. Several sources can be
+// soloed at once.
+func (mr *Multiplexer) Solo(id string) error {
+	return mr.withSource(id, func(s *mixSource) { s.solo = true })
+}
+
+// Unsolo undoes Solo.
+func (mr *Multiplexer) Unsolo(id string) error {
+	return mr.withSource(id, func(s *mixSource) { s.solo = false })
+}
+
+func (mr *Multiplexer) withSource(id string, fn func(*mixSource)) error {
+	mr.Lock()
+	defer mr.Unlock()
+	s, ok := mr.sources[id]
+	if !ok {
+		return ErrSourceNotFound
+	}
+	fn(s)
+	return nil
+}
+
+// anySolo reports whether any source is soloed. Must be called with the lock
+// held.
+func (mr *Multiplexer) anySolo() bool {
+	for _, s := range mr.sources {
+		if s.solo {
+			return true
+		}
+	}
+	return false
+}
+
+// targetGain is the gain the source should be ramping towards given whether
+// any source in the mix is soloed and whether it was left out of a top-N mix.
+func (s *mixSource) targetGain(anySolo bool) float64 {
+	if s.muted || (anySolo && !s.solo) || s.benched {
+		return 0
+	}
+	return s.level
+}
+
+// applyGain scales pcm by the source gain, moving it linearly to target over
+// rampSamples whenever the target changes.
+func (s *mixSource) applyGain(pcm []int16, target float64, rampSamples int) {
+	if target != s.rampTarget {
+		s.rampTarget = target
+		s.rampLeft = rampSamples
+	}
+	if s.rampLeft == 0 {
+		s.gain = target
+		if s.gain == 1 {
+			return
+		}
+	}
+	for i := range pcm {
+		if s.rampLeft > 0 {
+			s.gain += (s.rampTarget - s.gain) / float64(s.rampLeft)
+			s.rampLeft--
+		}
+		pcm[i] = clampInt16(int32(math.Round(float64(pcm[i]) * s.gain)))
+	}
+}
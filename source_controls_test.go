@@ -0,0 +1,75 @@
+package avmuxer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newControlledMultiplexer(t *testing.T, rampSamples int) *Multiplexer {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, GainRampSamples: rampSamples})
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 1000}))
+	assert.NoError(t, mux.AddSourceStream("b", &constantStream{value: 100}))
+	return mux
+}
+
+func TestMultiplexer_SetGain(t *testing.T) {
+	mux := newControlledMultiplexer(t, -1)
+	assert.ErrorIs(t, mux.SetGain("missing", 6), ErrSourceNotFound)
+
+	assert.NoError(t, mux.SetGain("a", -6.0206))
+	gain, err := mux.Gain("a")
+	assert.NoError(t, err)
+	assert.InDelta(t, -6.0206, gain, 1e-9)
+	assert.Equal(t, []int16{600, 600}, mux.ReadPCM(2))
+
+	assert.NoError(t, mux.SetGain("b", 20))
+	assert.Equal(t, []int16{1500, 1500}, mux.ReadPCM(2))
+}
+
+func TestMultiplexer_GainIsRamped(t *testing.T) {
+	mux := newControlledMultiplexer(t, 8)
+	assert.Equal(t, []int16{1100, 1100}, mux.ReadPCM(2))
+
+	assert.NoError(t, mux.Mute("a"))
+	pcm := mux.ReadPCM(12)
+	for i := 1; i < 8; i++ {
+		assert.Less(t, pcm[i], pcm[i-1])
+	}
+	assert.Equal(t, int16(975), pcm[0])
+	assert.Equal(t, []int16{100, 100, 100, 100}, pcm[8:])
+
+	assert.NoError(t, mux.Unmute("a"))
+	pcm = mux.ReadPCM(12)
+	assert.Equal(t, int16(225), pcm[0])
+	assert.Equal(t, []int16{1100, 1100, 1100, 1100}, pcm[8:])
+}
+
+func TestMultiplexer_MutedSourceIsStillDrained(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Strategy: MixStrategySum, GainRampSamples: -1})
+	stream := newBufferStream([]int16{5, 5, 5, 5})
+	assert.NoError(t, mux.AddSourceStream("a", stream))
+	assert.NoError(t, mux.Mute("a"))
+
+	assert.Equal(t, []int16{0, 0}, mux.ReadPCM(2))
+	assert.NoError(t, mux.Unmute("a"))
+	assert.Equal(t, []int16{5, 5}, mux.ReadPCM(2))
+	assert.Empty(t, mux.ReadPCM(2))
+}
+
+func TestMultiplexer_Solo(t *testing.T) {
+	mux := newControlledMultiplexer(t, -1)
+	assert.NoError(t, mux.AddSourceStream("c", &constantStream{value: 10}))
+
+	assert.NoError(t, mux.Solo("b"))
+	assert.Equal(t, []int16{100, 100}, mux.ReadPCM(2))
+
+	assert.NoError(t, mux.Solo("c"))
+	assert.Equal(t, []int16{110, 110}, mux.ReadPCM(2))
+	assert.Equal(t, []int16{10, 10}, mux.ReadPCMFor("b", 2))
+
+	assert.NoError(t, mux.Unsolo("b"))
+	assert.NoError(t, mux.Unsolo("c"))
+	assert.Equal(t, []int16{1110, 1110}, mux.ReadPCM(2))
+	assert.ErrorIs(t, mux.Solo("missing"), ErrSourceNotFound)
+}
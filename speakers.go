@@ -0,0 +1,129 @@
+package avmuxer
+
+import "sort"
+
+// defaultSpeakerHysteresis is how many dB louder a source has to be to take
+// a speaker's place.
+const defaultSpeakerHysteresis = 6.0
+
+// DominantSpeakerEvent reports a change of the dominant speaker, the source
+// talking loudest.
+type DominantSpeakerEvent struct {
+	// ID is the new dominant speaker, empty when the previous one was
+	// removed.
+	ID       string
+	Previous string
+}
+
+// DominantSpeaker returns the id of the dominant speaker, or "" when nobody
+// has spoken yet. The dominant speaker stays the same while everybody is
+// quiet.
+func (mr *Multiplexer) DominantSpeaker() string {
+	mr.RLock()
+	defer mr.RUnlock()
+	return mr.dominant
+}
+
+// ActiveSpeakers returns the ids of the sources selected for the mix when
+// MixerOptions.MaxSpeakers is set, in sorted order, and nil otherwise.
+func (mr *Multiplexer) ActiveSpeakers() []string {
+	mr.RLock()
+	defer mr.RUnlock()
+	if mr.maxSpeakers <= 0 {
+		return nil
+	}
+	var ids []string
+	for id, s := range mr.sources {
+		if !s.benched {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// speechLevel returns the smoothed speech level of the source in dBFS.
+func (s *mixSource) speechLevel() float64 {
+	if s.vad == nil {
+		return vadSilence
+	}
+	return s.vad.Level()
+}
+
+// selectSpeakers picks the sources mixed in the next frame when the number of
+// speakers is limited, and the dominant speaker, from the speech levels of
+// the frame just read. A source only takes the place of another one when it
+// is louder by the hysteresis, so the selection doesn't flap between voices
+// of similar levels. Must be called with the lock held.
+func (mr *Multiplexer) selectSpeakers(anySolo bool) {
+	candidates := mr.candidates[:0]
+	for _, s := range mr.sources {
+		if s.muted || (anySolo && !s.solo) {
+			s.benched = mr.maxSpeakers > 0
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		li, lj := candidates[i].speechLevel(), candidates[j].speechLevel()
+		if li != lj {
+			return li > lj
+		}
+		return candidates[i].id < candidates[j].id
+	})
+	mr.candidates = candidates
+
+	if mr.maxSpeakers > 0 {
+		mr.selectTopN(candidates)
+	}
+
+	var current, loudest *mixSource
+	for _, s := range candidates {
+		if s.id == mr.dominant {
+			current = s
+		}
+		if loudest == nil && s.vad.Speaking() {
+			loudest = s
+		}
+	}
+	if loudest == nil || loudest == current {
+		return
+	}
+	if current == nil || loudest.speechLevel() > current.speechLevel()+mr.speakerHysteresis {
+		mr.events.dominant = append(mr.events.dominant, DominantSpeakerEvent{ID: loudest.id, Previous: mr.dominant})
+		mr.dominant = loudest.id
+	}
+}
+
+// selectTopN keeps up to maxSpeakers of candidates, which are sorted loudest
+// first, in the mix.
+func (mr *Multiplexer) selectTopN(candidates []*mixSource) {
+	selected := 0
+	for _, s := range candidates {
+		if !s.benched {
+			selected++
+		}
+	}
+	for _, s := range candidates {
+		if s.benched && selected < mr.maxSpeakers {
+			s.benched = false
+			selected++
+		}
+	}
+	for {
+		// the loudest benched source against the quietest selected one
+		var in, out *mixSource
+		for _, s := range candidates {
+			if s.benched && in == nil {
+				in = s
+			}
+			if !s.benched {
+				out = s
+			}
+		}
+		if in == nil || out == nil || in.speechLevel() <= out.speechLevel()+mr.speakerHysteresis {
+			return
+		}
+		in.benched, out.benched = false, true
+	}
+}
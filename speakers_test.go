@@ -0,0 +1,71 @@
+package avmuxer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplexer_TopNSpeakers(t *testing.T) {
+	const frame = 960
+	var events []DominantSpeakerEvent
+	mux := NewMultiplexer(MixerOptions{
+		Strategy:          MixStrategySum,
+		GainRampSamples:   -1,
+		Channels:          1,
+		MaxSpeakers:       2,
+		OnDominantSpeaker: func(e DominantSpeakerEvent) { events = append(events, e) },
+	})
+	loud := voiced(48000, 20*frame, 16000)
+	// drops to a level close to quiet's, which must not flap the selection
+	medium := append(voiced(48000, 10*frame, 8000), voiced(48000, 50*frame, 5000)[10*frame:]...)
+	quiet := voiced(48000, 60*frame, 4000)
+	mono := Format{Channels: 1}
+	assert.NoError(t, mux.AddSourceStream("loud", &formatStream{newBufferStream(loud), mono}))
+	assert.NoError(t, mux.AddSourceStream("medium", &formatStream{newBufferStream(medium), mono}))
+	assert.NoError(t, mux.AddSourceStream("quiet", &formatStream{newBufferStream(quiet), mono}))
+	assert.NoError(t, mux.AddSourceStream("silent", &formatStream{newBufferStream(nil), mono}))
+	assert.Empty(t, mux.ActiveSpeakers())
+	assert.Equal(t, "", mux.DominantSpeaker())
+
+	mux.ReadPCM(frame)
+	assert.Equal(t, []string{"loud", "medium"}, mux.ActiveSpeakers())
+	assert.Equal(t, "loud", mux.DominantSpeaker())
+
+	// only the selected speakers are mixed
+	expected := make([]int16, frame)
+	for i := range expected {
+		expected[i] = loud[frame+i] + medium[frame+i]
+	}
+	assert.Equal(t, expected, mux.ReadPCM(frame))
+
+	for i := 2; i < 40; i++ {
+		mux.ReadPCM(frame)
+		if i < 20 {
+			assert.Equal(t, []string{"loud", "medium"}, mux.ActiveSpeakers(), "frame %d", i)
+		}
+	}
+	// quiet took the place of loud once it stopped, never the one of medium
+	assert.Equal(t, []string{"medium", "quiet"}, mux.ActiveSpeakers())
+	assert.Equal(t, "medium", mux.DominantSpeaker())
+	assert.Equal(t, []DominantSpeakerEvent{{ID: "loud"}, {ID: "medium", Previous: "loud"}}, events)
+
+	// a muted source gives up its place to the most recent speaker
+	assert.NoError(t, mux.Mute("quiet"))
+	mux.ReadPCM(frame)
+	assert.Equal(t, []string{"loud", "medium"}, mux.ActiveSpeakers())
+
+	events = nil
+	assert.NoError(t, mux.RemoveSourceStream("medium"))
+	assert.Equal(t, []DominantSpeakerEvent{{Previous: "medium"}}, events)
+	assert.Equal(t, "", mux.DominantSpeaker())
+}
+
+func TestMultiplexer_DominantSpeakerWithoutTopN(t *testing.T) {
+	mux := NewMultiplexer(MixerOptions{Channels: 1})
+	assert.NoError(t, mux.AddSourceStream("a", &formatStream{newBufferStream(voiced(48000, 4800, 8000)), Format{Channels: 1}}))
+	assert.NoError(t, mux.AddSourceStream("b", &formatStream{newBufferStream(nil), Format{Channels: 1}}))
+	mux.ReadPCM(960)
+	assert.Nil(t, mux.ActiveSpeakers())
+	assert.Equal(t, "a", mux.DominantSpeaker())
+}
@@ -0,0 +1,163 @@
+package avmuxer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// TrackOutputOptions configures the output of encoded audio to a local
+// WebRTC track.
+type TrackOutputOptions struct {
+	// FrameDuration is the duration of the frames PumpTrack reads. It
+	// defaults to the frame duration of the encoder of a Transcoder or
+	// Multiplexer, or 20ms when that is unknown.
+	FrameDuration time.Duration
+	// Packetizer configures the packets sent to a TrackLocalStaticRTP. The
+	// clock rate defaults to the one of the track's codec.
+	Packetizer RTPPacketizerOptions
+	// Clock paces PumpTrack, defaults to SystemClock.
+	Clock Clock
+}
+
+func (o TrackOutputOptions) withDefaults() TrackOutputOptions {
+	if o.FrameDuration == 0 {
+		o.FrameDuration = 20 * time.Millisecond
+	}
+	if o.Clock == nil {
+		o.Clock = SystemClock
+	}
+	return o
+}
+
+// trackWriter sends encoded frames to a TrackLocalStaticSample or through an
+// RTPPacketizer to a TrackLocalStaticRTP.
+type trackWriter struct {
+	sample     *webrtc.TrackLocalStaticSample
+	packetizer *RTPPacketizer
+}
+
+func newTrackWriter(track webrtc.TrackLocal, opts TrackOutputOptions) (*trackWriter, error) {
+	switch t := track.(type) {
+	case *webrtc.TrackLocalStaticSample:
+		return &trackWriter{sample: t}, nil
+	case *webrtc.TrackLocalStaticRTP:
+		if opts.Packetizer.ClockRate == 0 {
+			opts.Packetizer.ClockRate = int(t.Codec().ClockRate)
+		}
+		p, err := NewRTPPacketizer(t, opts.Packetizer)
+		if err != nil {
+			return nil, err
+		}
+		return &trackWriter{packetizer: p}, nil
+	}
+	return nil, fmt.Errorf("unsupported track %T", track)
+}
+
+// write sends a frame of duration d. Nothing is sent for an empty payload
+// or while paused, which a TrackLocalStaticRTP still skips the timestamps
+// of.
+func (tw *trackWriter) write(payload []byte, d time.Duration, paused bool) error {
+	if paused {
+		payload = nil
+	}
+	if tw.packetizer != nil {
+		return tw.packetizer.WritePayload(payload, d, paused)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return tw.sample.WriteSample(media.Sample{Data: payload, Duration: d})
+}
+
+// underrun reports whether a read failed for lack of input rather than
+// because the source broke.
+func underrun(err error) bool {
+	return errors.Is(err, ErrNoInput) || errors.Is(err, ErrEmptyBuffer) || errors.Is(err, io.EOF)
+}
+
+// encodedSource is implemented by the readers PumpTrack knows the encoder
+// format of.
+type encodedSource interface {
+	encoderFormat() Format
+}
+
+type trackSink struct {
+	w *trackWriter
+}
+
+// NewTrackSink returns a MixSink sending the encoded frames of the mixing loop
+// to a webrtc.TrackLocalStaticSample or webrtc.TrackLocalStaticRTP, which the
+// loop paces. Nothing is sent while the Multiplexer has no sources.
+func NewTrackSink(track webrtc.TrackLocal, opts ...TrackOutputOptions) (MixSink, error) {
+	var o TrackOutputOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	w, err := newTrackWriter(track, o.withDefaults())
+	if err != nil {
+		return nil, err
+	}
+	return &trackSink{w: w}, nil
+}
+
+func (s *trackSink) WriteFrame(frame MixFrame) error {
+	return s.w.write(frame.Encoded, frame.Duration, frame.Idle)
+}
+
+// PumpTrack reads an encoded frame from src every FrameDuration, scheduled
+// against the start time like the mixing loop, and sends it to a
+// webrtc.TrackLocalStaticSample or webrtc.TrackLocalStaticRTP until ctx is
+// done. src is typically a Transcoder or a Multiplexer with an encoder.
+// Sending pauses while src has nothing to read and resumes when it gets some:
+// a Transcoder without a source, a Multiplexer without sources, or a live
+// source that ran dry and returns ErrEmptyBuffer or io.EOF until its next
+// packet arrives. Any other read error stops the pump and is returned.
+func PumpTrack(ctx context.Context, src io.Reader, track webrtc.TrackLocal, opts ...TrackOutputOptions) error {
+	var o TrackOutputOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	var encoderDuration time.Duration
+	if es, ok := src.(encodedSource); ok {
+		encoderDuration = es.encoderFormat().FrameDuration
+	}
+	if o.FrameDuration == 0 {
+		o.FrameDuration = encoderDuration
+	}
+	o = o.withDefaults()
+	if o.FrameDuration < 0 {
+		return errors.New("invalid frame duration")
+	}
+	if encoderDuration != 0 && o.FrameDuration != encoderDuration {
+		return fmt.Errorf("frame duration %v doesn't match the encoder frame duration %v", o.FrameDuration, encoderDuration)
+	}
+	w, err := newTrackWriter(track, o)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxEncodedFrameSize)
+	return tickFrames(ctx, o.Clock, o.FrameDuration, func() error {
+		var n int
+		paused := false
+		if mr, ok := src.(*Multiplexer); ok {
+			paused = mr.idle()
+		}
+		if !paused {
+			var err error
+			n, err = src.Read(buf)
+			if underrun(err) {
+				paused = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return w.write(buf[:n], o.FrameDuration, paused)
+	})
+}
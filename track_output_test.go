@@ -0,0 +1,224 @@
+package avmuxer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// receivePackets connects track to a loopback peer and returns the packets
+// it receives
+func receivePackets(t *testing.T, track webrtc.TrackLocal) (<-chan *rtp.Packet, func()) {
+	offerer, answerer := newLoopbackPeers(t)
+	_, err := offerer.AddTrack(track)
+	assert.NoError(t, err)
+	packets := make(chan *rtp.Packet, 100)
+	answerer.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- pkt:
+			default:
+			}
+		}
+	})
+	connected := make(chan struct{}, 2)
+	for _, pc := range []*webrtc.PeerConnection{offerer, answerer} {
+		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			if state == webrtc.PeerConnectionStateConnected {
+				connected <- struct{}{}
+			}
+		})
+	}
+	signal(t, offerer, answerer)
+	// packets sent before DTLS completes are lost
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			t.Fatal("peers didn't connect")
+		}
+	}
+	return packets, func() {
+		_ = offerer.Close()
+		_ = answerer.Close()
+	}
+}
+
+func nextPacket(t *testing.T, packets <-chan *rtp.Packet) *rtp.Packet {
+	select {
+	case pkt := <-packets:
+		return pkt
+	case <-time.After(10 * time.Second):
+		t.Fatal("no packet received")
+		return nil
+	}
+}
+
+func newPCMUMultiplexer(t *testing.T) *Multiplexer {
+	mux := NewMultiplexer(MixerOptions{SampleRate: 8000, Channels: 1})
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddEncoder("pcmu", enc))
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 4000}))
+	return mux
+}
+
+func TestNewTrackSink(t *testing.T) {
+	_, err := NewTrackSink(nil)
+	assert.Error(t, err)
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "audio", "mix")
+	assert.NoError(t, err)
+	packets, closePeers := receivePackets(t, track)
+	defer closePeers()
+
+	mux := newPCMUMultiplexer(t)
+	sink, err := NewTrackSink(track)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddSink("track", sink))
+	assert.NoError(t, mux.Start(context.Background(), 20*time.Millisecond))
+	defer mux.Stop()
+
+	first := nextPacket(t, packets)
+	assert.Len(t, first.Payload, 160)
+	second := nextPacket(t, packets)
+	assert.Equal(t, first.SequenceNumber+1, second.SequenceNumber)
+	assert.Equal(t, first.Timestamp+160, second.Timestamp)
+}
+
+// waitPump waits for the pump to wait for its next frame.
+func waitPump(t *testing.T, clock *ManualClock) {
+	assert.Eventually(t, func() bool { return clock.Timers() == 1 }, time.Second, time.Millisecond)
+}
+
+// tickPump advances clock by a frame and waits for the pump to handle it.
+func tickPump(t *testing.T, clock *ManualClock) {
+	waitPump(t, clock)
+	clock.Advance(20 * time.Millisecond)
+	waitPump(t, clock)
+}
+
+func TestPumpTrack(t *testing.T) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, "audio", "mix")
+	assert.NoError(t, err)
+	packets, closePeers := receivePackets(t, track)
+	defer closePeers()
+	clock := NewManualClock(time.Unix(0, 0))
+
+	mux := newPCMUMultiplexer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- PumpTrack(ctx, mux, track, TrackOutputOptions{Clock: clock})
+	}()
+
+	first := nextPacket(t, packets)
+	assert.Len(t, first.Payload, 160)
+	tickPump(t, clock)
+	second := nextPacket(t, packets)
+	assert.Equal(t, first.Timestamp+160, second.Timestamp)
+	assert.False(t, second.Marker)
+
+	// the pump pauses without sources, skipping the timestamps, once the
+	// removed source faded out
+	assert.NoError(t, mux.RemoveSourceStream("a"))
+	for waitPump(t, clock); !mux.idle(); {
+		tickPump(t, clock)
+		second = nextPacket(t, packets)
+	}
+	for i := 0; i < 3; i++ {
+		tickPump(t, clock)
+	}
+	assert.NoError(t, mux.AddSourceStream("a", &constantStream{value: 4000}))
+	tickPump(t, clock)
+	resumed := nextPacket(t, packets)
+	assert.True(t, resumed.Marker)
+	assert.Equal(t, second.SequenceNumber+1, resumed.SequenceNumber)
+	assert.Equal(t, second.Timestamp+4*160, resumed.Timestamp)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestPumpTrack_LiveSource(t *testing.T) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, "audio", "live")
+	assert.NoError(t, err)
+	packets, closePeers := receivePackets(t, track)
+	defer closePeers()
+	clock := NewManualClock(time.Unix(0, 0))
+
+	source, err := NewG711Stream("live", G711Type_Ulaw)
+	assert.NoError(t, err)
+	enc, err := NewG711Encoder(G711Type_Ulaw)
+	assert.NoError(t, err)
+	transcoder := NewTranscoder()
+	assert.NoError(t, transcoder.AddSource(source))
+	assert.NoError(t, transcoder.AddEncoder(enc))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- PumpTrack(ctx, transcoder, track, TrackOutputOptions{Clock: clock})
+	}()
+
+	// the source has nothing on the first tick, the pump waits for it
+	write := func() {
+		_, err := source.(*G711Stream).Write(make([]byte, 160))
+		assert.NoError(t, err)
+	}
+	waitPump(t, clock)
+	write()
+	tickPump(t, clock)
+	first := nextPacket(t, packets)
+	assert.Len(t, first.Payload, 160)
+
+	// and again after it ran dry for a frame
+	tickPump(t, clock)
+	write()
+	tickPump(t, clock)
+	second := nextPacket(t, packets)
+	assert.True(t, second.Marker)
+	assert.Equal(t, first.SequenceNumber+1, second.SequenceNumber)
+	assert.Equal(t, first.Timestamp+2*160, second.Timestamp)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestPumpTrack_Errors(t *testing.T) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, "audio", "mix")
+	assert.NoError(t, err)
+	clock := NewManualClock(time.Unix(0, 0))
+
+	// the frame duration has to be the encoder's
+	mux := newPCMUMultiplexer(t)
+	err = PumpTrack(context.Background(), mux, track, TrackOutputOptions{FrameDuration: 10 * time.Millisecond, Clock: clock})
+	assert.Error(t, err)
+
+	// read errors other than a missing source stop the pump
+	boom := errors.New("boom")
+	err = PumpTrack(context.Background(), iotest.ErrReader(boom), track, TrackOutputOptions{Clock: clock})
+	assert.ErrorIs(t, err, boom)
+
+	// a Transcoder without a source pauses it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- PumpTrack(ctx, NewTranscoder(), track, TrackOutputOptions{Clock: clock})
+	}()
+	for i := 0; i < 3; i++ {
+		clock.Advance(20 * time.Millisecond)
+	}
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,138 @@
+package avmuxer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TrackSourceOptions configures AddTrackSource.
+type TrackSourceOptions struct {
+	// FrameDuration is the packetization time of Opus tracks, defaults to
+	// 20ms.
+	FrameDuration time.Duration
+	// Jitter configures the jitter buffer in front of the Opus decoder.
+	Jitter JitterBufferOptions
+	// AudioLevelExtensionID, when set, is the id negotiated for the RFC 6464
+	// client-to-mixer audio level extension. The levels it carries are fed
+	// to ReportAudioLevel.
+	AudioLevelExtensionID uint8
+	// OnEnd, when set, is called once the track ended and its source was
+	// removed, with the error that ended it.
+	OnEnd func(id string, err error)
+}
+
+// TrackSource is the source AddTrackSource made of a remote track.
+type TrackSource struct {
+	id     string
+	stream *RTPStream
+	done   chan struct{}
+}
+
+// ID returns the id of the source.
+func (ts *TrackSource) ID() string {
+	return ts.id
+}
+
+// Stats returns the reception statistics of the track.
+func (ts *TrackSource) Stats() RTPStats {
+	return ts.stream.Stats()
+}
+
+// Done is closed once the track ended and its source was removed.
+func (ts *TrackSource) Done() <-chan struct{} {
+	return ts.done
+}
+
+// newTrackStream creates the stream decoding the codec of a track.
+func newTrackStream(id string, codec webrtc.RTPCodecParameters, opts TrackSourceOptions) (Stream, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := int(codec.Channels)
+		if channels == 0 {
+			channels = 1
+		}
+		ms := int(opts.FrameDuration / time.Millisecond)
+		if ms == 0 {
+			ms = 20
+		}
+		if opts.Jitter.ClockRate == 0 {
+			opts.Jitter.ClockRate = int(codec.ClockRate)
+		}
+		return NewJitterBufferedOpusStream(id, int(codec.ClockRate), ms, channels, opts.Jitter)
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		return NewG711Stream(id, G711Type_Ulaw)
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		return NewG711Stream(id, G711Type_Alaw)
+	}
+	return nil, fmt.Errorf("unsupported codec %v", codec.MimeType)
+}
+
+// AddTrackSource adds the audio of a remote WebRTC track as the source id. The
+// decoder is picked from the codec negotiated for the track: Opus, PCMU or
+// PCMA. A goroutine reads the RTP packets of the track until it ends, as it
+// does when the PeerConnection closes, and then removes the source.
+func (mr *Multiplexer) AddTrackSource(id string, track *webrtc.TrackRemote, opts ...TrackSourceOptions) (*TrackSource, error) {
+	var o TrackSourceOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if track.Kind() != webrtc.RTPCodecTypeAudio {
+		return nil, errors.New("track is not audio")
+	}
+	codec := track.Codec()
+	stream, err := newTrackStream(id, codec, o)
+	if err != nil {
+		return nil, err
+	}
+	in, err := NewRTPStream(stream, uint8(codec.PayloadType), RTPStreamOptions{
+		SSRC:      uint32(track.SSRC()),
+		ClockRate: int(codec.ClockRate),
+		Clock:     mr.clock,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := mr.AddSourceStream(id, in); err != nil {
+		return nil, err
+	}
+	if err := mr.SetSourceSSRC(id, uint32(track.SSRC())); err != nil {
+		return nil, err
+	}
+
+	ts := &TrackSource{id: id, stream: in, done: make(chan struct{})}
+	go func() {
+		defer close(ts.done)
+		err := mr.readTrack(id, track, in, o)
+		if rmErr := mr.removeSourceStream(id, in); rmErr != nil && !errors.Is(rmErr, ErrSourceNotFound) {
+			log.Printf("failed to remove track source %v: %v", id, rmErr)
+		}
+		if o.OnEnd != nil {
+			o.OnEnd(id, err)
+		}
+	}()
+	return ts, nil
+}
+
+// readTrack feeds the packets of track to in until reading fails.
+func (mr *Multiplexer) readTrack(id string, track *webrtc.TrackRemote, in *RTPStream, opts TrackSourceOptions) error {
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		if opts.AudioLevelExtensionID != 0 {
+			if level, ok, err := ReadAudioLevel(pkt, opts.AudioLevelExtensionID); err == nil && ok {
+				_ = mr.ReportAudioLevel(id, level)
+			}
+		}
+		if err := in.WriteRTP(pkt); err != nil &&
+			!errors.Is(err, ErrUnexpectedPayloadType) && !errors.Is(err, ErrUnexpectedSSRC) {
+			log.Printf("failed to write packet of track source %v: %v", id, err)
+		}
+	}
+}
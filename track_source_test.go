@@ -0,0 +1,98 @@
+package avmuxer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLoopbackPeers returns two PeerConnections that connect over loopback
+func newLoopbackPeers(t *testing.T) (offerer, answerer *webrtc.PeerConnection) {
+	var se webrtc.SettingEngine
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	offerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	assert.NoError(t, err)
+	answerer, err = api.NewPeerConnection(webrtc.Configuration{})
+	assert.NoError(t, err)
+	return offerer, answerer
+}
+
+// signal runs the offer/answer exchange between two PeerConnections
+func signal(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	offer, err := offerer.CreateOffer(nil)
+	assert.NoError(t, err)
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	assert.NoError(t, offerer.SetLocalDescription(offer))
+	<-gathered
+	assert.NoError(t, answerer.SetRemoteDescription(*offerer.LocalDescription()))
+
+	answer, err := answerer.CreateAnswer(nil)
+	assert.NoError(t, err)
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	assert.NoError(t, answerer.SetLocalDescription(answer))
+	<-gathered
+	assert.NoError(t, offerer.SetRemoteDescription(*answerer.LocalDescription()))
+}
+
+func TestMultiplexer_AddTrackSource(t *testing.T) {
+	offerer, answerer := newLoopbackPeers(t)
+	defer offerer.Close()
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "audio", "test")
+	assert.NoError(t, err)
+	_, err = offerer.AddTrack(track)
+	assert.NoError(t, err)
+
+	mux := NewMultiplexer(MixerOptions{SampleRate: 8000, Channels: 1, GainRampSamples: -1})
+	sources := make(chan *TrackSource, 1)
+	ended := make(chan error, 1)
+	answerer.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		ts, err := mux.AddTrackSource("remote", remote, TrackSourceOptions{
+			OnEnd: func(id string, err error) { ended <- err },
+		})
+		assert.NoError(t, err)
+		sources <- ts
+	})
+	signal(t, offerer, answerer)
+
+	pcm := sineWave(8000, 400, 160, 8000)
+	payload := make([]byte, 160)
+	enc, _ := NewG711Encoder(G711Type_Ulaw)
+	_, err = enc.Encode(pcm, payload)
+	assert.NoError(t, err)
+
+	// the track only shows up once packets flow
+	var ts *TrackSource
+	deadline := time.After(10 * time.Second)
+	for seq := uint16(0); ts == nil || ts.Stats().Received < 5; seq++ {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 160}, Payload: payload}
+		assert.NoError(t, track.WriteRTP(pkt))
+		select {
+		case ts = <-sources:
+			assert.Equal(t, "remote", ts.ID())
+		case <-deadline:
+			t.Fatal("no audio received over loopback")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, []string{"remote"}, mux.Sources())
+
+	amplitude, _ := toneFit(mux.ReadPCM(160), 8000, 400)
+	assert.InDelta(t, 8000, amplitude, 400)
+
+	// closing the PeerConnection ends the track and removes the source
+	assert.NoError(t, answerer.Close())
+	select {
+	case <-ts.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("track source not removed")
+	}
+	assert.Error(t, <-ended)
+	assert.Empty(t, mux.Sources())
+}
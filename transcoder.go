@@ -5,11 +5,19 @@ import (
 	"io"
 )
 
+// ErrNoInput is returned when reading from a Transcoder without a source.
+var ErrNoInput = errors.New("input stream is not binded")
+
 type Transcoder struct {
 	input Stream
 
 	encoder Encoder
 	io.Reader
+
+	// conv converts the input to the sample rate and channel layout of the
+	// encoder once both are added.
+	conv   *streamConverter
+	matrix ChannelMatrix
 }
 
 func NewTranscoder() *Transcoder {
@@ -20,7 +28,14 @@ func (tc *Transcoder) AddSource(stream Stream) error {
 	if tc.input != nil {
 		return errors.New("source is already present")
 	}
+	if err := validateSource("input", stream); err != nil {
+		return err
+	}
 	tc.input = stream
+	if err := tc.configure(); err != nil {
+		tc.input = nil
+		return err
+	}
 	return nil
 }
 
@@ -28,30 +43,88 @@ func (tc *Transcoder) AddEncoder(enc Encoder) error {
 	if tc.encoder != nil {
 		return errors.New("encoder is already present")
 	}
+	// the input is converted to the encoder's rate
+	if err := validateEncoder(enc, enc.Format().rate(0)); err != nil {
+		return err
+	}
 	tc.encoder = enc
+	if err := tc.configure(); err != nil {
+		tc.encoder = nil
+		return err
+	}
 
 	return nil
 }
 
+// configure sets up the conversion of the input to the encoder's sample rate
+// and channel layout. Inputs that report neither are passed through as is.
+func (tc *Transcoder) configure() error {
+	if tc.input == nil || tc.encoder == nil {
+		return nil
+	}
+	in := tc.input.Format()
+	rate := tc.encoder.Format().rate(in.rate(0))
+	// an input without a layout is taken to be in the encoder's one, which
+	// is only needed when converting
+	channels := 0
+	if in.Channels != 0 || in.rate(rate) != rate {
+		channels = tc.encoder.ChannelCount()
+	}
+	conv, err := newStreamConverter(tc.input, rate, channels)
+	if err != nil {
+		return err
+	}
+	if tc.matrix != nil {
+		if err := conv.setMatrix(tc.matrix); err != nil {
+			return err
+		}
+	}
+	tc.conv = conv
+	return nil
+}
+
 func (tc *Transcoder) Read(dst []byte) (int, error) {
 	if tc.input == nil {
-		return 0, errors.New("input stream is not binded")
+		return 0, ErrNoInput
+	}
+	size := tc.encoder.SampleSize()
+	if tc.conv.outChannels != 0 {
+		size *= tc.conv.outChannels
 	}
-	pcm := make([]int16, tc.encoder.SampleSize())
-	n, err := tc.input.ReadPCM(pcm)
+	pcm := make([]int16, size)
+	n, err := tc.conv.read(tc.input, pcm)
 	if err != nil {
 		return 0, err
 	}
+	if n == 0 {
+		return 0, ErrEmptyBuffer
+	}
 	return tc.encoder.Encode(pcm[:n], dst)
 }
 
 func (tc *Transcoder) ReadPCM(dst []int16) (int, error) {
 	if tc.input == nil {
-		return 0, errors.New("input stream is not binded")
+		return 0, ErrNoInput
 	}
 	return tc.input.ReadPCM(dst)
 }
 
+// encoderFormat returns the format of the encoder, zero without one.
+func (tc *Transcoder) encoderFormat() Format {
+	if tc.encoder == nil {
+		return Format{}
+	}
+	return tc.encoder.Format()
+}
+
+// Format returns the format of the input.
+func (tc *Transcoder) Format() Format {
+	if tc.input == nil {
+		return Format{}
+	}
+	return tc.input.Format()
+}
+
 func (tc *Transcoder) WritePCM([]int16) (int, error) {
 	return 0, errors.New("transcoder stream doesn't support write method")
 }
@@ -30,6 +30,10 @@ func (ms *MockStream) WritePCM([]int16) (int, error) {
 	return 0, errors.New("WritePCM not supported in this mock")
 }
 
+func (ms *MockStream) Format() Format {
+	return Format{}
+}
+
 // MockEncoder is a mock implementation of the Encoder interface
 type MockEncoder struct {
 	mock.Mock
@@ -50,6 +54,10 @@ func (me *MockEncoder) ChannelCount() int {
 	return args.Int(0)
 }
 
+func (me *MockEncoder) Format() Format {
+	return Format{}
+}
+
 func TestTranscoder_AddSource(t *testing.T) {
 	transcoder := NewTranscoder()
 
@@ -102,6 +110,26 @@ func TestTranscoder_Read(t *testing.T) {
 	mockEncoder.AssertCalled(t, "Encode", mock.Anything, mock.Anything)
 }
 
+func TestTranscoder_ReadResamples(t *testing.T) {
+	transcoder := NewTranscoder()
+	wide := &formatStream{newBufferStream(sineWave(48000, 1000, 4800, 8000)), Format{SampleRate: 48000}}
+	enc, err := NewG711EncodingStream("pstn", G711Type_Ulaw)
+	assert.NoError(t, err)
+	_ = transcoder.AddSource(wide)
+	_ = transcoder.AddEncoder(enc)
+
+	dst := make([]byte, 400)
+	for i := 0; i < 5; i++ {
+		n, err := transcoder.Read(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, 160, n)
+	}
+	// 100 ms at 8 kHz consumed 100 ms at 48 kHz
+	assert.Equal(t, 0, wide.Len())
+	_, err = transcoder.Read(dst)
+	assert.Error(t, err)
+}
+
 func TestTranscoder_ReadPCM(t *testing.T) {
 	transcoder := NewTranscoder()
 
@@ -18,3 +18,27 @@ func ByteSliceToInt16(samples []byte) []int16 {
 	}
 	return pcm
 }
+
+// resizeInt32 returns buf with length n and every element zeroed, reusing the
+// underlying array when it is large enough
+func resizeInt32(buf []int32, n int) []int32 {
+	if cap(buf) < n {
+		return make([]int32, n)
+	}
+	buf = buf[:n]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return buf
+}
+
+// clampInt16 saturates v to the int16 range
+func clampInt16(v int32) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
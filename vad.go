@@ -0,0 +1,413 @@
+package avmuxer
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+	"time"
+)
+
+const (
+	defaultVADEnergyThreshold   = -50.0
+	defaultVADNoiseMargin       = 10.0
+	defaultVADFlatnessThreshold = 0.35
+	defaultVADZeroCrossings     = 5000
+	defaultVADOnset             = 20 * time.Millisecond
+	defaultVADHangover          = 300 * time.Millisecond
+	defaultVADLevelSmoothing    = 200 * time.Millisecond
+
+	// vadNoiseRise is how fast in dB per second the noise floor estimate
+	// follows a rising level, it drops to a lower level at once.
+	vadNoiseRise = 3.0
+	// vadSilence is the level in dBFS of digital silence.
+	vadSilence = -96.0
+	// vadMaxFFTSize caps the block the spectral flatness is measured on.
+	vadMaxFFTSize = 512
+	// vadReportTimeout is how long a level reported with Report is used
+	// before the VAD falls back to analysing the audio.
+	vadReportTimeout = 100 * time.Millisecond
+	// vadBandLow and vadBandHigh bound the band the spectral flatness is
+	// measured in.
+	vadBandLow  = 100
+	vadBandHigh = 8000
+)
+
+// VADOptions configures voice activity detection. Zero fields take their
+// defaults.
+type VADOptions struct {
+	// EnergyThreshold is the level in dBFS under which audio is never
+	// speech. Defaults to -50 dBFS.
+	EnergyThreshold float64
+	// NoiseMargin is how many dB above the estimated noise floor speech has
+	// to be. Defaults to 10 dB.
+	NoiseMargin float64
+	// FlatnessThreshold is the spectral flatness, between 0 for a pure tone
+	// and 1 for white noise, from which audio is taken for noise. Defaults
+	// to 0.35.
+	FlatnessThreshold float64
+	// ZeroCrossingThreshold is the number of zero crossings per second from
+	// which audio is taken for noise. Defaults to 5000.
+	ZeroCrossingThreshold float64
+	// Onset is how long speech has to last before it is reported. Defaults
+	// to 20ms.
+	Onset time.Duration
+	// Hangover is how long speech is still reported after the last frame
+	// that sounded like it, which bridges the pauses between words.
+	// Defaults to 300ms.
+	Hangover time.Duration
+	// LevelSmoothing is the time constant of the speech level reported by
+	// Level. Defaults to 200ms.
+	LevelSmoothing time.Duration
+}
+
+func (o VADOptions) withDefaults() VADOptions {
+	if o.EnergyThreshold == 0 {
+		o.EnergyThreshold = defaultVADEnergyThreshold
+	}
+	if o.NoiseMargin == 0 {
+		o.NoiseMargin = defaultVADNoiseMargin
+	}
+	if o.FlatnessThreshold == 0 {
+		o.FlatnessThreshold = defaultVADFlatnessThreshold
+	}
+	if o.ZeroCrossingThreshold == 0 {
+		o.ZeroCrossingThreshold = defaultVADZeroCrossings
+	}
+	if o.Onset == 0 {
+		o.Onset = defaultVADOnset
+	}
+	if o.Hangover == 0 {
+		o.Hangover = defaultVADHangover
+	}
+	if o.LevelSmoothing == 0 {
+		o.LevelSmoothing = defaultVADLevelSmoothing
+	}
+	return o
+}
+
+// vadFeatures are the measurements a frame is classified by.
+type vadFeatures struct {
+	// energy is the RMS level in dBFS.
+	energy float64
+	// zeroCrossings is the number of zero crossings per second.
+	zeroCrossings float64
+	// flatness is the spectral flatness, 1 when there is too little audio
+	// to measure it.
+	flatness float64
+}
+
+// VAD detects speech in a stream of PCM frames from its level, zero crossing
+// rate and spectral flatness.
+type VAD struct {
+	opts       VADOptions
+	sampleRate int
+	channels   int
+
+	noise    float64
+	level    float64
+	speaking bool
+	// speech is how long the current run of speech frames lasts, silence
+	// how long it has been since the last one.
+	speech  time.Duration
+	silence time.Duration
+
+	// report is the last level reported by the sender and reportAge how
+	// long it has been used. timedReports is set while the reports are fed
+	// with reportFor, which times them itself.
+	report       *AudioLevel
+	reportAge    time.Duration
+	timedReports bool
+
+	mono     []float64
+	spectrum []complex128
+}
+
+// NewVAD creates a VAD for interleaved PCM at sampleRate with the given
+// number of channels, optionally configured by opts.
+func NewVAD(sampleRate, channels int, opts ...VADOptions) *VAD {
+	var o VADOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return &VAD{
+		opts:       o.withDefaults(),
+		sampleRate: sampleRate,
+		channels:   max(channels, 1),
+		noise:      vadSilence,
+		level:      vadSilence,
+	}
+}
+
+// Speaking reports whether speech is ongoing.
+func (v *VAD) Speaking() bool {
+	return v.speaking
+}
+
+// Level returns the level of the speech in dBFS, smoothed over
+// VADOptions.LevelSmoothing. Frames that are not speech count as silence, so
+// a loud but steady background doesn't raise it.
+func (v *VAD) Level() float64 {
+	return v.level
+}
+
+// Report feeds the VAD the level and voice flag of the audio to come as
+// reported by its sender, such as in an RFC 6464 audio level header
+// extension. The following frames are classified from the report rather than
+// analysed until no report arrived for 100ms.
+func (v *VAD) Report(level uint8, voice bool) {
+	v.report = &AudioLevel{Level: level, Voice: voice}
+	v.reportAge = 0
+	v.timedReports = false
+}
+
+// reportFor feeds the VAD a reported level d after the previous report,
+// without waiting for frames to be processed. The previous report classifies
+// the time in between, up to 100ms after which it counts as silence, and the
+// new one the time until the next report. Frames processed while reports keep
+// arriving leave the classification alone.
+func (v *VAD) reportFor(level uint8, voice bool, d time.Duration) (speaking, changed bool) {
+	was := v.speaking
+	if v.report != nil && v.timedReports {
+		held := min(d, vadReportTimeout)
+		v.update(v.reportedEnergy(), v.report.Voice, held)
+		if d > held {
+			v.update(vadSilence, false, d-held)
+		}
+	}
+	v.report = &AudioLevel{Level: level, Voice: voice}
+	v.reportAge = 0
+	v.timedReports = true
+	return v.speaking, v.speaking != was
+}
+
+// reportedEnergy returns the level of the last report in dBFS.
+func (v *VAD) reportedEnergy() float64 {
+	return math.Max(vadSilence, -float64(v.report.Level))
+}
+
+// Process analyses a frame and reports whether speech is ongoing and whether
+// that changed with this frame.
+func (v *VAD) Process(pcm []int16) (speaking, changed bool) {
+	return v.process(pcm, len(pcm))
+}
+
+// process analyses pcm as a frame of frameSamples interleaved samples, the
+// ones missing being silence.
+func (v *VAD) process(pcm []int16, frameSamples int) (speaking, changed bool) {
+	if v.sampleRate <= 0 || frameSamples <= 0 {
+		return v.speaking, false
+	}
+	d := time.Duration(frameSamples/v.channels) * time.Second / time.Duration(v.sampleRate)
+	var f vadFeatures
+	var isSpeech bool
+	if v.report != nil && v.reportAge < vadReportTimeout {
+		v.reportAge += d
+		if v.timedReports {
+			return v.speaking, false
+		}
+		f.energy = v.reportedEnergy()
+		isSpeech = v.report.Voice
+	} else {
+		v.report = nil
+		v.timedReports = false
+		f = v.analyze(pcm)
+		if f.energy < v.noise {
+			v.noise = f.energy
+		} else {
+			v.noise = math.Min(f.energy, v.noise+vadNoiseRise*d.Seconds())
+		}
+		isSpeech = f.energy > v.opts.EnergyThreshold &&
+			f.energy > v.noise+v.opts.NoiseMargin &&
+			f.flatness < v.opts.FlatnessThreshold &&
+			f.zeroCrossings < v.opts.ZeroCrossingThreshold
+	}
+	was := v.speaking
+	v.update(f.energy, isSpeech, d)
+	return v.speaking, v.speaking != was
+}
+
+// update moves the speech state and level on by d of audio at energy dBFS,
+// classified as speech or not.
+func (v *VAD) update(energy float64, isSpeech bool, d time.Duration) {
+	if isSpeech {
+		v.speech += d
+		v.silence = 0
+	} else {
+		v.speech = 0
+		v.silence += d
+	}
+
+	switch {
+	case !v.speaking && v.speech >= v.opts.Onset:
+		v.speaking = true
+	case v.speaking && v.silence > v.opts.Hangover:
+		v.speaking = false
+	}
+
+	target := vadSilence
+	if v.speaking {
+		target = energy
+	}
+	v.level += (target - v.level) * (1 - math.Exp(-d.Seconds()/v.opts.LevelSmoothing.Seconds()))
+}
+
+func (v *VAD) analyze(pcm []int16) vadFeatures {
+	n := len(pcm) / v.channels
+	if n == 0 {
+		return vadFeatures{energy: vadSilence, flatness: 1}
+	}
+	if cap(v.mono) < n {
+		v.mono = make([]float64, n)
+	}
+	mono := v.mono[:n]
+	var mean float64
+	for i := range mono {
+		var s float64
+		for c := 0; c < v.channels; c++ {
+			s += float64(pcm[i*v.channels+c])
+		}
+		mono[i] = s / float64(v.channels)
+		mean += mono[i]
+	}
+	mean /= float64(n)
+
+	// a DC offset is neither speech nor noise
+	var sum float64
+	crossings := 0
+	for i := range mono {
+		mono[i] -= mean
+		sum += mono[i] * mono[i]
+		if i > 0 && (mono[i] < 0) != (mono[i-1] < 0) {
+			crossings++
+		}
+	}
+	rms := math.Sqrt(sum / float64(n))
+	energy := vadSilence
+	if rms > 0 {
+		energy = math.Max(vadSilence, 20*math.Log10(rms/32768))
+	}
+	return vadFeatures{
+		energy:        energy,
+		zeroCrossings: float64(crossings) * float64(v.sampleRate) / float64(n),
+		flatness:      v.flatness(mono),
+	}
+}
+
+// flatness returns the spectral flatness, the ratio of the geometric to the
+// arithmetic mean of the power spectrum, of the start of mono.
+func (v *VAD) flatness(mono []float64) float64 {
+	size := 1
+	for size*2 <= len(mono) && size*2 <= vadMaxFFTSize {
+		size *= 2
+	}
+	lo := vadBandLow * size / v.sampleRate
+	hi := min(vadBandHigh*size/v.sampleRate, size/2)
+	lo = max(lo, 1)
+	if hi-lo < 4 {
+		return 1
+	}
+
+	if cap(v.spectrum) < size {
+		v.spectrum = make([]complex128, size)
+	}
+	spectrum := v.spectrum[:size]
+	for i := range spectrum {
+		// Hann window
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size))
+		spectrum[i] = complex(mono[i]*w, 0)
+	}
+	fft(spectrum)
+
+	var logSum, sum float64
+	for _, c := range spectrum[lo:hi] {
+		p := real(c)*real(c) + imag(c)*imag(c) + 1e-9
+		logSum += math.Log(p)
+		sum += p
+	}
+	bins := float64(hi - lo)
+	return math.Exp(logSum/bins) / (sum / bins)
+}
+
+// fft transforms x in place, len(x) has to be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// SpeechEvent reports a source starting or stopping to speak.
+type SpeechEvent struct {
+	ID       string
+	Speaking bool
+}
+
+// IsSpeaking reports whether voice activity detection currently hears speech
+// from the source id. Muting a source doesn't stop it from being detected.
+func (mr *Multiplexer) IsSpeaking(id string) bool {
+	mr.RLock()
+	defer mr.RUnlock()
+	s, ok := mr.sources[id]
+	return ok && s.vad != nil && s.vad.Speaking()
+}
+
+// mixEvents are the events queued while mixing.
+type mixEvents struct {
+	speech   []SpeechEvent
+	dominant []DominantSpeakerEvent
+}
+
+// queueSpeechEvents queues an event for every source whose speech started or
+// stopped with the current frame, in id order. Must be called with the lock
+// held.
+func (mr *Multiplexer) queueSpeechEvents() {
+	start := len(mr.events.speech)
+	for id, s := range mr.sources {
+		if s.speechChanged {
+			mr.events.speech = append(mr.events.speech, SpeechEvent{ID: id, Speaking: s.vad.Speaking()})
+		}
+	}
+	queued := mr.events.speech[start:]
+	sort.Slice(queued, func(i, j int) bool { return queued[i].ID < queued[j].ID })
+}
+
+// takeEvents returns the events queued since the last call. Must be called
+// with the lock held.
+func (mr *Multiplexer) takeEvents() mixEvents {
+	events := mr.events
+	mr.events = mixEvents{}
+	return events
+}
+
+// emit delivers events to MixerOptions.OnSpeech and OnDominantSpeaker. It
+// must be called without the lock so the callbacks can use the Multiplexer.
+func (mr *Multiplexer) emit(events mixEvents) {
+	if mr.onSpeech != nil {
+		for _, e := range events.speech {
+			mr.onSpeech(e)
+		}
+	}
+	if mr.onDominantSpeaker != nil {
+		for _, e := range events.dominant {
+			mr.onDominantSpeaker(e)
+		}
+	}
+}
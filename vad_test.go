@@ -0,0 +1,176 @@
+package avmuxer
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// voiced returns samples of a vowel-like sound: a 150 Hz fundamental with
+// harmonics falling off by 6 dB per octave
+func voiced(rate, samples int, amplitude float64) []int16 {
+	pcm := make([]int16, samples)
+	for i := range pcm {
+		var v float64
+		for h := 1; h*150 < rate/2 && h <= 20; h++ {
+			v += math.Sin(2*math.Pi*float64(h*150)*float64(i)/float64(rate)) / float64(h)
+		}
+		pcm[i] = int16(amplitude * v / 2)
+	}
+	return pcm
+}
+
+func whiteNoise(samples int, amplitude float64) []int16 {
+	r := rand.New(rand.NewSource(1))
+	pcm := make([]int16, samples)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * (2*r.Float64() - 1))
+	}
+	return pcm
+}
+
+func TestFFT(t *testing.T) {
+	x := make([]complex128, 8)
+	x[0] = 1
+	fft(x)
+	for _, c := range x {
+		assert.InDelta(t, 1, real(c), 1e-12)
+		assert.InDelta(t, 0, imag(c), 1e-12)
+	}
+
+	for i := range x {
+		x[i] = complex(math.Cos(2*math.Pi*2*float64(i)/8), 0)
+	}
+	fft(x)
+	for i, c := range x {
+		if i == 2 || i == 6 {
+			assert.InDelta(t, 4, cmplx.Abs(c), 1e-9)
+		} else {
+			assert.InDelta(t, 0, cmplx.Abs(c), 1e-9)
+		}
+	}
+}
+
+func TestVAD_Features(t *testing.T) {
+	for _, rate := range []int{8000, 16000, 48000} {
+		v := NewVAD(rate, 1)
+		f := v.analyze(voiced(rate, rate/50, 8000))
+		assert.Less(t, f.flatness, defaultVADFlatnessThreshold, "voice at %d Hz", rate)
+		assert.Less(t, f.zeroCrossings, float64(defaultVADZeroCrossings), "voice at %d Hz", rate)
+		assert.Greater(t, f.energy, defaultVADEnergyThreshold)
+
+		f = v.analyze(whiteNoise(rate/50, 8000))
+		assert.Greater(t, f.flatness, defaultVADFlatnessThreshold, "noise at %d Hz", rate)
+	}
+
+	v := NewVAD(48000, 2)
+	f := v.analyze(make([]int16, 1920))
+	assert.Equal(t, vadSilence, f.energy)
+	assert.Equal(t, vadSilence, v.analyze(nil).energy)
+	// a DC offset is not speech
+	assert.Equal(t, vadSilence, v.analyze(interleave(960, 16384, 16384)).energy)
+}
+
+func TestVAD_SpeechAndHangover(t *testing.T) {
+	v := NewVAD(48000, 1, VADOptions{Hangover: 100 * time.Millisecond})
+	silence := make([]int16, 960)
+	speech := voiced(48000, 960, 8000)
+
+	for i := 0; i < 5; i++ {
+		speaking, changed := v.Process(silence)
+		assert.False(t, speaking)
+		assert.False(t, changed)
+	}
+	speaking, changed := v.Process(speech)
+	assert.True(t, speaking)
+	assert.True(t, changed)
+	speaking, changed = v.Process(speech)
+	assert.True(t, speaking)
+	assert.False(t, changed)
+
+	// 100ms of hangover bridges five silent frames
+	for i := 0; i < 5; i++ {
+		speaking, _ = v.Process(silence)
+		assert.True(t, speaking)
+	}
+	speaking, changed = v.Process(silence)
+	assert.False(t, speaking)
+	assert.True(t, changed)
+	assert.False(t, v.Speaking())
+}
+
+func TestVAD_Onset(t *testing.T) {
+	v := NewVAD(16000, 1, VADOptions{Onset: 60 * time.Millisecond})
+	speech := voiced(16000, 320, 8000)
+	for i := 0; i < 2; i++ {
+		speaking, _ := v.Process(speech)
+		assert.False(t, speaking)
+	}
+	// a single click resets the onset
+	v.Process(make([]int16, 320))
+	for i := 0; i < 2; i++ {
+		speaking, _ := v.Process(speech)
+		assert.False(t, speaking)
+	}
+	speaking, _ := v.Process(speech)
+	assert.True(t, speaking)
+}
+
+func TestVAD_RejectsNoiseAndQuietAudio(t *testing.T) {
+	v := NewVAD(48000, 1)
+	noise := whiteNoise(960, 3000)
+	quiet := voiced(48000, 960, 50)
+	for i := 0; i < 50; i++ {
+		speaking, _ := v.Process(noise)
+		assert.False(t, speaking)
+		speaking, _ = v.Process(quiet)
+		assert.False(t, speaking)
+	}
+}
+
+func TestMultiplexer_SpeechEvents(t *testing.T) {
+	var events []SpeechEvent
+	var mux *Multiplexer
+	mux = NewMultiplexer(MixerOptions{
+		VAD: VADOptions{Hangover: 40 * time.Millisecond},
+		// the callback runs without the lock held
+		OnSpeech: func(e SpeechEvent) {
+			assert.Equal(t, e.Speaking, mux.IsSpeaking(e.ID))
+			events = append(events, e)
+		},
+	})
+	talker := &formatStream{newBufferStream(voiced(48000, 4800, 8000)), Format{SampleRate: 48000, Channels: 1}}
+	assert.NoError(t, mux.AddSourceStream("talker", talker))
+	assert.NoError(t, mux.AddSourceStream("quiet", &formatStream{newBufferStream(nil), Format{Channels: 1}}))
+	assert.NoError(t, mux.Mute("talker"))
+
+	assert.False(t, mux.IsSpeaking("talker"))
+	mux.ReadPCM(1920)
+	// muted sources are still detected
+	assert.True(t, mux.IsSpeaking("talker"))
+	assert.False(t, mux.IsSpeaking("quiet"))
+	assert.False(t, mux.IsSpeaking("missing"))
+	assert.Equal(t, []SpeechEvent{{ID: "talker", Speaking: true}}, events)
+
+	// 100ms of speech followed by the hangover
+	for i := 0; i < 4; i++ {
+		mux.ReadPCM(1920)
+	}
+	assert.True(t, mux.IsSpeaking("talker"))
+	for i := 0; i < 3; i++ {
+		mux.ReadPCM(1920)
+	}
+	assert.False(t, mux.IsSpeaking("talker"))
+	assert.Equal(t, []SpeechEvent{{ID: "talker", Speaking: true}, {ID: "talker"}}, events)
+
+	// removing a talking source ends its speech
+	events = nil
+	assert.NoError(t, mux.ReplaceSourceStream("talker", &formatStream{newBufferStream(voiced(48000, 4800, 8000)), Format{Channels: 1}}))
+	mux.ReadPCM(1920)
+	assert.NoError(t, mux.RemoveSourceStream("talker"))
+	assert.Equal(t, []SpeechEvent{{ID: "talker", Speaking: true}, {ID: "talker"}}, events)
+}
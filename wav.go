@@ -0,0 +1,143 @@
+package avmuxer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/zaf/g711"
+)
+
+// WAV format tags
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatAlaw       = 0x0006
+	wavFormatMulaw      = 0x0007
+	wavFormatExtensible = 0xfffe
+)
+
+// wavUnknownSize is the chunk size written by recorders that cannot go back
+// to patch it, the chunk then runs to the end of the file.
+const wavUnknownSize = 0xffffffff
+
+// WAVEncoding is the encoding of the samples of a WAV file.
+type WAVEncoding int
+
+const (
+	WAVEncodingPCM16 WAVEncoding = iota + 1
+	WAVEncodingPCM24
+	WAVEncodingFloat32
+	WAVEncodingAlaw
+	WAVEncodingUlaw
+)
+
+func (e WAVEncoding) String() string {
+	switch e {
+	case WAVEncodingPCM16:
+		return "pcm16"
+	case WAVEncodingPCM24:
+		return "pcm24"
+	case WAVEncodingFloat32:
+		return "float32"
+	case WAVEncodingAlaw:
+		return "alaw"
+	case WAVEncodingUlaw:
+		return "ulaw"
+	}
+	return fmt.Sprintf("WAVEncoding(%d)", int(e))
+}
+
+// wavEncoding returns the encoding of a format tag and sample size.
+func wavEncoding(tag, bits uint16) (WAVEncoding, error) {
+	switch {
+	case tag == wavFormatPCM && bits == 16:
+		return WAVEncodingPCM16, nil
+	case tag == wavFormatPCM && bits == 24:
+		return WAVEncodingPCM24, nil
+	case tag == wavFormatFloat && bits == 32:
+		return WAVEncodingFloat32, nil
+	case tag == wavFormatAlaw && bits == 8:
+		return WAVEncodingAlaw, nil
+	case tag == wavFormatMulaw && bits == 8:
+		return WAVEncodingUlaw, nil
+	}
+	return 0, fmt.Errorf("unsupported wav format 0x%04x with %d bit samples", tag, bits)
+}
+
+// tag returns the format tag of the encoding.
+func (e WAVEncoding) tag() uint16 {
+	switch e {
+	case WAVEncodingFloat32:
+		return wavFormatFloat
+	case WAVEncodingAlaw:
+		return wavFormatAlaw
+	case WAVEncodingUlaw:
+		return wavFormatMulaw
+	}
+	return wavFormatPCM
+}
+
+// sampleSize returns the number of bytes of a sample.
+func (e WAVEncoding) sampleSize() int {
+	switch e {
+	case WAVEncodingPCM16:
+		return 2
+	case WAVEncodingPCM24:
+		return 3
+	case WAVEncodingFloat32:
+		return 4
+	}
+	return 1
+}
+
+// decode converts the samples of src to dst, which holds one sample per
+// sampleSize bytes of src.
+func (e WAVEncoding) decode(src []byte, dst []int16) {
+	switch e {
+	case WAVEncodingPCM16:
+		for i := range dst {
+			dst[i] = int16(binary.LittleEndian.Uint16(src[i*2:]))
+		}
+	case WAVEncodingPCM24:
+		// the lowest byte is dropped
+		for i := range dst {
+			dst[i] = int16(binary.LittleEndian.Uint16(src[i*3+1:]))
+		}
+	case WAVEncodingFloat32:
+		for i := range dst {
+			f := float64(math.Float32frombits(binary.LittleEndian.Uint32(src[i*4:])))
+			if math.IsNaN(f) {
+				f = 0
+			}
+			dst[i] = int16(max(-32768, min(32767, math.Round(f*32768))))
+		}
+	case WAVEncodingAlaw:
+		for i := range dst {
+			dst[i] = g711.DecodeAlawFrame(src[i])
+		}
+	case WAVEncodingUlaw:
+		for i := range dst {
+			dst[i] = g711.DecodeUlawFrame(src[i])
+		}
+	}
+}
+
+// encode appends the samples of src to dst.
+func (e WAVEncoding) encode(dst []byte, src []int16) []byte {
+	for _, v := range src {
+		switch e {
+		case WAVEncodingPCM16:
+			dst = binary.LittleEndian.AppendUint16(dst, uint16(v))
+		case WAVEncodingPCM24:
+			dst = append(dst, 0, byte(v), byte(v>>8))
+		case WAVEncodingFloat32:
+			dst = binary.LittleEndian.AppendUint32(dst, math.Float32bits(float32(v)/32768))
+		case WAVEncodingAlaw:
+			dst = append(dst, g711.EncodeAlawFrame(v))
+		case WAVEncodingUlaw:
+			dst = append(dst, g711.EncodeUlawFrame(v))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,284 @@
+package avmuxer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrInvalidWAV = errors.New("invalid wav file")
+
+// WAVStreamOptions configures a WAVStream.
+type WAVStreamOptions struct {
+	// Loop restarts the stream from the beginning when it ends, which
+	// requires a seekable reader.
+	Loop bool
+}
+
+// WAVStream is a Stream reading the audio of a RIFF/WAVE file, 16 or 24 bit
+// PCM, 32 bit float, A-law or µ-law.
+type WAVStream struct {
+	mu sync.Mutex
+
+	r      io.Reader
+	closer io.Closer
+	br     *bufio.Reader
+	// dataOffset is the offset of the audio, dataSize its size or -1 when
+	// it runs to the end of the file.
+	dataOffset int64
+	dataSize   int64
+
+	encoding   WAVEncoding
+	sampleRate int
+	channels   int
+	blockAlign int
+	loop       bool
+
+	buf      []byte
+	read     int64
+	position int64
+	ended    bool
+}
+
+// NewWAVFileStream opens the WAV file at path as a Stream. The file is closed
+// by Close.
+func NewWAVFileStream(path string, opts ...WAVStreamOptions) (*WAVStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewWAVStream(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// NewWAVStream reads a WAV file from r as a Stream. Looping and Seek need r to
+// be an io.Seeker.
+func NewWAVStream(r io.Reader, opts ...WAVStreamOptions) (*WAVStream, error) {
+	var o WAVStreamOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if _, ok := r.(io.Seeker); o.Loop && !ok {
+		return nil, ErrNotSeekable
+	}
+	s := &WAVStream{r: r, br: bufio.NewReader(r), loop: o.Loop}
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readHeader parses the chunks up to the data chunk, skipping the ones it
+// doesn't know.
+func (s *WAVStream) readHeader() error {
+	var riff [12]byte
+	if _, err := io.ReadFull(s.br, riff[:]); err != nil {
+		return ErrInvalidWAV
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return ErrInvalidWAV
+	}
+	offset := int64(len(riff))
+	haveFormat := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(s.br, header[:]); err != nil {
+			return ErrInvalidWAV
+		}
+		offset += int64(len(header))
+		id := string(header[:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+
+		if id == "data" {
+			if !haveFormat {
+				return ErrInvalidWAV
+			}
+			s.dataOffset, s.dataSize = offset, size
+			if size == wavUnknownSize {
+				s.dataSize = -1
+			}
+			return nil
+		}
+		if size == wavUnknownSize {
+			return ErrInvalidWAV
+		}
+		// chunks are padded to an even size
+		padded := size + size&1
+		if id != "fmt " {
+			if _, err := s.br.Discard(int(padded)); err != nil {
+				return ErrInvalidWAV
+			}
+			offset += padded
+			continue
+		}
+
+		if size < 16 || size > 1024 {
+			return ErrInvalidWAV
+		}
+		chunk := make([]byte, padded)
+		if _, err := io.ReadFull(s.br, chunk); err != nil {
+			return ErrInvalidWAV
+		}
+		offset += padded
+		if err := s.parseFormat(chunk[:size]); err != nil {
+			return err
+		}
+		haveFormat = true
+	}
+}
+
+// parseFormat parses the fmt chunk.
+func (s *WAVStream) parseFormat(chunk []byte) error {
+	tag := binary.LittleEndian.Uint16(chunk[0:2])
+	channels := int(binary.LittleEndian.Uint16(chunk[2:4]))
+	rate := int(binary.LittleEndian.Uint32(chunk[4:8]))
+	blockAlign := int(binary.LittleEndian.Uint16(chunk[12:14]))
+	bits := binary.LittleEndian.Uint16(chunk[14:16])
+	if tag == wavFormatExtensible {
+		// the format tag is the start of the sub format GUID
+		if len(chunk) < 40 {
+			return ErrInvalidWAV
+		}
+		tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+	encoding, err := wavEncoding(tag, bits)
+	if err != nil {
+		return err
+	}
+	if channels == 0 || rate == 0 || blockAlign != channels*encoding.sampleSize() {
+		return ErrInvalidWAV
+	}
+	s.encoding, s.sampleRate, s.channels, s.blockAlign = encoding, rate, channels, blockAlign
+	return nil
+}
+
+// Encoding returns the encoding of the samples of the file.
+func (s *WAVStream) Encoding() WAVEncoding {
+	return s.encoding
+}
+
+func (s *WAVStream) SampleRate() int {
+	return s.sampleRate
+}
+
+func (s *WAVStream) ChannelCount() int {
+	return s.channels
+}
+
+func (s *WAVStream) Format() Format {
+	return pcmFormat(s.sampleRate, s.channels, 0)
+}
+
+// Position returns the position in the audio of the next sample ReadPCM
+// returns.
+func (s *WAVStream) Position() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.position) * time.Second / time.Duration(s.sampleRate)
+}
+
+// Seek moves the stream to the position d in the audio. Seeking past the end
+// ends the stream.
+func (s *WAVStream) Seek(d time.Duration) error {
+	if d < 0 {
+		return errors.New("invalid seek position")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seek(int64(d) * int64(s.sampleRate) / int64(time.Second))
+}
+
+// seek moves the stream to the given sample frame. Must be called with the
+// lock held.
+func (s *WAVStream) seek(frame int64) error {
+	seeker, ok := s.r.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	offset := frame * int64(s.blockAlign)
+	if s.dataSize >= 0 {
+		offset = min(offset, s.dataSize)
+	}
+	if _, err := seeker.Seek(s.dataOffset+offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.br.Reset(s.r)
+	s.read, s.position = offset, offset/int64(s.blockAlign)
+	s.ended = false
+	return nil
+}
+
+// ReadPCM reads the samples of whole frames that fit in dst. It returns io.EOF
+// once the stream ended, unless it loops.
+func (s *WAVStream) ReadPCM(dst []int16) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for frames := len(dst) / s.channels; n < frames && !s.ended; {
+		read, err := s.readFrames(dst[n*s.channels : frames*s.channels])
+		n += read
+		// seek resets the position, so it is advanced per read
+		s.position += int64(read)
+		if err == io.EOF && s.loop && (read > 0 || s.read > 0) {
+			err = s.seek(0)
+		} else if err == io.EOF {
+			s.ended = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if n == 0 && s.ended {
+		return 0, io.EOF
+	}
+	return n * s.channels, nil
+}
+
+// readFrames decodes the frames that fit in dst, returning io.EOF at the end
+// of the audio. Must be called with the lock held.
+func (s *WAVStream) readFrames(dst []int16) (int, error) {
+	size := len(dst) / s.channels * s.blockAlign
+	if s.dataSize >= 0 {
+		size = int(min(int64(size), s.dataSize-s.read))
+	}
+	if size == 0 {
+		return 0, io.EOF
+	}
+	if cap(s.buf) < size {
+		s.buf = make([]byte, size)
+	}
+	n, err := io.ReadFull(s.br, s.buf[:size])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	// a truncated file ends with the last whole frame
+	frames := n / s.blockAlign
+	s.read += int64(frames * s.blockAlign)
+	s.encoding.decode(s.buf[:frames*s.blockAlign], dst[:frames*s.channels])
+	if err == nil && frames == 0 {
+		err = io.EOF
+	}
+	return frames, err
+}
+
+func (s *WAVStream) WritePCM([]int16) (int, error) {
+	return 0, errors.New("wav stream doesn't support write pcm")
+}
+
+// Close closes the file of a stream created by NewWAVFileStream.
+func (s *WAVStream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
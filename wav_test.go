@@ -0,0 +1,223 @@
+package avmuxer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stereoTone returns a 440 Hz tone on the left channel and silence on the
+// right one
+func stereoTone(rate, frames int) []int16 {
+	tone := sineWave(rate, 440, frames, 8000)
+	pcm := make([]int16, frames*2)
+	for i, v := range tone {
+		pcm[i*2] = v
+	}
+	return pcm
+}
+
+func TestWAVWriter(t *testing.T) {
+	_, err := NewWAVWriter(io.Discard, WAVWriterOptions{Encoding: 9})
+	assert.Error(t, err)
+
+	for _, tc := range []struct {
+		encoding WAVEncoding
+		exact    bool
+		header   int
+	}{
+		{WAVEncodingPCM16, true, 44},
+		{WAVEncodingPCM24, true, 44},
+		{WAVEncodingFloat32, true, 58},
+		{WAVEncodingAlaw, false, 58},
+		{WAVEncodingUlaw, false, 58},
+	} {
+		t.Run(tc.encoding.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.wav")
+			w, err := NewWAVFileWriter(path, WAVWriterOptions{SampleRate: 16000, Channels: 2, Encoding: tc.encoding})
+			assert.NoError(t, err)
+			pcm := stereoTone(16000, 1601)
+			n, err := w.WritePCM(pcm)
+			assert.NoError(t, err)
+			assert.Equal(t, len(pcm), n)
+			assert.Equal(t, 100062500*time.Nanosecond, w.Duration())
+			assert.NoError(t, w.Close())
+			assert.NoError(t, w.Close())
+			_, err = w.WritePCM(pcm)
+			assert.Error(t, err)
+
+			// the sizes are patched in on close
+			file, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			dataSize := len(pcm) * tc.encoding.sampleSize()
+			assert.Len(t, file, tc.header+dataSize)
+			assert.Equal(t, uint32(len(file)-8), binary.LittleEndian.Uint32(file[4:]))
+			assert.Equal(t, uint32(dataSize), binary.LittleEndian.Uint32(file[tc.header-4:]))
+			if tc.header > 44 {
+				assert.Equal(t, "fact", string(file[38:42]))
+				assert.Equal(t, uint32(1601), binary.LittleEndian.Uint32(file[46:]))
+			}
+
+			s, err := NewWAVFileStream(path)
+			assert.NoError(t, err)
+			defer s.Close()
+			assert.Equal(t, tc.encoding, s.Encoding())
+			assert.Equal(t, pcmFormat(16000, 2, 0), s.Format())
+			read := readAll(t, s)
+			assert.Len(t, read, len(pcm))
+			if tc.exact {
+				assert.Equal(t, pcm, read)
+				return
+			}
+			left := make([]int16, 1600)
+			for i := range left {
+				left[i] = read[i*2]
+			}
+			amplitude, _ := toneFit(left, 16000, 440)
+			assert.InDelta(t, 8000, amplitude, 200)
+		})
+	}
+}
+
+func TestWAVWriter_NotSeekable(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWAVWriter(&buf, WAVWriterOptions{Encoding: WAVEncodingUlaw})
+	assert.NoError(t, err)
+	_, err = w.Write([]byte{1})
+	assert.Error(t, err)
+	n, err := w.Write(Int16ToByteSlice([]int16{1000, 2000, 3000}))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.NoError(t, w.Close())
+
+	// the sizes are left unknown, with the audio padded to an even size
+	assert.Equal(t, uint32(wavUnknownSize), binary.LittleEndian.Uint32(buf.Bytes()[4:]))
+	assert.Equal(t, 58+4, buf.Len())
+	s, err := NewWAVStream(&buf)
+	assert.NoError(t, err)
+	read := readAll(t, s)
+	assert.Len(t, read, 4)
+	assert.InDelta(t, 2000, read[1], 100)
+}
+
+// wavTestFile returns a WAV file of 24 bit stereo samples in the extensible
+// format with chunks of odd sizes before the audio
+func wavTestFile(frames []byte) []byte {
+	file := []byte("RIFF\x00\x00\x00\x00WAVE")
+	file = append(file, "LIST"...)
+	file = binary.LittleEndian.AppendUint32(file, 3)
+	file = append(file, 'a', 'b', 'c', 0)
+	file = append(file, "fmt "...)
+	file = binary.LittleEndian.AppendUint32(file, 40)
+	file = binary.LittleEndian.AppendUint16(file, wavFormatExtensible)
+	file = binary.LittleEndian.AppendUint16(file, 2)
+	file = binary.LittleEndian.AppendUint32(file, 8000)
+	file = binary.LittleEndian.AppendUint32(file, 8000*6)
+	file = binary.LittleEndian.AppendUint16(file, 6)
+	file = binary.LittleEndian.AppendUint16(file, 24)
+	file = binary.LittleEndian.AppendUint16(file, 22)
+	file = binary.LittleEndian.AppendUint16(file, 24)
+	file = binary.LittleEndian.AppendUint32(file, 3)
+	file = binary.LittleEndian.AppendUint16(file, wavFormatPCM)
+	file = append(file, make([]byte, 14)...)
+	file = append(file, "data"...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(frames)))
+	file = append(file, frames...)
+	// a chunk after the audio is not read as samples
+	return append(file, "LIST\x00\x00\x00\x00"...)
+}
+
+func TestWAVStream(t *testing.T) {
+	frames := []byte{
+		0x12, 0x34, 0x12, 0x00, 0x00, 0x80,
+		0x00, 0xff, 0x7f, 0x00, 0x01, 0x00,
+		0x00, 0x00, 0x10, 0x00, 0x00, 0xf0,
+	}
+	s, err := NewWAVStream(bytes.NewReader(wavTestFile(frames)))
+	assert.NoError(t, err)
+	assert.Equal(t, WAVEncodingPCM24, s.Encoding())
+	assert.Equal(t, 8000, s.SampleRate())
+	assert.Equal(t, 2, s.ChannelCount())
+
+	// only whole frames are read
+	dst := make([]int16, 3)
+	n, err := s.ReadPCM(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int16{0x1234, -32768}, dst[:2])
+	assert.Equal(t, []int16{0x7fff, 1, 0x1000, -4096}, readAll(t, s))
+	assert.Equal(t, 375*time.Microsecond, s.Position())
+
+	assert.NoError(t, s.Seek(250*time.Microsecond))
+	assert.Equal(t, []int16{0x1000, -4096}, readAll(t, s))
+	assert.NoError(t, s.Seek(time.Second))
+	assert.Equal(t, 375*time.Microsecond, s.Position())
+	_, err = s.ReadPCM(dst)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = NewWAVStream(struct{ io.Reader }{bytes.NewReader(wavTestFile(frames))}, WAVStreamOptions{Loop: true})
+	assert.ErrorIs(t, err, ErrNotSeekable)
+	s, err = NewWAVStream(bytes.NewReader(wavTestFile(frames)), WAVStreamOptions{Loop: true})
+	assert.NoError(t, err)
+	dst = make([]int16, 10)
+	n, err = s.ReadPCM(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []int16{0x1234, -32768, 0x7fff, 1, 0x1000, -4096, 0x1234, -32768, 0x7fff, 1}, dst)
+	// the position only counts the frames read since the wrap
+	assert.Equal(t, 250*time.Microsecond, s.Position())
+	n, err = s.ReadPCM(dst[:4])
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 125*time.Microsecond, s.Position())
+}
+
+func TestWAVStream_Invalid(t *testing.T) {
+	_, err := NewWAVFileStream("testdata/1.pcm")
+	assert.ErrorIs(t, err, ErrInvalidWAV)
+
+	file := wavTestFile(nil)
+	_, err = NewWAVStream(bytes.NewReader(file[:40]))
+	assert.ErrorIs(t, err, ErrInvalidWAV)
+
+	// 8 bit PCM
+	binary.LittleEndian.PutUint16(file[46:], 8)
+	_, err = NewWAVStream(bytes.NewReader(file))
+	assert.Error(t, err)
+}
+
+func TestMultiplexer_WAV(t *testing.T) {
+	var in bytes.Buffer
+	w, err := NewWAVWriter(&in, WAVWriterOptions{SampleRate: 8000, Encoding: WAVEncodingAlaw})
+	assert.NoError(t, err)
+	_, err = w.WritePCM(sineWave(8000, 440, 800, 8000))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	s, err := NewWAVStream(&in)
+	assert.NoError(t, err)
+
+	mux := NewMultiplexer(MixerOptions{SampleRate: 16000, Channels: 1, GainRampSamples: -1})
+	assert.NoError(t, mux.AddSourceStream("announcement", s))
+	path := filepath.Join(t.TempDir(), "mix.wav")
+	recording, err := NewWAVFileWriter(path, WAVWriterOptions{SampleRate: 16000})
+	assert.NoError(t, err)
+	assert.NoError(t, mux.AddSink("recording", recording))
+	for i := 0; i < 4; i++ {
+		mux.produceFrame(20*time.Millisecond, uint64(i))
+	}
+	assert.NoError(t, recording.Close())
+
+	out, err := NewWAVFileStream(path)
+	assert.NoError(t, err)
+	defer out.Close()
+	mix := readAll(t, out)
+	assert.Len(t, mix, 4*320)
+	amplitude, _ := toneFit(mix[320:], 16000, 440)
+	assert.InDelta(t, 8000, amplitude, 400)
+}
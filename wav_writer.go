@@ -0,0 +1,225 @@
+package avmuxer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WAVWriterOptions configures a WAVWriter.
+type WAVWriterOptions struct {
+	// SampleRate of the audio, defaults to 48000.
+	SampleRate int
+	// Channels of the audio, defaults to 1.
+	Channels int
+	// Encoding of the samples in the file, defaults to WAVEncodingPCM16.
+	Encoding WAVEncoding
+}
+
+// WAVWriter records interleaved int16 PCM as a WAV file. It takes samples
+// from WritePCM, little endian bytes of them from Write, which decoding
+// streams connected to it produce, and the frames of the mixing loop as a
+// MixSink.
+//
+// The sizes in the header are left unknown, which readers take as running to
+// the end of the file, until Close patches them in when the file is an
+// io.Seeker.
+type WAVWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	closed bool
+
+	encoding   WAVEncoding
+	sampleRate int
+	channels   int
+	// factOffset is the offset of the sample count of the fact chunk, 0
+	// without one, dataOffset the one of the audio.
+	factOffset int64
+	dataOffset int64
+	dataSize   int64
+	buf        []byte
+}
+
+// NewWAVFileWriter creates the file at path and records to it. The file is
+// closed by Close.
+func NewWAVFileWriter(path string, opts ...WAVWriterOptions) (*WAVWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	ww, err := NewWAVWriter(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ww.closer = f
+	return ww, nil
+}
+
+// NewWAVWriter writes the header of a WAV file to w and returns a writer
+// recording the audio that follows.
+func NewWAVWriter(w io.Writer, opts ...WAVWriterOptions) (*WAVWriter, error) {
+	var o WAVWriterOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.SampleRate == 0 {
+		o.SampleRate = 48000
+	}
+	if o.Channels == 0 {
+		o.Channels = 1
+	}
+	if o.Encoding == 0 {
+		o.Encoding = WAVEncodingPCM16
+	}
+	if o.SampleRate < 0 || o.Channels < 0 || o.Channels > 0xffff {
+		return nil, fmt.Errorf("invalid wav format: %v Hz, %v channels", o.SampleRate, o.Channels)
+	}
+	if o.Encoding < WAVEncodingPCM16 || o.Encoding > WAVEncodingUlaw {
+		return nil, fmt.Errorf("unsupported wav encoding: %v", o.Encoding)
+	}
+
+	ww := &WAVWriter{
+		w:          w,
+		encoding:   o.Encoding,
+		sampleRate: o.SampleRate,
+		channels:   o.Channels,
+	}
+	blockAlign := o.Channels * o.Encoding.sampleSize()
+	h := append([]byte("RIFF"), 0xff, 0xff, 0xff, 0xff)
+	h = append(h, "WAVEfmt "...)
+	// formats other than PCM have an extension size and a fact chunk
+	pcm := o.Encoding.tag() == wavFormatPCM
+	if pcm {
+		h = binary.LittleEndian.AppendUint32(h, 16)
+	} else {
+		h = binary.LittleEndian.AppendUint32(h, 18)
+	}
+	h = binary.LittleEndian.AppendUint16(h, o.Encoding.tag())
+	h = binary.LittleEndian.AppendUint16(h, uint16(o.Channels))
+	h = binary.LittleEndian.AppendUint32(h, uint32(o.SampleRate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(o.SampleRate*blockAlign))
+	h = binary.LittleEndian.AppendUint16(h, uint16(blockAlign))
+	h = binary.LittleEndian.AppendUint16(h, uint16(o.Encoding.sampleSize()*8))
+	if !pcm {
+		h = append(h, 0, 0)
+		h = append(h, "fact"...)
+		h = binary.LittleEndian.AppendUint32(h, 4)
+		ww.factOffset = int64(len(h))
+		h = append(h, 0xff, 0xff, 0xff, 0xff)
+	}
+	h = append(h, "data"...)
+	h = append(h, 0xff, 0xff, 0xff, 0xff)
+	ww.dataOffset = int64(len(h))
+	if _, err := w.Write(h); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+// WritePCM records interleaved samples.
+func (ww *WAVWriter) WritePCM(pcm []int16) (int, error) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.closed {
+		return 0, errors.New("wav writer is closed")
+	}
+	ww.buf = ww.encoding.encode(ww.buf[:0], pcm)
+	// the sizes in the header are 32 bit
+	if ww.dataOffset+ww.dataSize+int64(len(ww.buf)) > wavUnknownSize-1 {
+		return 0, errors.New("wav file too large")
+	}
+	n, err := ww.w.Write(ww.buf)
+	ww.dataSize += int64(n)
+	if err != nil {
+		return n / ww.encoding.sampleSize(), err
+	}
+	return len(pcm), nil
+}
+
+// Write records little endian int16 samples.
+func (ww *WAVWriter) Write(p []byte) (int, error) {
+	if len(p)%2 != 0 {
+		return 0, errors.New("odd number of bytes of int16 samples")
+	}
+	n, err := ww.WritePCM(ByteSliceToInt16(p))
+	return n * 2, err
+}
+
+// WriteFrame records the PCM of a frame of the mixing loop.
+func (ww *WAVWriter) WriteFrame(frame MixFrame) error {
+	_, err := ww.WritePCM(frame.PCM)
+	return err
+}
+
+func (ww *WAVWriter) Format() Format {
+	return pcmFormat(ww.sampleRate, ww.channels, 0)
+}
+
+// Duration returns the duration of the audio recorded so far.
+func (ww *WAVWriter) Duration() time.Duration {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	frames := ww.dataSize / int64(ww.channels*ww.encoding.sampleSize())
+	return time.Duration(frames) * time.Second / time.Duration(ww.sampleRate)
+}
+
+// Close pads the audio to an even size, patches the sizes in the header when
+// the file is an io.Seeker and closes the file of a writer created by
+// NewWAVFileWriter.
+func (ww *WAVWriter) Close() error {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.closed {
+		return nil
+	}
+	ww.closed = true
+	err := ww.finish()
+	if ww.closer != nil {
+		if cErr := ww.closer.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// finish writes the padding and the sizes. Must be called with the lock held.
+func (ww *WAVWriter) finish() error {
+	size := ww.dataOffset + ww.dataSize
+	if ww.dataSize%2 != 0 {
+		if _, err := ww.w.Write([]byte{0}); err != nil {
+			return err
+		}
+		size++
+	}
+	seeker, ok := ww.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	patch := func(offset int64, v uint32) error {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := seeker.Write(binary.LittleEndian.AppendUint32(nil, v))
+		return err
+	}
+	if err := patch(4, uint32(size-8)); err != nil {
+		return err
+	}
+	if ww.factOffset > 0 {
+		frames := ww.dataSize / int64(ww.channels*ww.encoding.sampleSize())
+		if err := patch(ww.factOffset, uint32(frames)); err != nil {
+			return err
+		}
+	}
+	if err := patch(ww.dataOffset-4, uint32(ww.dataSize)); err != nil {
+		return err
+	}
+	_, err := seeker.Seek(size, io.SeekStart)
+	return err
+}